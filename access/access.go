@@ -0,0 +1,182 @@
+package access
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/atomic"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/metrics"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+var (
+	ErrBanned          = errors.New("ip banned")
+	ErrDenied          = errors.New("ip not allowed")
+	ErrTooManyConns    = errors.New("too many connections of ip")
+	ErrTooManyNewConns = errors.New("too many new connections of ip")
+)
+
+type rules struct {
+	allow                utils.Prefixes
+	deny                 utils.Prefixes
+	allowFile            *listFile
+	denyFile             *listFile
+	maxConns             int
+	maxNewConnsPerSecond int
+	banMaxFails          int
+	banWindow            time.Duration
+	banDuration          time.Duration
+}
+
+// newRules returns nil if accessConfig is empty
+func newRules(accessConfig config.AccessConfig) (*rules, error) {
+	r := &rules{
+		maxConns:             accessConfig.MaxConnsPerIP,
+		maxNewConnsPerSecond: accessConfig.MaxNewConnsPerSecondPerIP,
+		banMaxFails:          accessConfig.BanMaxFails,
+		banWindow:            time.Duration(accessConfig.BanWindow) * time.Second,
+		banDuration:          time.Duration(accessConfig.BanDuration) * time.Second,
+	}
+	if r.banWindow <= 0 {
+		r.banWindow = DefaultBanWindow
+	}
+	if r.banDuration <= 0 {
+		r.banDuration = DefaultBanDuration
+	}
+	var err error
+	if r.allow, err = utils.ParsePrefixes(accessConfig.Allow); err != nil {
+		return nil, err
+	}
+	if r.deny, err = utils.ParsePrefixes(accessConfig.Deny); err != nil {
+		return nil, err
+	}
+	if len(accessConfig.AllowFile) > 0 {
+		if r.allowFile, err = newListFile(accessConfig.AllowFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(accessConfig.DenyFile) > 0 {
+		if r.denyFile, err = newListFile(accessConfig.DenyFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.allow) == 0 && len(r.deny) == 0 && r.allowFile == nil && r.denyFile == nil &&
+		r.maxConns <= 0 && r.maxNewConnsPerSecond <= 0 && r.banMaxFails <= 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *rules) allowed(addr netip.Addr) bool {
+	if r.deny.Contains(addr) || (r.denyFile != nil && r.denyFile.load().Contains(addr)) {
+		return false
+	}
+	if len(r.allow) == 0 && r.allowFile == nil {
+		return true
+	}
+	return r.allow.Contains(addr) || (r.allowFile != nil && r.allowFile.load().Contains(addr))
+}
+
+type ipState struct {
+	conns    int
+	second   int64 // the window of newConns
+	newConns int
+}
+
+// Limiter enforces the access rules of a listener,
+// the per-ip states are kept when the rules updated by a config reload
+type Limiter struct {
+	address string
+	rules   atomic.Pointer[rules]
+
+	mu        sync.Mutex
+	ips       map[netip.Addr]*ipState
+	lastSweep int64
+}
+
+func NewLimiter(address string) *Limiter {
+	return &Limiter{address: address, ips: make(map[netip.Addr]*ipState)}
+}
+
+func (l *Limiter) Update(accessConfig config.AccessConfig) error {
+	r, err := newRules(accessConfig)
+	if err != nil {
+		return err
+	}
+	l.rules.Store(r)
+	return nil
+}
+
+func noop() {}
+
+// Acquire checks a new connection from remote ("ip:port" or "ip"),
+// release must be called once the connection closed if no error returned
+func (l *Limiter) Acquire(remote string) (release func(), err error) {
+	r := l.rules.Load()
+	if r == nil {
+		return noop, nil
+	}
+	addr := utils.ParseAddr(remote)
+	if !addr.IsValid() {
+		return noop, nil
+	}
+	if r.banMaxFails > 0 && l.banned(addr) {
+		metrics.AccessRejected.With(l.address, "ban").Inc()
+		return nil, ErrBanned
+	}
+	if !r.allowed(addr) {
+		metrics.AccessRejected.With(l.address, "deny").Inc()
+		return nil, ErrDenied
+	}
+	if r.maxConns <= 0 && r.maxNewConnsPerSecond <= 0 {
+		return noop, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	l.sweep(now)
+	state, ok := l.ips[addr]
+	if !ok {
+		state = &ipState{}
+		l.ips[addr] = state
+	}
+	if state.second != now {
+		state.second = now
+		state.newConns = 0
+	}
+	if r.maxConns > 0 && state.conns >= r.maxConns {
+		metrics.AccessRejected.With(l.address, "conns").Inc()
+		return nil, ErrTooManyConns
+	}
+	if r.maxNewConnsPerSecond > 0 && state.newConns >= r.maxNewConnsPerSecond {
+		metrics.AccessRejected.With(l.address, "rate").Inc()
+		return nil, ErrTooManyNewConns
+	}
+	state.conns++
+	state.newConns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			state.conns--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// sweep removes the idle states at most once per second
+func (l *Limiter) sweep(now int64) {
+	if l.lastSweep == now {
+		return
+	}
+	l.lastSweep = now
+	for addr, state := range l.ips {
+		if state.conns <= 0 && state.second != now {
+			delete(l.ips, addr)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+var limiterSeq int
+
+// newLimiter returns a Limiter of a unique address, as the ban tables are shared by the Limiters of the same address
+func newLimiter(t *testing.T, accessConfig config.AccessConfig) *Limiter {
+	t.Helper()
+	limiterSeq++
+	l := NewLimiter(fmt.Sprintf("%s-%d", t.Name(), limiterSeq))
+	if err := l.Update(accessConfig); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name         string
+		accessConfig config.AccessConfig
+		remote       string
+		expect       error
+	}{
+		{"no rules", config.AccessConfig{}, "1.1.1.1:80", nil},
+		{"allowed", config.AccessConfig{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3:80", nil},
+		{"not in allow", config.AccessConfig{Allow: []string{"10.0.0.0/8"}}, "1.1.1.1:80", ErrDenied},
+		{"denied", config.AccessConfig{Deny: []string{"1.1.1.1"}}, "1.1.1.1:80", ErrDenied},
+		{"not in deny", config.AccessConfig{Deny: []string{"1.1.1.1"}}, "1.1.1.2:80", nil},
+		{"deny over allow", config.AccessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}, "10.1.2.3:80", ErrDenied},
+		{"ipv4 mapped", config.AccessConfig{Deny: []string{"1.1.1.1"}}, "[::ffff:1.1.1.1]:80", ErrDenied},
+		{"ipv6", config.AccessConfig{Allow: []string{"2001:db8::/32"}}, "[2001:db8::1]:80", nil},
+		{"ip without port", config.AccessConfig{Deny: []string{"1.1.1.1"}}, "1.1.1.1", ErrDenied},
+		{"invalid remote", config.AccessConfig{Allow: []string{"10.0.0.0/8"}}, "pipe", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(t, tt.accessConfig)
+			release, err := l.Acquire(tt.remote)
+			if err != tt.expect {
+				t.Fatalf("acquire = %v, want %v", err, tt.expect)
+			}
+			if err == nil {
+				release()
+			}
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		accessConfig config.AccessConfig
+	}{
+		{"invalid allow", config.AccessConfig{Allow: []string{"10.0.0.0/33"}}},
+		{"invalid deny", config.AccessConfig{Deny: []string{"example.com"}}},
+		{"missing allow file", config.AccessConfig{AllowFile: filepath.Join(t.TempDir(), "missing")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewLimiter(t.Name()).Update(tt.accessConfig); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	l := newLimiter(t, config.AccessConfig{MaxConnsPerIP: 2})
+	first, err := l.Acquire("1.1.1.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire("1.1.1.1:2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire("1.1.1.1:3"); err != ErrTooManyConns {
+		t.Fatalf("acquire = %v, want %v", err, ErrTooManyConns)
+	}
+	if _, err = l.Acquire("1.1.1.2:1"); err != nil {
+		t.Fatalf("acquire of another ip = %v", err)
+	}
+	first()
+	first() // released only once
+	if _, err = l.Acquire("1.1.1.1:3"); err != nil {
+		t.Fatalf("acquire after released = %v", err)
+	}
+	if _, err = l.Acquire("1.1.1.1:4"); err != ErrTooManyConns {
+		t.Fatalf("acquire = %v, want %v", err, ErrTooManyConns)
+	}
+
+	// the states are kept by a reload
+	if err = l.Update(config.AccessConfig{MaxConnsPerIP: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire("1.1.1.1:4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire("1.1.1.1:5"); err != ErrTooManyConns {
+		t.Fatalf("acquire after reload = %v, want %v", err, ErrTooManyConns)
+	}
+}
+
+func TestMaxNewConnsPerSecond(t *testing.T) {
+	l := newLimiter(t, config.AccessConfig{MaxNewConnsPerSecondPerIP: 2})
+	// start at the beginning of a second, so all of them are in the same window
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire("1.1.1.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if _, err := l.Acquire("1.1.1.1:1"); err != ErrTooManyNewConns {
+		t.Fatalf("acquire = %v, want %v", err, ErrTooManyNewConns)
+	}
+	if _, err := l.Acquire("1.1.1.2:1"); err != nil {
+		t.Fatalf("acquire of another ip = %v", err)
+	}
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if _, err := l.Acquire("1.1.1.1:1"); err != nil {
+		t.Fatalf("acquire in the next second = %v", err)
+	}
+}
+
+func TestListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# comment\n1.1.1.1 # inline\n\n10.0.0.0/8\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(t, config.AccessConfig{DenyFile: path})
+	tests := []struct {
+		remote string
+		expect error
+	}{
+		{"1.1.1.1:80", ErrDenied},
+		{"10.1.2.3:80", ErrDenied},
+		{"2.2.2.2:80", nil},
+	}
+	for _, tt := range tests {
+		if _, err := l.Acquire(tt.remote); err != tt.expect {
+			t.Fatalf("acquire %s = %v, want %v", tt.remote, err, tt.expect)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("2.2.2.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	f := l.rules.Load().denyFile
+	f.mu.Lock()
+	f.lastCheck = time.Time{}
+	f.mu.Unlock()
+	if _, err := l.Acquire("2.2.2.2:80"); err != ErrDenied {
+		t.Fatalf("acquire after modified = %v, want %v", err, ErrDenied)
+	}
+	if _, err := l.Acquire("1.1.1.1:80"); err != nil {
+		t.Fatalf("acquire after modified = %v", err)
+	}
+
+	// the old list is kept if the file is removed
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.lastCheck = time.Time{}
+	f.mu.Unlock()
+	if _, err := l.Acquire("2.2.2.2:80"); err != ErrDenied {
+		t.Fatalf("acquire after removed = %v, want %v", err, ErrDenied)
+	}
+}
+
+func TestBan(t *testing.T) {
+	l := newLimiter(t, config.AccessConfig{BanMaxFails: 3})
+	ctx := WithLimiter(context.Background(), l)
+	for i := 0; i < 2; i++ {
+		Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+	}
+	if _, err := l.Acquire("1.1.1.1:1"); err != nil {
+		t.Fatalf("acquire before banned = %v", err)
+	}
+	Fail(ctx, "1.1.1.1:2", FailTrojanAuth)
+	if _, err := l.Acquire("1.1.1.1:3"); err != ErrBanned {
+		t.Fatalf("acquire = %v, want %v", err, ErrBanned)
+	}
+	if reason, _ := banTable.Get(banKey{listener: l.address, addr: netip.MustParseAddr("1.1.1.1")}); reason != FailTrojanAuth {
+		t.Fatalf("ban reason = %s, want %s", reason, FailTrojanAuth)
+	}
+	if _, err := l.Acquire("1.1.1.2:1"); err != nil {
+		t.Fatalf("acquire of another ip = %v", err)
+	}
+
+	// kept by the Limiter of a reloaded config
+	reloaded := NewLimiter(l.address)
+	if err := reloaded.Update(config.AccessConfig{BanMaxFails: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Acquire("1.1.1.1:1"); err != ErrBanned {
+		t.Fatalf("acquire after reload = %v, want %v", err, ErrBanned)
+	}
+	// but not shared with other listeners
+	other := NewLimiter(l.address + "-other")
+	if err := other.Update(config.AccessConfig{BanMaxFails: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Acquire("1.1.1.1:1"); err != nil {
+		t.Fatalf("acquire of another listener = %v", err)
+	}
+}
+
+func TestBanDisabled(t *testing.T) {
+	tests := []struct {
+		name         string
+		accessConfig config.AccessConfig
+		withLimiter  bool
+	}{
+		{"no ban-max-fails", config.AccessConfig{MaxConnsPerIP: 10}, true},
+		{"no rules", config.AccessConfig{}, true},
+		{"no limiter in context", config.AccessConfig{BanMaxFails: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(t, tt.accessConfig)
+			ctx := context.Background()
+			if tt.withLimiter {
+				ctx = WithLimiter(ctx, l)
+			}
+			for i := 0; i < 3; i++ {
+				Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+			}
+			if _, ok := banTable.Get(banKey{listener: l.address, addr: netip.MustParseAddr("1.1.1.1")}); ok {
+				t.Fatal("banned")
+			}
+		})
+	}
+}
+
+func TestFailDecay(t *testing.T) {
+	l := newLimiter(t, config.AccessConfig{BanMaxFails: 3, BanWindow: 60})
+	ctx := WithLimiter(context.Background(), l)
+	key := banKey{listener: l.address, addr: netip.MustParseAddr("1.1.1.1")}
+	Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+	Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+
+	// 2 failures a window ago count as 1
+	failuresMu.Lock()
+	f, _ := failureTable.Get(key)
+	f.last = f.last.Add(-time.Minute)
+	failuresMu.Unlock()
+	Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+	if _, err := l.Acquire("1.1.1.1:1"); err != nil {
+		t.Fatalf("acquire after decayed = %v", err)
+	}
+	Fail(ctx, "1.1.1.1:1", FailUnrecognized)
+	if _, err := l.Acquire("1.1.1.1:1"); err != ErrBanned {
+		t.Fatalf("acquire = %v, want %v", err, ErrBanned)
+	}
+	if _, ok := failureTable.Get(key); ok {
+		t.Fatal("failures kept after banned")
+	}
+}
@@ -0,0 +1,105 @@
+package access
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/metrics"
+	"github.com/wwqgtxx/wstunnel/utils"
+	cache "github.com/wwqgtxx/wstunnel/utils/lrucache"
+)
+
+const (
+	DefaultBanWindow   = 10 * time.Minute
+	DefaultBanDuration = 10 * time.Minute
+
+	maxBanEntries = 1 << 16
+)
+
+// the failure reasons
+const (
+	FailUnrecognized = "unrecognized" // matched none of the fallbacks of a WebSocket listener
+	FailUnknownSNI   = "unknown-sni"  // tls with a sni served by neither a local certificate nor a tls-fallback
+	FailTrojanAuth   = "trojan-auth"  // a trojan header with an unknown password
+	FailVlessAuth    = "vless-auth"   // a vless header with an unknown uuid
+	FailWSAuth       = "ws-auth"      // WebSocket upgrade rejected by auth
+)
+
+type banKey struct {
+	listener string
+	addr     netip.Addr
+}
+
+type failures struct {
+	score float64 // halved every ban-window
+	last  time.Time
+}
+
+// failures and bans are shared by all Limiters of a listener, so they are kept across config reloads
+var (
+	failuresMu   sync.Mutex
+	failureTable = cache.New[banKey, *failures](
+		cache.WithAge[banKey, *failures](math.MaxInt32), // expired by SetWithExpire
+		cache.WithSize[banKey, *failures](maxBanEntries),
+	)
+	banTable = cache.New[banKey, string](
+		cache.WithAge[banKey, string](math.MaxInt32),
+		cache.WithSize[banKey, string](maxBanEntries),
+	)
+)
+
+type limiterKey struct{}
+
+// WithLimiter makes the failures reported by Fail counted for l
+func WithLimiter(ctx context.Context, l *Limiter) context.Context {
+	return context.WithValue(ctx, limiterKey{}, l)
+}
+
+// Fail reports a failure of remote to the Limiter of ctx, remote is banned once it failed ban-max-fails times
+func Fail(ctx context.Context, remote string, reason string) {
+	l, _ := ctx.Value(limiterKey{}).(*Limiter)
+	if l == nil {
+		return
+	}
+	r := l.rules.Load()
+	if r == nil || r.banMaxFails <= 0 {
+		return
+	}
+	addr := utils.ParseAddr(remote)
+	if !addr.IsValid() {
+		return
+	}
+	key := banKey{listener: l.address, addr: addr}
+	now := time.Now()
+
+	failuresMu.Lock()
+	f, ok := failureTable.Get(key)
+	if !ok {
+		f = &failures{}
+	}
+	f.score = f.score*math.Exp2(-now.Sub(f.last).Seconds()/r.banWindow.Seconds()) + 1
+	f.last = now
+	banned := math.Round(f.score) >= float64(r.banMaxFails)
+	if banned {
+		failureTable.Delete(key)
+	} else {
+		failureTable.SetWithExpire(key, f, now.Add(4*r.banWindow))
+	}
+	failuresMu.Unlock()
+
+	slog.DebugContext(ctx, "Access failure", "address", l.address, "remote", remote, "reason", reason)
+	if banned {
+		banTable.SetWithExpire(key, reason, now.Add(r.banDuration))
+		metrics.AccessBans.With(l.address, reason).Inc()
+		slog.WarnContext(ctx, "Ban", "address", l.address, "remote", addr.String(), "reason", reason, "duration", r.banDuration)
+	}
+}
+
+func (l *Limiter) banned(addr netip.Addr) bool {
+	_, ok := banTable.Get(banKey{listener: l.address, addr: addr})
+	return ok
+}
@@ -0,0 +1,82 @@
+package access
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+const fileCheckInterval = 10 * time.Second
+
+// listFile is a list of CIDRs which is reloaded when the file modified,
+// so it could be fed by external tools without reloading the config
+type listFile struct {
+	path string
+
+	mu        sync.Mutex
+	prefixes  utils.Prefixes
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newListFile(path string) (*listFile, error) {
+	f := &listFile{path: path}
+	if err := f.reload(); err != nil { // check at startup
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *listFile) load() utils.Prefixes {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.lastCheck) < fileCheckInterval {
+		return f.prefixes
+	}
+	if err := f.reload(); err != nil {
+		slog.Warn("Reload access list failed, keep the old one", "file", f.path, "err", err)
+	}
+	return f.prefixes
+}
+
+func (f *listFile) reload() error {
+	f.lastCheck = time.Now()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if !f.modTime.IsZero() && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var cidrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	prefixes, err := utils.ParsePrefixes(cidrs)
+	if err != nil {
+		return err
+	}
+	if !f.modTime.IsZero() {
+		slog.Info("Reload access list", "file", f.path, "count", len(prefixes))
+	}
+	f.prefixes = prefixes
+	f.modTime = info.ModTime()
+	return nil
+}
@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/tunnel"
+)
+
+type connection struct {
+	ID       uint64    `json:"id"`
+	Network  string    `json:"network"`
+	Listener string    `json:"listener"`
+	Remote   string    `json:"remote"`
+	Fallback string    `json:"fallback,omitempty"`
+	Target   string    `json:"target"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Start    time.Time `json:"start"`
+	Received int64     `json:"received"`
+	Sent     int64     `json:"sent"`
+}
+
+var (
+	serverMu      sync.Mutex
+	server        *http.Server
+	serverAddress string
+	token         atomic.Pointer[string]
+)
+
+func authorized(r *http.Request) bool {
+	want := token.Load()
+	if want == nil {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(*want)) == 1
+}
+
+func withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	entries := tunnel.List()
+	connections := make([]connection, 0, len(entries))
+	for _, e := range entries {
+		connections = append(connections, connection{
+			ID:       e.ID,
+			Network:  e.Network,
+			Listener: e.Listener,
+			Remote:   e.Remote,
+			Fallback: e.Fallback,
+			Target:   e.Target,
+			Proxy:    e.Proxy,
+			Start:    e.Start,
+			Received: e.Received.Load(),
+			Sent:     e.Sent.Load(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(connections)
+}
+
+func killConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if !tunnel.Kill(id) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Admin killed connection", "id", id, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serve serves the admin api on address, an empty address stops serving,
+// calling it again with the same address only updates the token
+func Serve(address string, bearerToken string) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	if len(bearerToken) > 0 {
+		token.Store(&bearerToken)
+	} else {
+		token.Store(nil)
+	}
+	if address == serverAddress && server != nil {
+		return
+	}
+	if server != nil {
+		slog.Info("Close Admin Listening", "address", serverAddress)
+		_ = server.Close()
+		server = nil
+	}
+	serverAddress = address
+	if len(address) == 0 {
+		return
+	}
+	if len(bearerToken) == 0 {
+		slog.Error("admin-token is required to serve admin api", "address", address)
+		return
+	}
+	slog.Info("New Admin Listening", "address", address)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("Listen failed", "address", address, "err", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", withAuth(listConnections))
+	mux.HandleFunc("DELETE /connections/{id}", withAuth(killConnection))
+	server = &http.Server{Handler: mux}
+	go func(server *http.Server) {
+		err := server.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Serve failed", "address", ln.Addr().String(), "err", err)
+		}
+	}(server)
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	cache "github.com/wwqgtxx/wstunnel/utils/lrucache"
+)
+
+const (
+	DefaultHeader = "X-Auth-Token"
+	DefaultWindow = 60 * time.Second
+
+	nonceSize     = 16
+	maxNonceCache = 1 << 16
+)
+
+var (
+	ErrMissingToken = errors.New("missing auth token")
+	ErrInvalidToken = errors.New("invalid auth token")
+	ErrExpiredToken = errors.New("expired auth token")
+	ErrReplayToken  = errors.New("replayed auth token")
+)
+
+// nonces are shared by all Auth, so they are kept across config reloads
+var noncesMu sync.Mutex
+var nonces = cache.New[string, struct{}](
+	cache.WithAge[string, struct{}](int64(2*DefaultWindow/time.Second)),
+	cache.WithSize[string, struct{}](maxNonceCache),
+)
+
+// Auth signs and verifies the time-windowed token of a WebSocket upgrade,
+// the token is "timestamp.nonce.mac" where mac is the HMAC-SHA256 over path, timestamp and nonce
+type Auth struct {
+	secret []byte
+	header string
+	query  string
+	window time.Duration
+}
+
+// New returns nil if authConfig has no secret
+func New(authConfig config.AuthConfig) *Auth {
+	if len(authConfig.AuthSecret) == 0 {
+		return nil
+	}
+	a := &Auth{
+		secret: []byte(authConfig.AuthSecret),
+		header: authConfig.AuthHeader,
+		query:  authConfig.AuthQuery,
+		window: time.Duration(authConfig.AuthWindow) * time.Second,
+	}
+	if len(a.header) == 0 {
+		a.header = DefaultHeader
+	}
+	if a.window <= 0 {
+		a.window = DefaultWindow
+	}
+	return a
+}
+
+// mac takes an empty path as "/", which is sent in the request line for the url without a path
+func (a *Auth) mac(path, timestamp, nonce string) []byte {
+	if len(path) == 0 {
+		path = "/"
+	}
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(path))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(nonce))
+	return h.Sum(nil)
+}
+
+func (a *Auth) Token(path string, now time.Time) string {
+	nonceBuf := make([]byte, nonceSize)
+	_, _ = rand.Read(nonceBuf)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBuf)
+	return timestamp + "." + nonce + "." + base64.RawURLEncoding.EncodeToString(a.mac(path, timestamp, nonce))
+}
+
+// Sign puts a new token for u into the header or the query of u
+func (a *Auth) Sign(u *url.URL, header http.Header) {
+	token := a.Token(u.Path, time.Now())
+	if len(a.query) > 0 {
+		q := u.Query()
+		q.Set(a.query, token)
+		u.RawQuery = q.Encode()
+		return
+	}
+	header.Set(a.header, token)
+}
+
+func (a *Auth) Verify(path, token string, now time.Time) error {
+	if len(token) == 0 {
+		return ErrMissingToken
+	}
+	timestamp, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+	nonce, mac, ok := strings.Cut(rest, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+	macBuf, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(macBuf, a.mac(path, timestamp, nonce)) {
+		return ErrInvalidToken
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > a.window || d < -a.window {
+		return ErrExpiredToken
+	}
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	if nonces.Exist(nonce) {
+		return ErrReplayToken
+	}
+	nonces.SetWithExpire(nonce, struct{}{}, time.Unix(unix, 0).Add(a.window+time.Second))
+	return nil
+}
+
+func (a *Auth) VerifyRequest(r *http.Request) error {
+	var token string
+	if len(a.query) > 0 {
+		token = r.URL.Query().Get(a.query)
+	} else {
+		token = r.Header.Get(a.header)
+	}
+	return a.Verify(r.URL.Path, token, time.Now())
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+func TestNew(t *testing.T) {
+	if New(config.AuthConfig{}) != nil {
+		t.Fatal("auth without secret is not nil")
+	}
+	a := New(config.AuthConfig{AuthSecret: "secret"})
+	if a.header != DefaultHeader || a.window != DefaultWindow {
+		t.Fatalf("defaults = %s %s", a.header, a.window)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	a := New(config.AuthConfig{AuthSecret: "secret", AuthWindow: 60})
+	other := New(config.AuthConfig{AuthSecret: "other"})
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		expect error
+	}{
+		{"valid", a.Token("/ws", now), "/ws", nil},
+		{"within window", a.Token("/ws", now.Add(-59*time.Second)), "/ws", nil},
+		{"clock skew within window", a.Token("/ws", now.Add(59*time.Second)), "/ws", nil},
+		{"expired", a.Token("/ws", now.Add(-61*time.Second)), "/ws", ErrExpiredToken},
+		{"from future", a.Token("/ws", now.Add(61*time.Second)), "/ws", ErrExpiredToken},
+		{"other path", a.Token("/ws", now), "/other", ErrInvalidToken},
+		{"other secret", other.Token("/ws", now), "/ws", ErrInvalidToken},
+		{"tampered timestamp", "1" + a.Token("/ws", now), "/ws", ErrInvalidToken},
+		{"tampered mac", a.Token("/ws", now) + "A", "/ws", ErrInvalidToken},
+		{"missing", "", "/ws", ErrMissingToken},
+		{"no separator", "abc", "/ws", ErrInvalidToken},
+		{"no mac", "123.nonce", "/ws", ErrInvalidToken},
+		{"invalid base64", "123.nonce.!!!", "/ws", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.Verify(tt.path, tt.token, now); err != tt.expect {
+				t.Fatalf("verify = %v, want %v", err, tt.expect)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	now := time.Now()
+	a := New(config.AuthConfig{AuthSecret: "secret"})
+	token := a.Token("/ws", now)
+	if err := a.Verify("/ws", token, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify("/ws", token, now); err != ErrReplayToken {
+		t.Fatalf("verify replayed = %v, want %v", err, ErrReplayToken)
+	}
+	// replayed by another Auth of a reloaded config
+	b := New(config.AuthConfig{AuthSecret: "secret"})
+	if err := b.Verify("/ws", token, now); err != ErrReplayToken {
+		t.Fatalf("verify replayed after reload = %v, want %v", err, ErrReplayToken)
+	}
+	if err := a.Verify("/ws", a.Token("/ws", now), now); err != nil {
+		t.Fatalf("verify new token = %v", err)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		authConfig config.AuthConfig
+		inHeader   string
+		inQuery    string
+	}{
+		{"default header", config.AuthConfig{AuthSecret: "secret"}, DefaultHeader, ""},
+		{"custom header", config.AuthConfig{AuthSecret: "secret", AuthHeader: "X-Token"}, "X-Token", ""},
+		{"query", config.AuthConfig{AuthSecret: "secret", AuthQuery: "token"}, "", "token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(tt.authConfig)
+			u, _ := url.Parse("wss://example.com/ws?ed=2048")
+			header := http.Header{}
+			a.Sign(u, header)
+			if len(tt.inHeader) > 0 && len(header.Get(tt.inHeader)) == 0 {
+				t.Fatalf("no token in header %s", tt.inHeader)
+			}
+			if len(tt.inQuery) > 0 {
+				if len(u.Query().Get(tt.inQuery)) == 0 || len(header) > 0 {
+					t.Fatalf("token not only in query %s: %s %v", tt.inQuery, u, header)
+				}
+				if u.Query().Get("ed") != "2048" {
+					t.Fatalf("other query lost: %s", u)
+				}
+			}
+
+			r := &http.Request{URL: u, Header: header}
+			if err := a.VerifyRequest(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.VerifyRequest(r); err != ErrReplayToken {
+				t.Fatalf("verify replayed request = %v, want %v", err, ErrReplayToken)
+			}
+		})
+	}
+}
+
+func TestSignNoPath(t *testing.T) {
+	a := New(config.AuthConfig{AuthSecret: "secret"})
+	u, _ := url.Parse("ws://example.com:8080")
+	header := http.Header{}
+	a.Sign(u, header)
+	// the request of a url without a path is sent with "/"
+	if err := a.Verify("/", header.Get(DefaultHeader), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify("", a.Token("/", time.Now()), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenFormat(t *testing.T) {
+	a := New(config.AuthConfig{AuthSecret: "secret"})
+	first, second := a.Token("/ws", time.Now()), a.Token("/ws", time.Now())
+	if strings.Count(first, ".") != 2 {
+		t.Fatalf("token = %s, want timestamp.nonce.mac", first)
+	}
+	if first == second {
+		t.Fatal("tokens with the same nonce")
+	}
+}
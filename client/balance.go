@@ -0,0 +1,273 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/common"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+const (
+	StrategyFailover      = "failover"
+	StrategyRoundRobin    = "round-robin"
+	StrategyLeastConns    = "least-conns"
+	StrategyLowestLatency = "lowest-latency"
+
+	DefaultMaxFails    = 3
+	DefaultFailTimeout = 30 * time.Second
+)
+
+type upstream struct {
+	*wsClientImpl
+	active    atomic.Int64
+	latency   atomic.Int64 // nanoseconds of the last successful handshake, 0 if unknown
+	fails     atomic.Int32 // consecutive dial errors
+	downUntil atomic.Int64 // unix nanoseconds, ejected by passive or active health check until
+}
+
+func (u *upstream) available(now time.Time) bool {
+	return now.UnixNano() >= u.downUntil.Load()
+}
+
+func (u *upstream) succeed(latency time.Duration) {
+	u.latency.Store(int64(latency))
+	u.fails.Store(0)
+	u.downUntil.Store(0)
+}
+
+func (u *upstream) fail(maxFails int32, failTimeout time.Duration) {
+	if u.fails.Add(1) >= maxFails {
+		if u.downUntil.Swap(time.Now().Add(failTimeout).UnixNano()) == 0 {
+			slog.Warn("Eject upstream", "target", u.Target(), "fails", u.fails.Load())
+		}
+	}
+}
+
+// balanceClientImpl dials one of the wsClientImpls selected by strategy,
+// the unavailable upstreams are only tried after all available ones failed
+type balanceClientImpl struct {
+	upstreams           []*upstream
+	strategy            string
+	next                atomic.Uint32
+	maxFails            int32
+	failTimeout         time.Duration
+	healthCheckInterval time.Duration
+	startOnce           sync.Once
+	stopOnce            sync.Once
+	stop                chan struct{}
+}
+
+var _ common.ClientImpl = (*balanceClientImpl)(nil)
+
+func (c *balanceClientImpl) Target() string {
+	targets := make([]string, len(c.upstreams))
+	for i, u := range c.upstreams {
+		targets[i] = u.Target()
+	}
+	return strings.Join(targets, ",")
+}
+
+func (c *balanceClientImpl) Proxy() string {
+	return c.upstreams[0].Proxy()
+}
+
+// candidates returns the upstreams in the order to try
+func (c *balanceClientImpl) candidates() []*upstream {
+	list := slices.Clone(c.upstreams)
+	switch c.strategy {
+	case StrategyRoundRobin:
+		n := int(c.next.Add(1)) % len(list)
+		list = append(list[n:], list[:n]...)
+	case StrategyLeastConns:
+		slices.SortStableFunc(list, func(a, b *upstream) int { return cmp.Compare(a.active.Load(), b.active.Load()) })
+	case StrategyLowestLatency:
+		slices.SortStableFunc(list, func(a, b *upstream) int { return cmp.Compare(a.latency.Load(), b.latency.Load()) })
+	}
+	now := time.Now()
+	slices.SortStableFunc(list, func(a, b *upstream) int {
+		switch aa, ba := a.available(now), b.available(now); {
+		case aa == ba:
+			return 0
+		case aa:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return list
+}
+
+func (c *balanceClientImpl) Handle(ctx context.Context, tcp net.Conn) {
+	defer tcp.Close()
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "target", c.Target(), "proxy", c.Proxy())
+	edBuf, err := utils.PrepareXray0rtt(tcp, c.upstreams[0].ed)
+	if err != nil {
+		slog.WarnContext(ctx, "Read early data failed", "err", err)
+		return
+	}
+	conn, err := c.Dial(ctx, edBuf, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Dial failed", "target", c.Target(), "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.TunnelTcp(ctx, tcp)
+}
+
+func (c *balanceClientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	var errs []error
+	for _, u := range c.candidates() {
+		start := time.Now()
+		conn, err := u.Dial(ctx, edBuf, inHeader)
+		if err != nil {
+			slog.DebugContext(ctx, "Dial upstream failed", "target", u.Target(), "err", err)
+			u.fail(c.maxFails, c.failTimeout)
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		u.succeed(time.Since(start))
+		u.active.Add(1)
+		return &balanceClientConn{ClientConn: conn, upstream: u}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// start runs the active health checks, it is called when the owner client started
+func (c *balanceClientImpl) start() {
+	for _, u := range c.upstreams {
+		startClientImpl(u.wsClientImpl)
+	}
+	if c.healthCheckInterval <= 0 {
+		return
+	}
+	c.startOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(c.healthCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-c.stop:
+					return
+				case <-ticker.C:
+					c.healthCheck()
+				}
+			}
+		}()
+	})
+}
+
+func (c *balanceClientImpl) healthCheck() {
+	var wg sync.WaitGroup
+	for _, u := range c.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+			defer cancel()
+			start := time.Now()
+			// a real handshake closed right away, so only an upgraded response is healthy
+			conn, _, err := u.dialWebsocket(ctx, u.header.Clone())
+			if err != nil {
+				if u.downUntil.Swap(time.Now().Add(c.healthCheckInterval).UnixNano()) == 0 {
+					slog.Warn("Health check failed", "target", u.Target(), "err", err)
+				}
+				return
+			}
+			_ = conn.Close()
+			if u.downUntil.Load() != 0 {
+				slog.Info("Health check recovered", "target", u.Target())
+			}
+			u.succeed(time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *balanceClientImpl) drain() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	for _, u := range c.upstreams {
+		drainClientImpl(u.wsClientImpl)
+	}
+}
+
+type balanceClientConn struct {
+	common.ClientConn
+	upstream *upstream
+	close    sync.Once
+}
+
+func (c *balanceClientConn) Close() {
+	c.close.Do(func() {
+		c.ClientConn.Close()
+		c.upstream.active.Add(-1)
+	})
+}
+
+func NewBalanceClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error) {
+	switch clientConfig.Strategy {
+	case "":
+		clientConfig.Strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastConns, StrategyLowestLatency:
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", clientConfig.Strategy)
+	}
+	c := &balanceClientImpl{
+		strategy:            clientConfig.Strategy,
+		maxFails:            int32(clientConfig.MaxFails),
+		failTimeout:         time.Duration(clientConfig.FailTimeout) * time.Second,
+		healthCheckInterval: time.Duration(clientConfig.HealthCheckInterval) * time.Second,
+		stop:                make(chan struct{}),
+	}
+	if c.maxFails <= 0 {
+		c.maxFails = DefaultMaxFails
+	}
+	if c.failTimeout <= 0 {
+		c.failTimeout = DefaultFailTimeout
+	}
+	for _, wsUrlConfig := range clientConfig.WSUrls {
+		upstreamConfig := clientConfig
+		upstreamConfig.WSUrls = nil
+		upstreamConfig.WSUrl = wsUrlConfig.WSUrl
+		if len(wsUrlConfig.WSHeaders) > 0 {
+			upstreamConfig.WSHeaders = wsUrlConfig.WSHeaders
+		}
+		if len(wsUrlConfig.ServerName) > 0 {
+			upstreamConfig.ServerName = wsUrlConfig.ServerName
+		}
+		if len(wsUrlConfig.Proxy) > 0 {
+			upstreamConfig.Proxy = wsUrlConfig.Proxy
+		}
+		if len(wsUrlConfig.AuthSecret) > 0 {
+			upstreamConfig.AuthConfig = wsUrlConfig.AuthConfig
+		}
+		upstreamConfig.SkipCertVerify = upstreamConfig.SkipCertVerify || wsUrlConfig.SkipCertVerify
+		upstreamConfig.V2rayHttpUpgrade = upstreamConfig.V2rayHttpUpgrade || wsUrlConfig.V2rayHttpUpgrade
+		upstreamConfig.H2 = upstreamConfig.H2 || wsUrlConfig.H2
+		impl, err := NewWsClientImpl(upstreamConfig)
+		if err != nil {
+			return nil, err
+		}
+		c.upstreams = append(c.upstreams, &upstream{wsClientImpl: impl.(*wsClientImpl)})
+	}
+	if len(c.upstreams) == 0 {
+		return nil, errors.New("empty ws-urls")
+	}
+	return c, nil
+}
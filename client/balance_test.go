@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		setup    func(upstreams []*upstream)
+		expect   []int
+	}{
+		{name: "failover", strategy: StrategyFailover, expect: []int{0, 1, 2}},
+		{name: "round-robin", strategy: StrategyRoundRobin, expect: []int{1, 2, 0}},
+		{
+			name:     "least-conns",
+			strategy: StrategyLeastConns,
+			setup: func(upstreams []*upstream) {
+				upstreams[0].active.Store(2)
+				upstreams[1].active.Store(1)
+				upstreams[2].active.Store(1)
+			},
+			expect: []int{1, 2, 0},
+		},
+		{
+			name:     "lowest-latency",
+			strategy: StrategyLowestLatency,
+			setup: func(upstreams []*upstream) {
+				upstreams[0].latency.Store(int64(30 * time.Millisecond))
+				upstreams[1].latency.Store(int64(10 * time.Millisecond))
+				upstreams[2].latency.Store(int64(20 * time.Millisecond))
+			},
+			expect: []int{1, 2, 0},
+		},
+		{
+			name:     "unavailable last",
+			strategy: StrategyFailover,
+			setup: func(upstreams []*upstream) {
+				upstreams[0].downUntil.Store(time.Now().Add(time.Minute).UnixNano())
+			},
+			expect: []int{1, 2, 0},
+		},
+		{
+			name:     "available again",
+			strategy: StrategyFailover,
+			setup: func(upstreams []*upstream) {
+				upstreams[0].downUntil.Store(time.Now().Add(-time.Second).UnixNano())
+			},
+			expect: []int{0, 1, 2},
+		},
+		{
+			name:     "unavailable last over latency",
+			strategy: StrategyLowestLatency,
+			setup: func(upstreams []*upstream) {
+				upstreams[0].latency.Store(int64(10 * time.Millisecond))
+				upstreams[0].downUntil.Store(time.Now().Add(time.Minute).UnixNano())
+				upstreams[1].latency.Store(int64(30 * time.Millisecond))
+				upstreams[2].latency.Store(int64(20 * time.Millisecond))
+			},
+			expect: []int{2, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &balanceClientImpl{strategy: tt.strategy}
+			index := make(map[*upstream]int)
+			for i := 0; i < 3; i++ {
+				u := &upstream{}
+				index[u] = i
+				c.upstreams = append(c.upstreams, u)
+			}
+			if tt.setup != nil {
+				tt.setup(c.upstreams)
+			}
+			var order []int
+			for _, u := range c.candidates() {
+				order = append(order, index[u])
+			}
+			if !slices.Equal(order, tt.expect) {
+				t.Fatalf("candidates = %v, want %v", order, tt.expect)
+			}
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	c := &balanceClientImpl{strategy: StrategyRoundRobin, upstreams: []*upstream{{}, {}}}
+	first := c.candidates()[0]
+	if second := c.candidates()[0]; second == first {
+		t.Fatal("same upstream selected twice")
+	}
+	if third := c.candidates()[0]; third != first {
+		t.Fatal("not selected in turn")
+	}
+}
+
+func newTestBalanceClientImpl(t *testing.T, clientConfig config.ClientConfig) *balanceClientImpl {
+	t.Helper()
+	impl, err := NewBalanceClientImpl(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := impl.(*balanceClientImpl)
+	t.Cleanup(c.drain)
+	return c
+}
+
+func TestBalanceDial(t *testing.T) {
+	down, up := newTestServer(t), newTestServer(t)
+	down.down.Store(true)
+	c := newTestBalanceClientImpl(t, config.ClientConfig{
+		WSUrls:   []config.WSUrlConfig{{WSUrl: down.wsUrl()}, {WSUrl: up.wsUrl()}},
+		MaxFails: 2,
+	})
+	first, second := c.upstreams[0], c.upstreams[1]
+
+	for i := 0; i < 2; i++ {
+		conn, err := c.Dial(context.Background(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u := conn.(*balanceClientConn).upstream; u != second {
+			t.Fatalf("dialed %s, want %s", u.Target(), second.Target())
+		}
+		if active := second.active.Load(); active != 1 {
+			t.Fatalf("active = %d, want 1", active)
+		}
+		conn.Close()
+		conn.Close() // counted only once
+		if active := second.active.Load(); active != 0 {
+			t.Fatalf("active after closed = %d, want 0", active)
+		}
+	}
+	if up.upgrades.Load() != 2 {
+		t.Fatalf("upgrades = %d, want 2", up.upgrades.Load())
+	}
+
+	// ejected after max-fails, and tried last
+	if first.available(time.Now()) {
+		t.Fatal("failed upstream not ejected")
+	}
+	if second.latency.Load() == 0 {
+		t.Fatal("latency not recorded")
+	}
+	_, err := c.Dial(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fails := first.fails.Load(); fails != 2 {
+		t.Fatalf("fails = %d, want 2 as the ejected upstream is not tried", fails)
+	}
+
+	// the ejected upstream is still tried if all others failed
+	up.down.Store(true)
+	if _, err = c.Dial(context.Background(), nil, nil); err == nil {
+		t.Fatal("dialed with all upstreams down")
+	}
+	if fails := first.fails.Load(); fails != 3 {
+		t.Fatalf("fails = %d, want 3", fails)
+	}
+	down.down.Store(false)
+	conn, err := c.Dial(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if u := conn.(*balanceClientConn).upstream; u != first {
+		t.Fatalf("dialed %s, want %s", u.Target(), first.Target())
+	}
+	if !first.available(time.Now()) || first.fails.Load() != 0 {
+		t.Fatal("recovered upstream still ejected")
+	}
+}
+
+func TestBalanceHealthCheck(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestBalanceClientImpl(t, config.ClientConfig{WSUrls: []config.WSUrlConfig{{WSUrl: s.wsUrl()}}})
+	c.healthCheckInterval = time.Minute
+	u := c.upstreams[0]
+
+	s.down.Store(true)
+	c.healthCheck()
+	if u.available(time.Now()) {
+		t.Fatal("upstream available after health check failed")
+	}
+
+	s.down.Store(false)
+	c.healthCheck()
+	if !u.available(time.Now()) {
+		t.Fatal("upstream unavailable after health check recovered")
+	}
+	if u.latency.Load() == 0 {
+		t.Fatal("latency not recorded")
+	}
+	if s.upgrades.Load() != 1 {
+		t.Fatalf("upgrades = %d, want 1", s.upgrades.Load())
+	}
+}
+
+func TestNewBalanceClientImpl(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientConfig config.ClientConfig
+		wantErr      bool
+	}{
+		{name: "empty ws-urls", wantErr: true},
+		{
+			name:         "unknown strategy",
+			clientConfig: config.ClientConfig{WSUrls: []config.WSUrlConfig{{WSUrl: "ws://127.0.0.1/ws"}}, Strategy: "random"},
+			wantErr:      true,
+		},
+		{
+			name:         "invalid ws-url",
+			clientConfig: config.ClientConfig{WSUrls: []config.WSUrlConfig{{WSUrl: "ws://127.0.0.1:port/ws"}}},
+			wantErr:      true,
+		},
+		{
+			name:         "default",
+			clientConfig: config.ClientConfig{WSUrls: []config.WSUrlConfig{{WSUrl: "ws://127.0.0.1/ws"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			impl, err := NewBalanceClientImpl(tt.clientConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			c := impl.(*balanceClientImpl)
+			if c.strategy != StrategyFailover || c.maxFails != DefaultMaxFails || c.failTimeout != DefaultFailTimeout {
+				t.Fatalf("defaults = %s %d %s", c.strategy, c.maxFails, c.failTimeout)
+			}
+		})
+	}
+}
+
+func TestBalanceUpstreamConfig(t *testing.T) {
+	c := newTestBalanceClientImpl(t, config.ClientConfig{
+		WSUrl:     "ws://ignored/ws",
+		WSHeaders: map[string]string{"Host": "shared.example.com"},
+		WSUrls: []config.WSUrlConfig{
+			{WSUrl: "ws://127.0.0.1:1/a"},
+			{WSUrl: "ws://127.0.0.1:2/b", WSHeaders: map[string]string{"Host": "own.example.com"}},
+		},
+	})
+	tests := []struct {
+		target string
+		host   string
+	}{
+		{"127.0.0.1:1", "shared.example.com"},
+		{"127.0.0.1:2", "own.example.com"},
+	}
+	for i, tt := range tests {
+		u := c.upstreams[i]
+		if u.wsUrl.Host != tt.target {
+			t.Fatalf("upstream %d host = %s, want %s", i, u.wsUrl.Host, tt.target)
+		}
+		if host := u.header.Get("Host"); host != tt.host {
+			t.Fatalf("upstream %d Host header = %s, want %s", i, host, tt.host)
+		}
+	}
+}
@@ -1,74 +1,162 @@
 package client
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
+	"net/http"
 	"strings"
 	"time"
 
+	"github.com/wwqgtxx/wstunnel/atomic"
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
 	"github.com/wwqgtxx/wstunnel/fallback"
 	"github.com/wwqgtxx/wstunnel/listener"
+	"github.com/wwqgtxx/wstunnel/proxy"
+	"github.com/wwqgtxx/wstunnel/tunnel"
 )
 
 const DialTimeout = 8 * time.Second
 
 type client struct {
-	common.ClientImpl
-	serverWSPath   string
-	listenerConfig listener.Config
+	clientImpl     atomic.TypedValue[common.ClientImpl]
+	inbound        atomic.Pointer[proxy.Inbound]
+	limiter        atomic.Pointer[tunnel.Limiter]
+	timeouts       atomic.TypedValue[config.TimeoutConfig]
+	serverWSPath   atomic.TypedValue[string]
+	listenerConfig atomic.TypedValue[listener.Config]
+	ln             atomic.TypedValue[listener.Listener]
 }
 
 func (c *client) Start() {
-	log.Println("New Client Listening on:", c.Addr())
+	slog.Info("New Client Listening", "address", c.Addr())
+	startClientImpl(c.GetClientImpl())
+	c.listen()
+}
+
+func (c *client) listen() {
+	ln, err := listener.ListenTcp(c.listenerConfig.Load())
+	if err != nil {
+		slog.Error("Listen failed", "address", c.Addr(), "err", err)
+		return
+	}
+	c.ln.Store(ln)
+	address := c.Addr()
 	go func() {
-		ln, err := listener.ListenTcp(c.listenerConfig)
-		if err != nil {
-			log.Println(err)
-			return
-		}
 		for {
 			tcp, err := ln.Accept()
 			if err != nil {
-				log.Println(err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Warn("Accept failed", "address", address, "err", err)
 				<-time.After(3 * time.Second)
 				continue
 			}
-			go c.Handle(tcp)
+			ctx := tunnel.NewContext(context.Background(), "tcp", address, tcp.RemoteAddr().String())
+			tunnel.SetLocal(ctx, tcp.LocalAddr().String())
+			go c.Handle(ctx, tcp)
 		}
 	}()
 }
 
+func (c *client) Close() error {
+	slog.Info("Close Client Listening", "address", c.Addr())
+	drainClientImpl(c.GetClientImpl())
+	if ln := c.ln.Swap(nil); ln != nil {
+		return ln.Close()
+	}
+	return nil
+}
+
+func (c *client) Update(newClient common.Client) {
+	nc := newClient.(*client)
+	slog.Info("Update Client Listening", "address", c.Addr())
+	oldClientImpl := c.GetClientImpl()
+	c.SetClientImpl(nc.GetClientImpl())
+	c.inbound.Store(nc.inbound.Load())
+	c.limiter.Store(nc.limiter.Load())
+	c.timeouts.Store(nc.timeouts.Load())
+	startClientImpl(nc.GetClientImpl())
+	drainClientImpl(oldClientImpl)
+	c.serverWSPath.Store(nc.serverWSPath.Load())
+	if nc.Addr() != c.Addr() {
+		// same port but another bind address, the old socket can't be reused
+		slog.Info("Listen again", "address", c.Addr(), "new", nc.Addr())
+		if ln := c.ln.Swap(nil); ln != nil {
+			_ = ln.Close()
+		}
+	}
+	c.listenerConfig.Store(nc.listenerConfig.Load())
+	ln := c.ln.Load()
+	if ln == nil { // last start failed or address changed
+		c.listen()
+		return
+	}
+	if err := ln.Update(c.listenerConfig.Load()); err != nil {
+		slog.Error("Update listener failed", "address", c.Addr(), "err", err)
+	}
+}
+
+func (c *client) Target() string {
+	return c.GetClientImpl().Target()
+}
+
+func (c *client) Proxy() string {
+	return c.GetClientImpl().Proxy()
+}
+
+func (c *client) Handle(ctx context.Context, tcp net.Conn) {
+	tunnel.SetTimeouts(ctx, c.timeouts.Load())
+	if err := tunnel.Limit(ctx, c.limiter.Load()); err != nil {
+		slog.WarnContext(ctx, "Refused", "remote", tcp.RemoteAddr().String(), "err", err)
+		_ = tcp.Close()
+		return
+	}
+	if inbound := c.inbound.Load(); inbound != nil {
+		c.handleInbound(ctx, inbound, tcp)
+		return
+	}
+	c.GetClientImpl().Handle(ctx, tcp)
+}
+
+func (c *client) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	return c.GetClientImpl().Dial(ctx, edBuf, inHeader)
+}
+
 func (c *client) Addr() string {
-	return c.listenerConfig.BindAddress
+	return c.listenerConfig.Load().BindAddress
 }
 
 func (c *client) GetClientImpl() common.ClientImpl {
-	return c.ClientImpl
+	return c.clientImpl.Load()
 }
 
 func (c *client) SetClientImpl(impl common.ClientImpl) {
-	c.ClientImpl = impl
+	c.clientImpl.Store(impl)
 }
 
 func (c *client) GetListenerConfig() any {
-	return c.listenerConfig
+	return c.listenerConfig.Load()
 }
 
 func (c *client) SetListenerConfig(cfg any) {
-	c.listenerConfig = cfg.(listener.Config)
-	c.listenerConfig.IsWebSocketListener = false
+	listenerConfig := cfg.(listener.Config)
+	listenerConfig.IsWebSocketListener = false
+	c.listenerConfig.Store(listenerConfig)
+	c.timeouts.Store(listenerConfig.TimeoutConfig)
 }
 
 func (c *client) GetServerWSPath() string {
-	return c.serverWSPath
+	return c.serverWSPath.Load()
 }
 
 func BuildClient(clientConfig config.ClientConfig) {
 	_, port, err := net.SplitHostPort(clientConfig.BindAddress)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Invalid bind-address", "address", clientConfig.BindAddress, "err", err)
 		return
 	}
 
@@ -76,20 +164,37 @@ func BuildClient(clientConfig config.ClientConfig) {
 
 	clientImpl, err := NewClientImpl(clientConfig)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Invalid client", "address", clientConfig.BindAddress, "err", err)
 		return
 	}
 
-	c := &client{
-		ClientImpl:   clientImpl,
-		serverWSPath: serverWSPath,
-		listenerConfig: listener.Config{
-			ListenerConfig:      clientConfig.ListenerConfig,
-			ProxyConfig:         clientConfig.ProxyConfig,
-			IsWebSocketListener: len(clientConfig.TargetAddress) > 0,
-		},
+	var inbound *proxy.Inbound
+	if len(clientConfig.Inbound) > 0 {
+		inbound, err = newInbound(clientConfig)
+		if err != nil {
+			slog.Error("Invalid inbound", "address", clientConfig.BindAddress, "err", err)
+			return
+		}
 	}
 
+	limiter, err := tunnel.NewLimiter("client/"+clientConfig.BindAddress, clientConfig.LimitConfig)
+	if err != nil {
+		slog.Error("Invalid limit", "address", clientConfig.BindAddress, "err", err)
+		return
+	}
+
+	c := &client{}
+	c.serverWSPath.Store(serverWSPath)
+	c.listenerConfig.Store(listener.Config{
+		ListenerConfig:      clientConfig.ListenerConfig,
+		ProxyConfig:         clientConfig.ProxyConfig,
+		IsWebSocketListener: len(clientConfig.TargetAddress) > 0,
+	})
+	c.SetClientImpl(clientImpl)
+	c.inbound.Store(inbound)
+	c.limiter.Store(limiter)
+	c.timeouts.Store(clientConfig.TimeoutConfig)
+
 	common.PortToClient[port] = c
 }
 
@@ -99,26 +204,30 @@ func NewClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error)
 		return NewMtproxyClientImpl(clientConfig)
 	case len(clientConfig.TargetAddress) > 0:
 		return NewTcpClientImpl(clientConfig)
+	case len(clientConfig.WSUrls) > 0:
+		return NewBalanceClientImpl(clientConfig)
 	default:
 		return NewWsClientImpl(clientConfig)
 	}
 }
 
-func StartClients() {
+// ResolveClients replaces the clients which target to a local server or client by short circuit,
+// it should be called after all servers and clients were built.
+func ResolveClients() {
 	for clientPort, client := range common.PortToClient {
 		if !strings.HasPrefix(client.Target(), "ws") {
 			host, port, err := net.SplitHostPort(client.Target())
 			if err != nil {
-				log.Println(err)
+				slog.Error("Invalid target-address", "address", client.Target(), "err", err)
 			}
 
 			if host == "127.0.0.1" || host == "localhost" {
 				if _server, ok := common.PortToServer[port]; ok {
-					log.Println("Short circuit replace (",
-						client.Addr(), "<->", client.Target(),
-						") to ( [Server]",
-						client.Addr(),
-						")")
+					slog.Info("Short circuit replace",
+						"address", client.Addr(),
+						"from", client.Target(),
+						"to", "[Server]",
+					)
 					newServer := _server.CloneWithNewAddress(client.Addr())
 					listenerConfig := client.GetListenerConfig()
 					newServer.SetListenerConfig(listenerConfig)
@@ -128,16 +237,15 @@ func StartClients() {
 				}
 
 				if _client, ok := common.PortToClient[port]; ok {
-					log.Println("Short circuit replace (",
-						client.Addr(), "<->", client.Target(),
-						") to (",
-						client.Addr(), "<->", _client.Target(),
-						")")
+					slog.Info("Short circuit replace",
+						"address", client.Addr(),
+						"from", client.Target(),
+						"to", _client.Target(),
+					)
 					client.SetClientImpl(_client.GetClientImpl())
 				}
 			}
 		}
-		client.Start()
 	}
 }
 
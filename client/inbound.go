@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/dynamic"
+	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/proxy"
+)
+
+const InboundHandshakeTimeout = 10 * time.Second
+
+func newInbound(clientConfig config.ClientConfig) (*proxy.Inbound, error) {
+	if len(clientConfig.TargetAddress) > 0 || len(clientConfig.Mtp) > 0 {
+		return nil, errors.New("inbound requires ws-url or ws-urls")
+	}
+	if clientConfig.Mux {
+		return nil, errors.New("inbound can't be used with mux")
+	}
+	return proxy.NewInbound(clientConfig.Inbound, clientConfig.InboundUsername, clientConfig.InboundPassword)
+}
+
+// handleInbound accepts a SOCKS5 or HTTP CONNECT request, then tunnels it to the dynamic target of server with its destination
+func (c *client) handleInbound(ctx context.Context, inbound *proxy.Inbound, tcp net.Conn) {
+	defer tcp.Close()
+	conn := peek.NewBufferedConn(tcp)
+	_ = tcp.SetReadDeadline(time.Now().Add(InboundHandshakeTimeout))
+	destination, reply, err := inbound.Handshake(conn)
+	if err != nil {
+		slog.WarnContext(ctx, "Inbound handshake failed", "remote", tcp.RemoteAddr().String(), "err", err)
+		return
+	}
+	_ = tcp.SetReadDeadline(time.Time{})
+
+	clientImpl := c.GetClientImpl()
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "destination", destination, "target", clientImpl.Target(), "proxy", clientImpl.Proxy())
+	ctx = dynamic.WithDestination(ctx, destination)
+	target, err := clientImpl.Dial(ctx, nil, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Dial failed", "target", clientImpl.Target(), "destination", destination, "err", err)
+		_ = reply(err)
+		return
+	}
+	defer target.Close()
+	if err = reply(nil); err != nil {
+		return
+	}
+	target.TunnelTcp(ctx, conn)
+}
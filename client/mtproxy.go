@@ -2,10 +2,11 @@ package client
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 
+	mtcommon "github.com/wwqgtxx/wstunnel/client/mtproxy/common"
 	"github.com/wwqgtxx/wstunnel/client/mtproxy/tools"
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
@@ -34,7 +35,7 @@ func (c *mtproxyClientImpl) SNI() string {
 	return c.serverInfo.CloakHost
 }
 
-func (c *mtproxyClientImpl) Handle(tcp net.Conn) {
+func (c *mtproxyClientImpl) Handle(ctx context.Context, tcp net.Conn) {
 	serverProtocol := c.serverInfo.ServerProtocolMaker(
 		c.serverInfo.Secret,
 		c.serverInfo.SecretMode,
@@ -43,31 +44,31 @@ func (c *mtproxyClientImpl) Handle(tcp net.Conn) {
 	)
 	serverConn, err := serverProtocol.Handshake(tcp)
 	if err != nil {
-		//log.Warnln("Cannot perform mtproxyClientImpl handshake: %s", err)
-
+		slog.DebugContext(ctx, "Cannot perform mtproxy handshake", "remote", tcp.RemoteAddr().String(), "err", err)
 		return
 	}
 	defer serverConn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
 	defer cancel()
 
 	telegramConn, err := c.serverInfo.TelegramDialer.Dial(
 		serverProtocol,
 		func(addr string) (net.Conn, error) {
-			return c.dialer.DialContext(ctx, "tcp", addr)
+			return c.dialer.DialContext(dialCtx, "tcp", addr)
 		})
 	if err != nil {
 		return
 	}
 	defer telegramConn.Close()
 
-	log.Println("Tunnel MTP From", tcp.RemoteAddr(), " --> ", telegramConn.RemoteAddr())
+	slog.InfoContext(ctx, "Tunnel MTP", "remote", tcp.RemoteAddr().String(), "target", telegramConn.RemoteAddr().String())
 
-	tunnel.Tunnel(serverConn, telegramConn)
+	tunnel.SetTarget(ctx, telegramConn.RemoteAddr().String(), c.Proxy())
+	tunnel.Tunnel(ctx, serverConn, telegramConn)
 }
 
-func (c *mtproxyClientImpl) Dial(edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+func (c *mtproxyClientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
 	return &mtproxyClientConn{mtproxyClientImpl: c, edBuf: edBuf}, nil
 }
 
@@ -78,15 +79,15 @@ type mtproxyClientConn struct {
 
 func (c *mtproxyClientConn) Close() {}
 
-func (c *mtproxyClientConn) TunnelTcp(tcp net.Conn) {
+func (c *mtproxyClientConn) TunnelTcp(ctx context.Context, tcp net.Conn) {
 	if len(c.edBuf) > 0 {
 		tcp = utils.NewCachedConn(tcp, c.edBuf)
 	}
-	c.Handle(tcp)
+	c.Handle(ctx, tcp)
 }
 
-func (c *mtproxyClientConn) TunnelWs(wsConn *utils.WebsocketConn) {
-	c.TunnelTcp(wsConn)
+func (c *mtproxyClientConn) TunnelWs(ctx context.Context, wsConn *utils.WebsocketConn) {
+	c.TunnelTcp(ctx, wsConn)
 }
 
 var _ common.ClientConn = (*mtproxyClientConn)(nil)
@@ -99,3 +100,9 @@ func NewMtproxyClientImpl(clientConfig config.ClientConfig) (common.ClientImpl,
 	dialer, proxyStr := proxy.FromProxyString(clientConfig.Proxy)
 	return &mtproxyClientImpl{serverInfo: serverInfo, dialer: dialer, proxyStr: proxyStr}, nil
 }
+
+func init() {
+	mtcommon.PrintlnFunc = func(str string) {
+		slog.Debug(str)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/peek/deadline"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+const DefaultPoolIdleTimeout = 60 * time.Second
+
+// wsPool keeps size upgraded WebSockets ready, so an incoming connection doesn't wait the handshake,
+// the idle ones are watched and replaced when closed by server or idle timeout.
+// The server dials its target as soon as a WebSocket upgraded (it can't wait the first byte for the protocols
+// which server speaks first), so every idle WebSocket holds a target connection until taken or idle timeout
+type wsPool struct {
+	dial        func() (net.Conn, error)
+	size        int
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	idle        []*idleConn
+	dialing     int
+	closed      bool
+}
+
+type idleConn struct {
+	net.Conn
+	taken atomic.Bool
+	done  chan struct{} // closed when watch returned
+	buf   []byte        // the data server sent before the conn taken
+	err   error
+}
+
+func newWsPool(dial func() (net.Conn, error), size int, idleTimeout time.Duration) *wsPool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultPoolIdleTimeout
+	}
+	return &wsPool{dial: dial, size: size, idleTimeout: idleTimeout}
+}
+
+// fill dials the missing connections in background
+func (p *wsPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	need := p.size - len(p.idle) - p.dialing
+	p.dialing += max(need, 0)
+	for range need {
+		go func() {
+			conn, err := p.dial()
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.dialing--
+			if err != nil {
+				slog.Debug("Dial pool connection failed", "err", err)
+				return
+			}
+			if p.closed {
+				_ = conn.Close()
+				return
+			}
+			// interrupting a read of the websocket framing may break the stream, deadline.New keeps the interrupted
+			// read running in background and its result is returned by the next read of the taker
+			i := &idleConn{Conn: deadline.New(conn), done: make(chan struct{})}
+			// set before published, or it may override the deadline of a take
+			_ = i.SetReadDeadline(time.Now().Add(p.idleTimeout))
+			p.idle = append(p.idle, i)
+			go p.watch(i)
+		}()
+	}
+}
+
+func (p *wsPool) watch(i *idleConn) {
+	buf := make([]byte, 4096)
+	n, err := i.Read(buf)
+	i.buf, i.err = buf[:n], err
+	close(i.done)
+	if i.taken.Load() || (n > 0 && err == nil) {
+		return // the taker or the next taker handles it
+	}
+	if p.remove(i) { // closed by server or idle timeout
+		_ = i.Close()
+		p.fill()
+	}
+}
+
+func (p *wsPool) remove(i *idleConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.idle)
+	p.idle = slices.DeleteFunc(p.idle, func(e *idleConn) bool { return e == i })
+	return len(p.idle) != n
+}
+
+// Get returns a ready connection or nil if the pool is empty
+func (p *wsPool) Get() net.Conn {
+	defer p.fill()
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		i := p.idle[0]
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+		if conn := i.take(); conn != nil {
+			return conn
+		}
+	}
+}
+
+// take stops watching and returns the underlying conn, or nil if it was closed by server
+func (i *idleConn) take() net.Conn {
+	i.taken.Store(true)
+	_ = i.SetReadDeadline(time.Now())
+	<-i.done
+	_ = i.SetReadDeadline(time.Time{})
+	if i.err != nil && !errors.Is(i.err, os.ErrDeadlineExceeded) {
+		_ = i.Close()
+		return nil
+	}
+	if len(i.buf) > 0 {
+		return utils.NewCachedConn(i.Conn, i.buf)
+	}
+	return i.Conn
+}
+
+func (p *wsPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, i := range idle {
+		if conn := i.take(); conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
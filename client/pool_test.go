@@ -0,0 +1,187 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials net.Pipes, the server ends are sent to conns
+type pipeDialer struct {
+	conns chan net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{conns: make(chan net.Conn, 16)}
+}
+
+func (d *pipeDialer) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	d.conns <- server
+	return client, nil
+}
+
+func (d *pipeDialer) next(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-d.conns:
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("no dial")
+		return nil
+	}
+}
+
+func (p *wsPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestPoolGet(t *testing.T) {
+	d := newPipeDialer()
+	p := newWsPool(d.dial, 2, 0)
+	defer p.Close()
+	if p.idleTimeout != DefaultPoolIdleTimeout {
+		t.Fatalf("idle timeout = %s, want %s", p.idleTimeout, DefaultPoolIdleTimeout)
+	}
+	if conn := p.Get(); conn != nil {
+		t.Fatal("got a conn from the empty pool")
+	}
+	servers := []net.Conn{d.next(t), d.next(t)}
+	waitFor(t, func() bool { return p.idleCount() == 2 })
+
+	conn := p.Get()
+	if conn == nil {
+		t.Fatal("no conn")
+	}
+	go func() { _, _ = conn.Write([]byte("ping")) }()
+	// the taken conn is one of the dialed, and refilled
+	d.next(t)
+	waitFor(t, func() bool { return p.idleCount() == 2 })
+	buf := make([]byte, 4)
+	var received net.Conn
+	for _, server := range servers {
+		_ = server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := io.ReadFull(server, buf); err == nil {
+			received = server
+			_ = server.SetReadDeadline(time.Time{})
+		}
+	}
+	if received == nil || string(buf) != "ping" {
+		t.Fatalf("read = %q, want %q", buf, "ping")
+	}
+	_ = conn.Close()
+}
+
+func TestPoolEarlyData(t *testing.T) {
+	d := newPipeDialer()
+	p := newWsPool(d.dial, 1, 0)
+	defer p.Close()
+	p.fill()
+	server := d.next(t)
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn := p.Get()
+	if conn == nil {
+		t.Fatal("no conn")
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("read = %q, want %q", buf, "hello")
+	}
+}
+
+func TestPoolServerClosed(t *testing.T) {
+	d := newPipeDialer()
+	p := newWsPool(d.dial, 1, 0)
+	defer p.Close()
+	p.fill()
+	server := d.next(t)
+	waitFor(t, func() bool { return p.idleCount() == 1 })
+	_ = server.Close()
+	// replaced by a new one
+	replaced := d.next(t)
+	waitFor(t, func() bool { return p.idleCount() == 1 })
+	conn := p.Get()
+	if conn == nil {
+		t.Fatal("no conn")
+	}
+	defer conn.Close()
+	go func() { _, _ = conn.Write([]byte("ping")) }()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(replaced, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	d := newPipeDialer()
+	p := newWsPool(d.dial, 1, 50*time.Millisecond)
+	defer p.Close()
+	p.fill()
+	expired := d.next(t)
+	expectClosed(t, expired)
+	d.next(t)
+	waitFor(t, func() bool { return p.idleCount() == 1 })
+}
+
+func TestPoolClose(t *testing.T) {
+	d := newPipeDialer()
+	p := newWsPool(d.dial, 2, 0)
+	p.fill()
+	servers := []net.Conn{d.next(t), d.next(t)}
+	waitFor(t, func() bool { return p.idleCount() == 2 })
+	p.Close()
+	for _, server := range servers {
+		expectClosed(t, server)
+	}
+	if conn := p.Get(); conn != nil {
+		t.Fatal("got a conn from the closed pool")
+	}
+	select {
+	case <-d.conns:
+		t.Fatal("dialed after closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	dials := make(chan struct{}, 16)
+	p := newWsPool(func() (net.Conn, error) {
+		dials <- struct{}{}
+		return nil, errors.New("refused")
+	}, 1, 0)
+	defer p.Close()
+	p.fill()
+	<-dials
+	if conn := p.Get(); conn != nil {
+		t.Fatal("got a conn from the failed pool")
+	}
+	<-dials // retried by Get
+}
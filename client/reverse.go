@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/common"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/tunnel"
+)
+
+type reverseClient struct {
+	reverseConfig config.ReverseConfig
+	wsClientImpl  *wsClientImpl
+	clientImpl    common.ClientImpl
+
+	mu      sync.Mutex
+	session *mux.Session
+	closed  bool
+}
+
+var (
+	reverseClients        []*reverseClient // built, wait for StartReverses
+	runningReverseClients []*reverseClient
+)
+
+func (c *reverseClient) Start() {
+	slog.Info("New Reverse Client Connecting", "address", c.wsClientImpl.Target(), "target", c.clientImpl.Target())
+	go func() {
+		for c.serve() {
+			<-time.After(3 * time.Second)
+		}
+	}()
+}
+
+func (c *reverseClient) Close() error {
+	slog.Info("Close Reverse Client Connecting", "address", c.wsClientImpl.Target(), "target", c.clientImpl.Target())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.session != nil {
+		c.session.Drain() // let the incoming streams finish
+	}
+	return nil
+}
+
+func (c *reverseClient) serve() (retry bool) {
+	conn, err := c.wsClientImpl.dialMuxSession()
+	if err != nil {
+		slog.Warn("Dial reverse session failed", "address", c.wsClientImpl.Target(), "err", err)
+		return !c.isClosed()
+	}
+	session := mux.Client(conn)
+	defer session.Close()
+	defer tunnel.TrackSession(session)()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.session = session
+	c.mu.Unlock()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if c.isClosed() {
+				return false
+			}
+			slog.Info("Reverse Session closed, reconnecting", "address", c.wsClientImpl.Target())
+			return true
+		}
+		if c.isClosed() { // accepted before drained
+			_ = stream.Close()
+			continue
+		}
+		go c.clientImpl.Handle(tunnel.NewContext(context.Background(), "tcp", c.wsClientImpl.Target(), session.RemoteAddr().String()), stream)
+	}
+}
+
+func (c *reverseClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func BuildReverse(reverseConfig config.ReverseConfig) {
+	wsImpl, err := NewWsClientImpl(config.ClientConfig{
+		ProxyConfig:      reverseConfig.ProxyConfig,
+		AuthConfig:       reverseConfig.AuthConfig,
+		WSUrl:            reverseConfig.WSUrl,
+		WSHeaders:        reverseConfig.WSHeaders,
+		V2rayHttpUpgrade: reverseConfig.V2rayHttpUpgrade,
+		SkipCertVerify:   reverseConfig.SkipCertVerify,
+		ServerName:       reverseConfig.ServerName,
+	})
+	if err != nil {
+		slog.Error("Invalid reverse ws-url", "address", reverseConfig.WSUrl, "err", err)
+		return
+	}
+	clientImpl, err := NewTcpClientImpl(config.ClientConfig{TargetAddress: reverseConfig.TargetAddress})
+	if err != nil {
+		slog.Error("Invalid reverse target-address", "address", reverseConfig.TargetAddress, "err", err)
+		return
+	}
+	reverseClients = append(reverseClients, &reverseClient{
+		reverseConfig: reverseConfig,
+		wsClientImpl:  wsImpl.(*wsClientImpl),
+		clientImpl:    clientImpl,
+	})
+}
+
+// StartReverses starts the built reverse clients, the running ones with an unchanged config are kept
+func StartReverses() {
+	var running []*reverseClient
+	for _, newClient := range reverseClients {
+		kept := false
+		for i, oldClient := range runningReverseClients {
+			if oldClient != nil && reflect.DeepEqual(oldClient.reverseConfig, newClient.reverseConfig) {
+				running = append(running, oldClient)
+				runningReverseClients[i] = nil
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			newClient.Start()
+			running = append(running, newClient)
+		}
+	}
+	for _, oldClient := range runningReverseClients {
+		if oldClient != nil {
+			_ = oldClient.Close()
+		}
+	}
+	runningReverseClients = running
+	reverseClients = nil
+}
+
+// StopReverses closes all running reverse clients
+func StopReverses() {
+	reverseClients = nil
+	StartReverses()
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+// newReverseServer accepts the reverse sessions like the reverse-listen of server
+func newReverseServer(t *testing.T) (wsUrl string, sessions chan *mux.Session) {
+	sessions = make(chan *mux.Session, 4)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mux.IsMuxRequest(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(mux.HeaderKey, mux.HeaderValue)
+		wsConn, err := utils.ServerWebsocketUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		session := mux.Server(wsConn)
+		sessions <- session
+		// reverse client never open stream, just wait the session close
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			_ = stream.Close()
+		}
+	}))
+	t.Cleanup(s.Close)
+	return "ws" + s.URL[len("http"):] + "/reverse", sessions
+}
+
+func newEchoListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn, nil)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func nextSession(t *testing.T, sessions chan *mux.Session) *mux.Session {
+	t.Helper()
+	select {
+	case session := <-sessions:
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	case <-time.After(time.Second):
+		t.Fatal("no reverse session")
+		return nil
+	}
+}
+
+func expectReverseEcho(t *testing.T, session *mux.Session) {
+	t.Helper()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(time.Second))
+	expectEcho(t, stream, "")
+}
+
+func TestStartReverses(t *testing.T) {
+	wsUrl, sessions := newReverseServer(t)
+	reverseConfig := config.ReverseConfig{WSUrl: wsUrl, TargetAddress: newEchoListener(t)}
+	BuildReverse(reverseConfig)
+	StartReverses()
+	defer StopReverses()
+	if len(runningReverseClients) != 1 {
+		t.Fatalf("running = %d, want 1", len(runningReverseClients))
+	}
+	first := runningReverseClients[0]
+	session := nextSession(t, sessions)
+	expectReverseEcho(t, session)
+
+	// kept by a reload with the same config
+	BuildReverse(reverseConfig)
+	StartReverses()
+	if len(runningReverseClients) != 1 || runningReverseClients[0] != first {
+		t.Fatal("reverse client of the same config not kept")
+	}
+	select {
+	case <-sessions:
+		t.Fatal("reconnected with the same config")
+	case <-time.After(50 * time.Millisecond):
+	}
+	expectReverseEcho(t, session)
+
+	// replaced with a changed config, and the old session is drained
+	reverseConfig.TargetAddress = newEchoListener(t)
+	BuildReverse(reverseConfig)
+	StartReverses()
+	if len(runningReverseClients) != 1 || runningReverseClients[0] == first {
+		t.Fatal("reverse client of a changed config not replaced")
+	}
+	expectReverseEcho(t, nextSession(t, sessions))
+	waitFor(t, session.IsClosed)
+
+	StopReverses()
+	if len(runningReverseClients) != 0 {
+		t.Fatalf("running = %d after stopped, want 0", len(runningReverseClients))
+	}
+}
+
+func TestBuildReverseInvalid(t *testing.T) {
+	BuildReverse(config.ReverseConfig{WSUrl: "ws://127.0.0.1:port/reverse", TargetAddress: "127.0.0.1:1"})
+	if len(reverseClients) != 0 {
+		t.Fatal("built with an invalid ws-url")
+	}
+}
+
+func TestReverseServe(t *testing.T) {
+	wsUrl, sessions := newReverseServer(t)
+	impl, err := NewWsClientImpl(config.ClientConfig{WSUrl: wsUrl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := NewTcpClientImpl(config.ClientConfig{TargetAddress: newEchoListener(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &reverseClient{wsClientImpl: impl.(*wsClientImpl), clientImpl: target}
+
+	// retried when the session closed by server
+	retry := make(chan bool, 1)
+	go func() { retry <- c.serve() }()
+	session := nextSession(t, sessions)
+	expectReverseEcho(t, session)
+	_ = session.Close()
+	select {
+	case r := <-retry:
+		if !r {
+			t.Fatal("not retried after the session closed by server")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve not returned after the session closed")
+	}
+
+	// but not after closed
+	go func() { retry <- c.serve() }()
+	session = nextSession(t, sessions)
+	_ = c.Close()
+	waitFor(t, session.IsClosed)
+	select {
+	case r := <-retry:
+		if r {
+			t.Fatal("retried after closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve not returned after closed")
+	}
+}
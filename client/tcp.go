@@ -2,22 +2,29 @@ package client
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/dynamic"
+	"github.com/wwqgtxx/wstunnel/metrics"
 	"github.com/wwqgtxx/wstunnel/proxy"
+	"github.com/wwqgtxx/wstunnel/proxyproto"
 	"github.com/wwqgtxx/wstunnel/tunnel"
 	"github.com/wwqgtxx/wstunnel/utils"
 )
 
 type tcpClientImpl struct {
-	targetAddress string
-	dialer        proxy.ContextDialer
-	proxy         string
+	targetAddress     string
+	dialer            proxy.ContextDialer
+	proxy             string
+	sendProxyProtocol int
 }
 
 func (c *tcpClientImpl) Target() string {
@@ -28,29 +35,50 @@ func (c *tcpClientImpl) Proxy() string {
 	return c.proxy
 }
 
-func (c *tcpClientImpl) Handle(tcp net.Conn) {
+func (c *tcpClientImpl) Handle(ctx context.Context, tcp net.Conn) {
 	defer tcp.Close()
-	log.Println("Incoming --> ", tcp.RemoteAddr(), " --> ", c.Target(), c.Proxy())
-	conn, err := c.Dial(nil, nil)
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "target", c.Target(), "proxy", c.Proxy())
+	conn, err := c.Dial(ctx, nil, nil)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(ctx, "Dial failed", "target", c.Target(), "err", err)
 		return
 	}
 	defer conn.Close()
-	conn.TunnelTcp(tcp)
+	conn.TunnelTcp(ctx, tcp)
 }
 
-func (c *tcpClientImpl) Dial(edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+func (c *tcpClientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	tunnel.SetTarget(ctx, c.Target(), c.Proxy())
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
 	defer cancel()
-	tcp, err := c.dialer.DialContext(ctx, "tcp", c.Target())
-	if err == nil && len(edBuf) > 0 {
-		_, err = tcp.Write(edBuf)
+	start := time.Now()
+	tcp, err := c.dialer.DialContext(dialCtx, "tcp", c.Target())
+	observeDial("tcp", dynamic.MetricsTarget(ctx, c.Target()), start, err)
+	if err != nil {
+		return nil, err
+	}
+	var header []byte
+	if c.sendProxyProtocol > 0 {
+		header = proxyHeader(ctx, c.sendProxyProtocol)
+	}
+	if len(header) > 0 || len(edBuf) > 0 {
+		_, err = tcp.Write(append(header, edBuf...))
 		if err != nil {
+			_ = tcp.Close()
 			return nil, err
 		}
 	}
-	return &tcpClientConn{tcp: tcp}, err
+	return &tcpClientConn{tcp: tcp}, nil
+}
+
+// proxyHeader builds the PROXY protocol header carrying the original source of ctx
+func proxyHeader(ctx context.Context, version int) []byte {
+	var src, dst netip.AddrPort
+	if info := tunnel.InfoFromContext(ctx); info != nil {
+		src, _ = netip.ParseAddrPort(info.Remote)
+		dst, _ = netip.ParseAddrPort(info.Local)
+	}
+	return proxyproto.AppendHeader(nil, version, src, dst)
 }
 
 type tcpClientConn struct {
@@ -64,20 +92,32 @@ func (c *tcpClientConn) Close() {
 	})
 }
 
-func (c *tcpClientConn) TunnelTcp(tcp net.Conn) {
-	tunnel.Tunnel(tcp, c.tcp)
+func (c *tcpClientConn) TunnelTcp(ctx context.Context, tcp net.Conn) {
+	tunnel.Tunnel(ctx, tcp, c.tcp)
 }
 
-func (c *tcpClientConn) TunnelWs(wsConn *utils.WebsocketConn) {
-	tunnel.Tunnel(c.tcp, wsConn)
+func (c *tcpClientConn) TunnelWs(ctx context.Context, wsConn *utils.WebsocketConn) {
+	tunnel.Tunnel(ctx, wsConn, c.tcp)
+}
+
+func observeDial(typ string, target string, start time.Time, err error) {
+	if err != nil {
+		metrics.DialErrors.With(typ, target).Inc()
+		return
+	}
+	metrics.DialDuration.With(typ, target).Observe(time.Since(start).Seconds())
 }
 
 func NewTcpClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error) {
+	if clientConfig.SendProxyProtocol < 0 || clientConfig.SendProxyProtocol > 2 {
+		return nil, fmt.Errorf("invalid send-proxy-protocol: %d", clientConfig.SendProxyProtocol)
+	}
 	dialer, proxyStr := proxy.FromProxyString(clientConfig.Proxy)
 
 	return &tcpClientImpl{
-		targetAddress: clientConfig.TargetAddress,
-		dialer:        dialer,
-		proxy:         proxyStr,
+		targetAddress:     clientConfig.TargetAddress,
+		dialer:            dialer,
+		proxy:             proxyStr,
+		sendProxyProtocol: clientConfig.SendProxyProtocol,
 	}, nil
 }
@@ -3,16 +3,22 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/wwqgtxx/wstunnel/auth"
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/dynamic"
+	"github.com/wwqgtxx/wstunnel/h2"
+	"github.com/wwqgtxx/wstunnel/mux"
 	"github.com/wwqgtxx/wstunnel/proxy"
 	"github.com/wwqgtxx/wstunnel/tunnel"
 	"github.com/wwqgtxx/wstunnel/utils"
@@ -26,6 +32,10 @@ type wsClientImpl struct {
 	ed               uint32
 	proxy            string
 	v2rayHttpUpgrade bool
+	muxPool          *mux.Pool
+	pool             *wsPool
+	h2Client         *h2.Client
+	auth             *auth.Auth
 }
 
 func (c *wsClientImpl) Target() string {
@@ -36,24 +46,63 @@ func (c *wsClientImpl) Proxy() string {
 	return c.proxy
 }
 
-func (c *wsClientImpl) Handle(tcp net.Conn) {
+func (c *wsClientImpl) Handle(ctx context.Context, tcp net.Conn) {
 	defer tcp.Close()
-	log.Println("Incoming --> ", tcp.RemoteAddr(), " --> ", c.Target(), c.Proxy())
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "target", c.Target(), "proxy", c.Proxy())
 	edBuf, err := utils.PrepareXray0rtt(tcp, c.ed)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(ctx, "Read early data failed", "err", err)
 		return
 	}
-	conn, err := c.Dial(edBuf, nil)
+	conn, err := c.Dial(ctx, edBuf, nil)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(ctx, "Dial failed", "target", c.Target(), "err", err)
 		return
 	}
 	defer conn.Close()
-	conn.TunnelTcp(tcp)
+	conn.TunnelTcp(ctx, tcp)
 }
 
-func (c *wsClientImpl) Dial(edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+func (c *wsClientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	tunnel.SetTarget(ctx, c.Target(), c.Proxy())
+	start := time.Now()
+	conn, err := c.DialConn(ctx, edBuf, inHeader)
+	observeDial("ws", c.Target(), start, err)
+	if err != nil {
+		return nil, err
+	}
+	if wsConn, ok := conn.(*utils.WebsocketConn); ok {
+		return &wsClientConn{wsConn: wsConn}, nil
+	} else {
+		return &tcpClientConn{tcp: conn}, nil
+	}
+}
+
+func (c *wsClientImpl) DialConn(ctx context.Context, edBuf []byte, inHeader http.Header) (net.Conn, error) {
+	destination := dynamic.DestinationFromContext(ctx)
+	if c.muxPool != nil {
+		if len(destination) > 0 {
+			return nil, errors.New("destination can't be sent over mux")
+		}
+		// the streams share the upgraded session, so inHeader can't be sent,
+		// but the early data of Xray's 0rtt ws in it is written as the first data of the stream
+		if len(edBuf) == 0 {
+			edBuf = utils.DecodeXray0rtt(inHeader)
+		}
+		return c.dialMux(edBuf)
+	}
+	if c.pool != nil && len(inHeader) == 0 && len(destination) == 0 {
+		if conn := c.pool.Get(); conn != nil {
+			// the upgrade was done, so the early data can't be put into Sec-WebSocket-Protocol
+			if len(edBuf) > 0 {
+				if _, err := conn.Write(edBuf); err != nil {
+					_ = conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		}
+	}
 	var header http.Header
 	if len(inHeader) > 0 {
 		// copy from inHeader
@@ -90,15 +139,18 @@ func (c *wsClientImpl) Dial(edBuf []byte, inHeader http.Header) (common.ClientCo
 			header = http.Header{}
 		}
 	}
+	if len(destination) > 0 {
+		header.Set(dynamic.Header, destination)
+	}
 	if c.ed > 0 && len(edBuf) > 0 {
 		header.Set("Sec-WebSocket-Protocol", utils.EncodeEd(edBuf))
 		edBuf = nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
 	defer cancel()
-	conn, respHeader, err := utils.ClientWebsocketDial(ctx, *c.wsUrl, header, c.dialer, c.tlsConfig, c.v2rayHttpUpgrade)
-	log.Println("Dial to", c.Target(), c.Proxy(), "with", header, "response", respHeader)
+	conn, respHeader, err := c.dialWebsocket(dialCtx, header)
+	slog.DebugContext(ctx, "Dial", "target", c.Target(), "proxy", c.Proxy(), "header", header, "response", respHeader)
 	if err != nil {
 		return nil, err
 	}
@@ -106,13 +158,93 @@ func (c *wsClientImpl) Dial(edBuf []byte, inHeader http.Header) (common.ClientCo
 	if len(edBuf) > 0 {
 		_, err = conn.Write(edBuf)
 		if err != nil {
+			_ = conn.Close()
 			return nil, err
 		}
 	}
-	if wsConn, ok := conn.(*utils.WebsocketConn); ok {
-		return &wsClientConn{wsConn: wsConn}, err
-	} else {
-		return &tcpClientConn{tcp: conn}, err
+	return conn, nil
+}
+
+func (c *wsClientImpl) dialMux(edBuf []byte) (net.Conn, error) {
+	stream, err := c.muxPool.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if len(edBuf) > 0 {
+		_, err = stream.Write(edBuf)
+		if err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+func (c *wsClientImpl) dialMuxSession() (net.Conn, error) {
+	header := c.header.Clone()
+	header.Set(mux.HeaderKey, mux.HeaderValue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	conn, respHeader, err := c.dialWebsocket(ctx, header)
+	slog.Debug("Dial Mux", "target", c.Target(), "proxy", c.Proxy(), "header", header, "response", respHeader)
+	if err != nil {
+		return nil, err
+	}
+	if !mux.IsMuxResponse(respHeader) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server %s does not support mux", c.Target())
+	}
+	return conn, nil
+}
+
+func (c *wsClientImpl) dialPoolConn() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	conn, respHeader, err := c.dialWebsocket(ctx, c.header.Clone())
+	slog.Debug("Dial Pool", "target", c.Target(), "proxy", c.Proxy(), "response", respHeader)
+	return conn, err
+}
+
+func (c *wsClientImpl) dialWebsocket(ctx context.Context, header http.Header) (net.Conn, http.Header, error) {
+	wsUrl := *c.wsUrl
+	if c.auth != nil {
+		c.auth.Sign(&wsUrl, header)
+	}
+	if c.h2Client != nil {
+		return utils.ClientWebsocketDialH2(ctx, c.h2Client, wsUrl, header)
+	}
+	return utils.ClientWebsocketDial(ctx, wsUrl, header, c.dialer, c.tlsConfig, c.v2rayHttpUpgrade)
+}
+
+// startClientImpl starts the background jobs of a clientImpl when its client started
+func startClientImpl(clientImpl common.ClientImpl) {
+	switch c := clientImpl.(type) {
+	case *wsClientImpl:
+		if c.pool != nil {
+			c.pool.fill()
+		}
+	case *balanceClientImpl:
+		c.start()
+	}
+}
+
+// drainClientImpl lets the mux sessions of a replaced or closed clientImpl close after their streams finished,
+// and closes its pre-established WebSockets and idle HTTP/2 connections
+func drainClientImpl(clientImpl common.ClientImpl) {
+	switch c := clientImpl.(type) {
+	case *wsClientImpl:
+		if c.muxPool != nil {
+			c.muxPool.Drain()
+		}
+		if c.pool != nil {
+			c.pool.Close()
+		}
+		if c.h2Client != nil {
+			c.h2Client.Close()
+		}
+	case *balanceClientImpl:
+		c.drain()
 	}
 }
 
@@ -127,16 +259,16 @@ func (c *wsClientConn) Close() {
 	})
 }
 
-func (c *wsClientConn) TunnelTcp(tcp net.Conn) {
-	tunnel.Tunnel(tcp, c.wsConn)
+func (c *wsClientConn) TunnelTcp(ctx context.Context, tcp net.Conn) {
+	tunnel.Tunnel(ctx, tcp, c.wsConn)
 }
 
-func (c *wsClientConn) TunnelWs(wsConn *utils.WebsocketConn) {
+func (c *wsClientConn) TunnelWs(ctx context.Context, wsConn *utils.WebsocketConn) {
 	if wsConn.ReaderReplaceable() == c.wsConn.ReaderReplaceable() {
 		// fastpath for direct tunnel underlying ws connection
-		tunnel.Tunnel(wsConn.Conn, c.wsConn.Conn)
+		tunnel.Tunnel(ctx, wsConn.Conn, c.wsConn.Conn)
 	} else {
-		tunnel.Tunnel(wsConn, c.wsConn)
+		tunnel.Tunnel(ctx, wsConn, c.wsConn)
 	}
 }
 
@@ -156,7 +288,7 @@ func NewWsClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error
 	var ed uint32
 	u, err := url.Parse(clientConfig.WSUrl)
 	if err != nil {
-		panic(fmt.Errorf("parse url %s error: %w", clientConfig.WSUrl, err))
+		return nil, fmt.Errorf("parse url %s error: %w", clientConfig.WSUrl, err)
 	}
 	if q := u.Query(); q.Get("ed") != "" {
 		Ed, _ := strconv.Atoi(q.Get("ed"))
@@ -166,7 +298,7 @@ func NewWsClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error
 		//clientConfig.WSUrl = u.String()
 	}
 
-	return &wsClientImpl{
+	c := &wsClientImpl{
 		header:           header,
 		wsUrl:            u,
 		dialer:           dialer,
@@ -174,5 +306,22 @@ func NewWsClientImpl(clientConfig config.ClientConfig) (common.ClientImpl, error
 		ed:               ed,
 		proxy:            proxyStr,
 		v2rayHttpUpgrade: clientConfig.V2rayHttpUpgrade,
-	}, nil
+		auth:             auth.New(clientConfig.AuthConfig),
+	}
+	if clientConfig.H2 {
+		if clientConfig.V2rayHttpUpgrade {
+			return nil, errors.New("h2 can't be used with v2ray-http-upgrade")
+		}
+		var h2TLSConfig *tls.Config // h2c for ws://
+		if u.Scheme == "wss" {
+			h2TLSConfig = tlsConfig
+		}
+		c.h2Client = h2.NewClient(dialer, h2TLSConfig)
+	}
+	if clientConfig.Mux {
+		c.muxPool = mux.NewPool(c.dialMuxSession, clientConfig.MuxConnections, clientConfig.MuxStreams)
+	} else if clientConfig.PoolSize > 0 {
+		c.pool = newWsPool(c.dialPoolConn, clientConfig.PoolSize, time.Duration(clientConfig.PoolIdleTimeout)*time.Second)
+	}
+	return c, nil
 }
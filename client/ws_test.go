@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/dynamic"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+// testServer is a WebSocket echo server, the early data of Xray's 0rtt ws is echoed first
+type testServer struct {
+	*httptest.Server
+	upgrades atomic.Int32
+	down     atomic.Bool                 // responds 502 like a cdn without its origin
+	header   atomic.Pointer[http.Header] // of the last upgraded request
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if !utils.IsWebSocketUpgrade(r) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.upgrades.Add(1)
+		s.header.Store(&r.Header)
+		isMux := mux.IsMuxRequest(r)
+		if isMux {
+			w.Header().Set(mux.HeaderKey, mux.HeaderValue)
+		}
+		wsConn, err := utils.ServerWebsocketUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		if !isMux {
+			echo(wsConn, utils.DecodeXray0rtt(r.Header))
+			return
+		}
+		session := mux.Server(wsConn)
+		defer session.Close()
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echo(stream, nil)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func echo(conn net.Conn, edBuf []byte) {
+	defer conn.Close()
+	if len(edBuf) > 0 {
+		if _, err := conn.Write(edBuf); err != nil {
+			return
+		}
+	}
+	_, _ = io.Copy(conn, conn)
+}
+
+func (s *testServer) wsUrl() string {
+	return "ws" + s.URL[len("http"):] + "/ws"
+}
+
+func newTestWsClientImpl(t *testing.T, clientConfig config.ClientConfig) *wsClientImpl {
+	t.Helper()
+	impl, err := NewWsClientImpl(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { drainClientImpl(impl) })
+	return impl.(*wsClientImpl)
+}
+
+func expectEcho(t *testing.T, conn net.Conn, prefix string) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	expect := prefix + "ping"
+	buf := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expect {
+		t.Fatalf("read = %q, want %q", buf, expect)
+	}
+}
+
+func TestDialConnEarlyData(t *testing.T) {
+	s := newTestServer(t)
+	inHeader := http.Header{}
+	inHeader.Set("Sec-WebSocket-Protocol", utils.EncodeEd([]byte("early")))
+	tests := []struct {
+		name     string
+		mux      bool
+		edBuf    []byte
+		inHeader http.Header
+		expect   string
+	}{
+		{name: "direct", expect: ""},
+		{name: "direct early data", edBuf: []byte("early"), expect: "early"},
+		{name: "direct 0rtt header", inHeader: inHeader, expect: "early"},
+		{name: "mux", mux: true, expect: ""},
+		{name: "mux early data", mux: true, edBuf: []byte("early"), expect: "early"},
+		{name: "mux 0rtt header", mux: true, inHeader: inHeader, expect: "early"},
+		{name: "mux both", mux: true, edBuf: []byte("early"), inHeader: inHeader, expect: "early"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestWsClientImpl(t, config.ClientConfig{WSUrl: s.wsUrl(), Mux: tt.mux})
+			conn, err := c.DialConn(context.Background(), tt.edBuf, tt.inHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			expectEcho(t, conn, tt.expect)
+		})
+	}
+}
+
+func TestDialConnDestination(t *testing.T) {
+	s := newTestServer(t)
+	ctx := dynamic.WithDestination(context.Background(), "example.com:443")
+	c := newTestWsClientImpl(t, config.ClientConfig{WSUrl: s.wsUrl(), PoolSize: 1})
+	conn, err := c.DialConn(ctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "")
+	if destination := s.header.Load().Get(dynamic.Header); destination != "example.com:443" {
+		t.Fatalf("%s = %s, want example.com:443", dynamic.Header, destination)
+	}
+
+	muxClient := newTestWsClientImpl(t, config.ClientConfig{WSUrl: s.wsUrl(), Mux: true})
+	if _, err = muxClient.DialConn(ctx, nil, nil); err == nil {
+		t.Fatal("destination sent over mux")
+	}
+}
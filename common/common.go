@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"net"
 	"net/http"
 
@@ -12,6 +13,8 @@ var PortToServer = make(map[string]Server)
 type Server interface {
 	HasListenerConfig
 	Start()
+	Close() error
+	Update(newServer Server)
 	Addr() string
 	CloneWithNewAddress(bindAddress string) Server
 }
@@ -22,6 +25,8 @@ type Client interface {
 	ClientImpl
 	HasListenerConfig
 	Start()
+	Close() error
+	Update(newClient Client)
 	Addr() string
 	GetClientImpl() ClientImpl
 	SetClientImpl(impl ClientImpl)
@@ -31,14 +36,18 @@ type Client interface {
 type ClientImpl interface {
 	Target() string
 	Proxy() string
-	Handle(tcp net.Conn)
-	Dial(edBuf []byte, inHeader http.Header) (ClientConn, error)
+	Handle(ctx context.Context, tcp net.Conn)
+	Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (ClientConn, error)
+}
+
+type ConnDialer interface {
+	DialConn(ctx context.Context, edBuf []byte, inHeader http.Header) (net.Conn, error)
 }
 
 type ClientConn interface {
 	Close()
-	TunnelTcp(tcp net.Conn)
-	TunnelWs(wsConn *utils.WebsocketConn)
+	TunnelTcp(ctx context.Context, tcp net.Conn)
+	TunnelWs(ctx context.Context, wsConn *utils.WebsocketConn)
 }
 
 type HasListenerConfig interface {
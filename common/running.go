@@ -0,0 +1,50 @@
+package common
+
+var (
+	runningServers = make(map[string]Server)
+	runningClients = make(map[string]Client)
+)
+
+// StartListeners makes the running servers and clients match PortToServer and PortToClient.
+// Removed ones are closed, new ones are started and the unchanged ports are updated in place,
+// so connections already accepted keep working with their old configuration.
+func StartListeners() {
+	// close removed first, so that a port can be taken over by another kind of listener
+	for port, server := range runningServers {
+		if _, ok := PortToServer[port]; !ok {
+			_ = server.Close()
+			delete(runningServers, port)
+		}
+	}
+	for port, client := range runningClients {
+		if _, ok := PortToClient[port]; !ok {
+			_ = client.Close()
+			delete(runningClients, port)
+		}
+	}
+	for port, server := range PortToServer {
+		if running, ok := runningServers[port]; ok {
+			running.Update(server)
+			PortToServer[port] = running
+			continue
+		}
+		server.Start()
+		runningServers[port] = server
+	}
+	for port, client := range PortToClient {
+		if running, ok := runningClients[port]; ok {
+			running.Update(client)
+			PortToClient[port] = running
+			continue
+		}
+		client.Start()
+		runningClients[port] = client
+	}
+}
+
+// StopListeners closes all running servers and clients, the accepted connections are not affected
+func StopListeners() {
+	PortToServer = make(map[string]Server)
+	PortToClient = make(map[string]Client)
+	StartListeners()
+}
@@ -7,72 +7,206 @@ import (
 )
 
 type ClientConfig struct {
-	ListenerConfig   `yaml:",inline"`
+	ListenerConfig    `yaml:",inline"`
+	ProxyConfig       `yaml:",inline"`
+	AuthConfig        `yaml:",inline"`
+	TargetAddress     string            `yaml:"target-address"`
+	WSUrl             string            `yaml:"ws-url"`
+	WSHeaders         map[string]string `yaml:"ws-headers"`
+	V2rayHttpUpgrade  bool              `yaml:"v2ray-http-upgrade"`
+	H2                bool              `yaml:"h2"` // WebSocket over HTTP/2 extended CONNECT (RFC 8441), sharing one connection
+	SkipCertVerify    bool              `yaml:"skip-cert-verify"`
+	ServerName        string            `yaml:"servername"`
+	ServerWSPath      string            `yaml:"server-ws-path"`
+	Mtp               string            `yaml:"mtp"`
+	Mux               bool              `yaml:"mux"`
+	MuxConnections    int               `yaml:"mux-max-connections"`
+	MuxStreams        int               `yaml:"mux-max-streams"`
+	SendProxyProtocol int               `yaml:"send-proxy-protocol"` // 0 (disabled), 1 or 2, only for target-address
+	PoolSize          int               `yaml:"pool-size"`           // pre-established WebSockets, 0 to disable, ignored with mux, each holds a target connection on server
+	PoolIdleTimeout   int               `yaml:"pool-idle-timeout"`   // seconds a pre-established WebSocket is kept, default 60
+	Inbound           string            `yaml:"inbound"`             // "" (forward to the target), "socks5", "http" or "mixed", only for ws-url(s)
+	InboundUsername   string            `yaml:"inbound-username"`    // optional for both socks5 and http
+	InboundPassword   string            `yaml:"inbound-password"`
+	LimitConfig       `yaml:",inline"`
+
+	WSUrls              []WSUrlConfig `yaml:"ws-urls"`
+	Strategy            string        `yaml:"strategy"`              // failover (default), round-robin, least-conns or lowest-latency
+	HealthCheckInterval int           `yaml:"health-check-interval"` // seconds, 0 to disable active health checks
+	MaxFails            int           `yaml:"max-fails"`             // consecutive dial errors to eject an upstream, default 3
+	FailTimeout         int           `yaml:"fail-timeout"`          // seconds an ejected upstream is skipped, default 30
+}
+
+// WSUrlConfig is an upstream of ws-urls, the empty fields are inherited from its ClientConfig
+type WSUrlConfig struct {
 	ProxyConfig      `yaml:",inline"`
+	AuthConfig       `yaml:",inline"`
+	WSUrl            string            `yaml:"ws-url"`
+	WSHeaders        map[string]string `yaml:"ws-headers"`
+	V2rayHttpUpgrade bool              `yaml:"v2ray-http-upgrade"`
+	H2               bool              `yaml:"h2"`
+	SkipCertVerify   bool              `yaml:"skip-cert-verify"`
+	ServerName       string            `yaml:"servername"`
+}
+
+type ReverseConfig struct {
+	ProxyConfig      `yaml:",inline"`
+	AuthConfig       `yaml:",inline"`
 	TargetAddress    string            `yaml:"target-address"`
 	WSUrl            string            `yaml:"ws-url"`
 	WSHeaders        map[string]string `yaml:"ws-headers"`
 	V2rayHttpUpgrade bool              `yaml:"v2ray-http-upgrade"`
 	SkipCertVerify   bool              `yaml:"skip-cert-verify"`
 	ServerName       string            `yaml:"servername"`
-	ServerWSPath     string            `yaml:"server-ws-path"`
-	Mtp              string            `yaml:"mtp"`
 }
 
 type ServerConfig struct {
 	ListenerConfig `yaml:",inline"`
 	ProxyConfig    `yaml:",inline"`
+	TLSConfig      `yaml:",inline"`
 	Target         []ServerTargetConfig `yaml:"target"`
+	TrustedProxies []string             `yaml:"trusted-proxies"` // CIDRs whose X-Forwarded-For and X-Real-IP are trusted
+	Decoy          *DecoyConfig         `yaml:"decoy"`
+}
+
+// DecoyConfig is served for the requests which are not a valid WebSocket upgrade,
+// only one of URL, Dir and the canned response (Status, Headers and Body) is used in order
+type DecoyConfig struct {
+	URL     string            `yaml:"url"` // reverse proxy to this http backend
+	Dir     string            `yaml:"dir"` // serve this static directory
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+}
+
+type TLSConfig struct {
+	TLSCert  string          `yaml:"tls-cert"`
+	TLSKey   string          `yaml:"tls-key"`
+	TLSCerts []TLSCertConfig `yaml:"tls-certs"`
+}
+
+type TLSCertConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
 }
 
 type UdpConfig struct {
 	ListenerConfig `yaml:",inline"`
-	TargetAddress  string  `yaml:"target-address"`
-	Reserved       []uint8 `yaml:"reserved"`
+	ProxyConfig    `yaml:",inline"`
+	AuthConfig     `yaml:",inline"`
+	TargetAddress  string            `yaml:"target-address"`
+	Reserved       []uint8           `yaml:"reserved"`
+	WSUrl          string            `yaml:"ws-url"`
+	WSHeaders      map[string]string `yaml:"ws-headers"`
+	SkipCertVerify bool              `yaml:"skip-cert-verify"`
+	ServerName     string            `yaml:"servername"`
 }
 
 type ListenerConfig struct {
-	BindAddress    string `yaml:"bind-address"`
-	FallbackConfig `yaml:",inline"`
-	MMsg           bool `yaml:"mmsg"`
+	BindAddress         string `yaml:"bind-address"`
+	FallbackConfig      `yaml:",inline"`
+	MMsg                bool `yaml:"mmsg"`
+	AcceptProxyProtocol bool `yaml:"accept-proxy-protocol"`
+	AccessConfig        `yaml:",inline"`
+	TimeoutConfig       `yaml:",inline"`
+}
+
+// AccessConfig is checked for every incoming connection or udp association before fallback sniffing,
+// Deny takes precedence over Allow, and an empty Allow allows all
+type AccessConfig struct {
+	Allow                     []string `yaml:"allow"`      // CIDRs or ips
+	Deny                      []string `yaml:"deny"`       // CIDRs or ips
+	AllowFile                 string   `yaml:"allow-file"` // one CIDR or ip per line, "#" starts a comment, reloaded when modified
+	DenyFile                  string   `yaml:"deny-file"`
+	MaxConnsPerIP             int      `yaml:"max-conns-per-ip"`                // 0 to disable
+	MaxNewConnsPerSecondPerIP int      `yaml:"max-new-conns-per-second-per-ip"` // 0 to disable
+	BanMaxFails               int      `yaml:"ban-max-fails"`                   // ban an ip failed sniffing or auth this many times, 0 to disable
+	BanWindow                 int      `yaml:"ban-window"`                      // seconds, the failures are halved every window, default 600
+	BanDuration               int      `yaml:"ban-duration"`                    // seconds, default 600
 }
 
 type FallbackConfig struct {
-	SshFallbackAddress     string `yaml:"ssh-fallback-address"`
-	SshFallbackTimeout     int    `yaml:"ssh-fallback-timeout"`
-	TLSFallbackAddress     string `yaml:"tls-fallback-address"` // old compatibility
-	WSFallbackAddress      string `yaml:"ws-fallback-address"`
-	UnknownFallbackAddress string `yaml:"unknown-fallback-address"`
+	SshFallbackAddress        string `yaml:"ssh-fallback-address"`
+	SshFallbackTimeout        int    `yaml:"ssh-fallback-timeout"`
+	TLSFallbackAddress        string `yaml:"tls-fallback-address"` // old compatibility
+	WSFallbackAddress         string `yaml:"ws-fallback-address"`
+	UnknownFallbackAddress    string `yaml:"unknown-fallback-address"`
+	FallbackSendProxyProtocol int    `yaml:"fallback-send-proxy-protocol"` // 0 (disabled), 1 or 2
 
-	TLSFallback    []TLSFallbackConfig   `yaml:"tls-fallback"`
-	QuicFallback   []QuicFallbackConfig  `yaml:"quic-fallback"`
-	SSFallback     []SSFallbackConfig    `yaml:"ss-fallback"`
-	SS2022Fallback []SSFallbackConfig    `yaml:"ss2022-fallback"`
-	VmessFallback  []VmessFallbackConfig `yaml:"vmess-fallback"`
+	TLSFallback    []TLSFallbackConfig    `yaml:"tls-fallback"`
+	QuicFallback   []QuicFallbackConfig   `yaml:"quic-fallback"`
+	SSFallback     []SSFallbackConfig     `yaml:"ss-fallback"`
+	SS2022Fallback []SSFallbackConfig     `yaml:"ss2022-fallback"`
+	VmessFallback  []VmessFallbackConfig  `yaml:"vmess-fallback"`
+	TrojanFallback []TrojanFallbackConfig `yaml:"trojan-fallback"`
+	VlessFallback  []VlessFallbackConfig  `yaml:"vless-fallback"`
+	HTTPFallback   []HTTPFallbackConfig   `yaml:"http-fallback"` // checked before ws-fallback-address
 }
 
 type TLSFallbackConfig struct {
-	SNI     string `yaml:"sni"`
-	Address string `yaml:"address"`
-	Mtp     string `yaml:"mtp"`
+	SNI     string   `yaml:"sni"`  // exact, "*.example.com", ".example.com", "regexp:..." or "" as default
+	ALPN    []string `yaml:"alpn"` // any of them offered by the client, any if empty, selected in order among the same sni
+	Address string   `yaml:"address"`
+	Mtp     string   `yaml:"mtp"`
 }
 
 type QuicFallbackConfig struct {
-	SNI     string `yaml:"sni"`
+	SNI     string `yaml:"sni"` // same as TLSFallbackConfig.SNI
 	Address string `yaml:"address"`
 }
 
 type SSFallbackConfig struct {
-	Name     string `yaml:"name"`
-	Method   string `yaml:"method"`
-	Password string `yaml:"password"`
-	Address  string `yaml:"address"`
+	Name        string           `yaml:"name"`
+	Method      string           `yaml:"method"`
+	Password    string           `yaml:"password"`
+	Address     string           `yaml:"address"`
+	LimitConfig `yaml:",inline"` // shared by the users of the same name, only for tcp
 }
 
 type VmessFallbackConfig struct {
-	Name    string `yaml:"name"`
-	UUID    string `yaml:"uuid"`
-	Address string `yaml:"address"`
+	Name        string           `yaml:"name"`
+	UUID        string           `yaml:"uuid"`
+	Address     string           `yaml:"address"`
+	LimitConfig `yaml:",inline"` // shared by the users of the same name
+}
+
+type TrojanFallbackConfig struct {
+	Name        string           `yaml:"name"`
+	Password    string           `yaml:"password"`
+	Address     string           `yaml:"address"`
+	LimitConfig `yaml:",inline"` // shared by the users of the same name
+}
+
+type VlessFallbackConfig struct {
+	Name        string           `yaml:"name"`
+	UUID        string           `yaml:"uuid"`
+	Address     string           `yaml:"address"`
+	LimitConfig `yaml:",inline"` // shared by the users of the same name
+}
+
+type HTTPFallbackConfig struct {
+	Name        string           `yaml:"name"`
+	Host        string           `yaml:"host"`    // same as TLSFallbackConfig.SNI, selected in order among the same host
+	Path        string           `yaml:"path"`    // prefix, any if empty
+	Upgrade     *bool            `yaml:"upgrade"` // whether the Upgrade header presents, any if not set
+	Address     string           `yaml:"address"`
+	LimitConfig `yaml:",inline"` // shared by the routes of the same name
+}
+
+// LimitConfig limits all tunnels of a client, a server target or a fallback user together,
+// the sizes are bytes with an optional K, M, G or T suffix in 1024 units
+type LimitConfig struct {
+	UploadLimit   string `yaml:"upload-limit"`   // per second, from the incoming side
+	DownloadLimit string `yaml:"download-limit"` // per second, to the incoming side
+	MonthlyQuota  string `yaml:"monthly-quota"`  // both directions, new tunnels are refused once exceeded
+}
+
+// AuthConfig is the shared-secret authentication of the WebSocket upgrade, disabled if AuthSecret is empty
+type AuthConfig struct {
+	AuthSecret string `yaml:"auth-secret"`
+	AuthHeader string `yaml:"auth-header"` // default X-Auth-Token
+	AuthQuery  string `yaml:"auth-query"`  // send the token in this query parameter instead of the header
+	AuthWindow int    `yaml:"auth-window"` // seconds, default 60
 }
 
 type ProxyConfig struct {
@@ -80,19 +214,55 @@ type ProxyConfig struct {
 }
 
 type ServerTargetConfig struct {
-	*ProxyConfig  `yaml:",inline"`
-	TargetAddress string `yaml:"target-address"`
-	WSPath        string `yaml:"ws-path"`
+	*ProxyConfig      `yaml:",inline"`
+	AuthConfig        `yaml:",inline"`
+	TargetAddress     string                `yaml:"target-address"`
+	WSPath            string                `yaml:"ws-path"`
+	ReverseListen     string                `yaml:"reverse-listen"`
+	ReverseListener   ReverseListenerConfig `yaml:"reverse-listener"` // the options of reverse-listen, its tunnels use the timeouts of this target
+	Type              string                `yaml:"type"`             // "" (tcp), "udp" or "dynamic" (the destination requested by a client inbound)
+	SendProxyProtocol int                   `yaml:"send-proxy-protocol"`
+	DynamicConfig     `yaml:",inline"`
+	LimitConfig       `yaml:",inline"`
+	TimeoutConfig     `yaml:",inline"`
+}
+
+type ReverseListenerConfig struct {
+	AcceptProxyProtocol bool `yaml:"accept-proxy-protocol"`
+	AccessConfig        `yaml:",inline"`
+}
+
+// TimeoutConfig closes the tcp tunnels which are idle or lived too long, 0 to disable
+type TimeoutConfig struct {
+	IdleTimeout int `yaml:"idle-timeout"` // seconds without any byte in both directions
+	MaxLifetime int `yaml:"max-lifetime"` // seconds
+}
+
+// DynamicConfig is the allow-list of a dynamic target,
+// the destination must match one of AllowCIDRs or AllowHosts, and one of AllowPorts if any
+type DynamicConfig struct {
+	AllowCIDRs []string `yaml:"allow-cidrs"`
+	AllowHosts []string `yaml:"allow-hosts"` // "example.com" or "*.example.com"
+	AllowPorts []string `yaml:"allow-ports"` // "443" or "8000-9000"
 }
 
 type Config struct {
-	ServerConfigs []ServerConfig `yaml:"server"`
-	ClientConfigs []ClientConfig `yaml:"client"`
-	UdpConfigs    []UdpConfig    `yaml:"udp"`
-	DisableServer bool           `yaml:"disable-server"`
-	DisableClient bool           `yaml:"disable-client"`
-	DisableUdp    bool           `yaml:"disable-udp"`
-	DisableLog    bool           `yaml:"disable-log"`
+	ServerConfigs   []ServerConfig  `yaml:"server"`
+	ClientConfigs   []ClientConfig  `yaml:"client"`
+	UdpConfigs      []UdpConfig     `yaml:"udp"`
+	ReverseConfigs  []ReverseConfig `yaml:"reverse"`
+	DisableServer   bool            `yaml:"disable-server"`
+	DisableClient   bool            `yaml:"disable-client"`
+	DisableUdp      bool            `yaml:"disable-udp"`
+	DisableLog      bool            `yaml:"disable-log"`
+	LogLevel        string          `yaml:"log-level"`        // debug, info, warn or error
+	LogFormat       string          `yaml:"log-format"`       // text or json
+	ReloadInterval  int             `yaml:"reload-interval"`  // seconds, poll the config file for changes, 0 to disable
+	ShutdownTimeout int             `yaml:"shutdown-timeout"` // seconds, wait active tunnels finish before exit
+	MetricsAddress  string          `yaml:"metrics-address"`  // serve prometheus metrics at http://metrics-address/metrics
+	AdminAddress    string          `yaml:"admin-address"`    // serve admin api, requires admin-token
+	AdminToken      string          `yaml:"admin-token"`      // bearer token of admin api
+	QuotaStateFile  string          `yaml:"quota-state-file"` // persist the monthly quota usages, in memory only if empty
 }
 
 func ReadConfig(path string) ([]byte, error) {
@@ -113,13 +283,15 @@ func ReadConfig(path string) ([]byte, error) {
 
 func ParseConfig(buf []byte) (*Config, error) {
 	cfg := &Config{
-		ServerConfigs: []ServerConfig{},
-		ClientConfigs: []ClientConfig{},
-		UdpConfigs:    []UdpConfig{},
-		DisableServer: false,
-		DisableClient: false,
-		DisableUdp:    false,
-		DisableLog:    false,
+		ServerConfigs:   []ServerConfig{},
+		ClientConfigs:   []ClientConfig{},
+		UdpConfigs:      []UdpConfig{},
+		ReverseConfigs:  []ReverseConfig{},
+		DisableServer:   false,
+		DisableClient:   false,
+		DisableUdp:      false,
+		DisableLog:      false,
+		ShutdownTimeout: 30,
 	}
 	if err := yaml.Unmarshal(buf, &cfg); err != nil {
 		return nil, err
@@ -0,0 +1,120 @@
+package dynamic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+var ErrNotAllowed = errors.New("destination not allowed")
+
+type portRange struct {
+	from, to uint16
+}
+
+// allowList allows a destination if its host matches one of hosts or its ip is contained by cidrs,
+// and its port is in one of ports (any port if empty)
+type allowList struct {
+	cidrs utils.Prefixes
+	hosts []string // exact or "*.suffix"
+	ports []portRange
+}
+
+func newAllowList(dynamicConfig config.DynamicConfig) (*allowList, error) {
+	if len(dynamicConfig.AllowCIDRs) == 0 && len(dynamicConfig.AllowHosts) == 0 {
+		return nil, errors.New("dynamic target requires allow-cidrs or allow-hosts")
+	}
+	cidrs, err := utils.ParsePrefixes(dynamicConfig.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	l := &allowList{cidrs: cidrs}
+	for _, host := range dynamicConfig.AllowHosts {
+		l.hosts = append(l.hosts, strings.ToLower(host))
+	}
+	for _, port := range dynamicConfig.AllowPorts {
+		fromStr, toStr, isRange := strings.Cut(port, "-")
+		from, err := strconv.ParseUint(fromStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow-ports: %s", port)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.ParseUint(toStr, 10, 16); err != nil || to < from {
+				return nil, fmt.Errorf("invalid allow-ports: %s", port)
+			}
+		}
+		l.ports = append(l.ports, portRange{from: uint16(from), to: uint16(to)})
+	}
+	return l, nil
+}
+
+func (l *allowList) allowPort(port uint16) bool {
+	if len(l.ports) == 0 {
+		return true
+	}
+	for _, r := range l.ports {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *allowList) allowHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range l.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the address to dial for destination, a hostname only allowed by cidrs is resolved here,
+// so the dialed ip is the checked one
+func (l *allowList) check(ctx context.Context, destination string) (string, error) {
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("invalid destination port: %s", destination)
+	}
+	if !l.allowPort(uint16(port)) {
+		return "", fmt.Errorf("%w: %s", ErrNotAllowed, destination)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if l.cidrs.Contains(addr) {
+			return destination, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrNotAllowed, destination)
+	}
+	if l.allowHost(host) {
+		return destination, nil
+	}
+	if len(l.cidrs) > 0 {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if l.cidrs.Contains(addr) {
+				return net.JoinHostPort(addr.Unmap().String(), portStr), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotAllowed, destination)
+}
@@ -0,0 +1,143 @@
+package dynamic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+func TestNewAllowList(t *testing.T) {
+	tests := []struct {
+		name          string
+		dynamicConfig config.DynamicConfig
+		wantErr       bool
+	}{
+		{name: "empty", dynamicConfig: config.DynamicConfig{AllowPorts: []string{"443"}}, wantErr: true},
+		{name: "cidrs", dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/8"}}},
+		{name: "hosts", dynamicConfig: config.DynamicConfig{AllowHosts: []string{"*.example.com"}}},
+		{name: "invalid cidr", dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "port range", dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}, AllowPorts: []string{"443", "8000-9000"}}},
+		{name: "invalid port", dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}, AllowPorts: []string{"https"}}, wantErr: true},
+		{name: "port overflow", dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}, AllowPorts: []string{"65536"}}, wantErr: true},
+		{name: "reversed range", dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}, AllowPorts: []string{"9000-8000"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newAllowList(tt.dynamicConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		dynamicConfig config.DynamicConfig
+		destination   string
+		expect        string
+		wantErr       error
+	}{
+		{
+			name:          "ip in cidrs",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/8"}},
+			destination:   "10.1.2.3:443",
+			expect:        "10.1.2.3:443",
+		},
+		{
+			name:          "ip not in cidrs",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/8"}},
+			destination:   "1.1.1.1:443",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "ipv6",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"2001:db8::/32"}},
+			destination:   "[2001:db8::1]:443",
+			expect:        "[2001:db8::1]:443",
+		},
+		{
+			name:          "ip not allowed by hosts",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}},
+			destination:   "10.1.2.3:443",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "exact host",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"Example.com"}},
+			destination:   "EXAMPLE.com.:443",
+			expect:        "EXAMPLE.com.:443",
+		},
+		{
+			name:          "subdomain of exact host",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"example.com"}},
+			destination:   "www.example.com:443",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "wildcard host",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"*.example.com"}},
+			destination:   "a.b.example.com:443",
+			expect:        "a.b.example.com:443",
+		},
+		{
+			name:          "wildcard doesn't match its parent",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"*.example.com"}},
+			destination:   "example.com:443",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "wildcard doesn't match a suffix",
+			dynamicConfig: config.DynamicConfig{AllowHosts: []string{"*.example.com"}},
+			destination:   "badexample.com:443",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "port allowed",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/8"}, AllowPorts: []string{"443", "8000-9000"}},
+			destination:   "10.1.2.3:8500",
+			expect:        "10.1.2.3:8500",
+		},
+		{
+			name:          "port not allowed",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"10.0.0.0/8"}, AllowPorts: []string{"443", "8000-9000"}},
+			destination:   "10.1.2.3:80",
+			wantErr:       ErrNotAllowed,
+		},
+		{
+			name:          "hostname resolved into cidrs",
+			dynamicConfig: config.DynamicConfig{AllowCIDRs: []string{"127.0.0.0/8"}},
+			destination:   "localhost:443",
+			expect:        "127.0.0.1:443",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newAllowList(tt.dynamicConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			address, err := l.check(context.Background(), tt.destination)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("check = %v, want %v", err, tt.wantErr)
+			}
+			if address != tt.expect {
+				t.Fatalf("address = %s, want %s", address, tt.expect)
+			}
+		})
+	}
+}
+
+func TestCheckInvalid(t *testing.T) {
+	l, err := newAllowList(config.DynamicConfig{AllowCIDRs: []string{"0.0.0.0/0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, destination := range []string{"10.1.2.3", "10.1.2.3:0", "10.1.2.3:65536", "10.1.2.3:https"} {
+		if _, err = l.check(context.Background(), destination); err == nil || errors.Is(err, ErrNotAllowed) {
+			t.Fatalf("check %s = %v, want invalid", destination, err)
+		}
+	}
+}
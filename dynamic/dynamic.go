@@ -0,0 +1,98 @@
+package dynamic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/wwqgtxx/wstunnel/common"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/fallback"
+	"github.com/wwqgtxx/wstunnel/proxy"
+)
+
+// Header carries the destination requested by a client inbound to the dynamic target of server
+const Header = "X-Destination"
+
+var ErrMissingDestination = errors.New("missing destination")
+
+type destinationKey struct{}
+
+func WithDestination(ctx context.Context, destination string) context.Context {
+	return context.WithValue(ctx, destinationKey{}, destination)
+}
+
+func DestinationFromContext(ctx context.Context) string {
+	destination, _ := ctx.Value(destinationKey{}).(string)
+	return destination
+}
+
+type dialKey struct{}
+
+// MetricsTarget returns the target label of the dial metrics, which is the fixed "dynamic"
+// for the destinations of a dynamic target, since they are chosen by the clients
+func MetricsTarget(ctx context.Context, target string) string {
+	if ctx.Value(dialKey{}) != nil {
+		return "dynamic"
+	}
+	return target
+}
+
+// clientImpl is used by server side to dial the destination carried in the Header of each WebSocket
+type clientImpl struct {
+	allowList    *allowList
+	clientConfig config.ClientConfig // TargetAddress is replaced by the destination
+	proxy        string
+}
+
+var _ common.ClientImpl = (*clientImpl)(nil)
+
+func NewClientImpl(dynamicConfig config.DynamicConfig, clientConfig config.ClientConfig) (common.ClientImpl, error) {
+	allowList, err := newAllowList(dynamicConfig)
+	if err != nil {
+		return nil, err
+	}
+	_, proxyStr := proxy.FromProxyString(clientConfig.Proxy)
+	return &clientImpl{allowList: allowList, clientConfig: clientConfig, proxy: proxyStr}, nil
+}
+
+func (c *clientImpl) Target() string {
+	return "dynamic"
+}
+
+func (c *clientImpl) Proxy() string {
+	return c.proxy
+}
+
+func (c *clientImpl) Handle(ctx context.Context, tcp net.Conn) {
+	defer tcp.Close()
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "target", c.Target(), "proxy", c.Proxy())
+	conn, err := c.Dial(ctx, nil, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Dial failed", "target", c.Target(), "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.TunnelTcp(ctx, tcp)
+}
+
+func (c *clientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	destination := inHeader.Get(Header)
+	if len(destination) == 0 {
+		return nil, ErrMissingDestination
+	}
+	address, err := c.allowList.check(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := c.clientConfig
+	clientConfig.TargetAddress = address
+	clientImpl, err := fallback.NewClientImpl(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("destination %s: %w", destination, err)
+	}
+	return clientImpl.Dial(context.WithValue(ctx, dialKey{}, struct{}{}), edBuf, nil)
+}
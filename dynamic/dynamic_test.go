@@ -0,0 +1,94 @@
+package dynamic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/wwqgtxx/wstunnel/common"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/fallback"
+)
+
+// targetImpl records the dials of the ClientImpls created by fallback.NewClientImpl
+type targetImpl struct {
+	address string
+	dials   *[]targetDial
+}
+
+type targetDial struct {
+	address       string
+	metricsTarget string
+}
+
+func (c *targetImpl) Target() string                           { return c.address }
+func (c *targetImpl) Proxy() string                            { return "" }
+func (c *targetImpl) Handle(ctx context.Context, tcp net.Conn) {}
+
+func (c *targetImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	*c.dials = append(*c.dials, targetDial{address: c.address, metricsTarget: MetricsTarget(ctx, c.address)})
+	return nil, nil
+}
+
+func TestDial(t *testing.T) {
+	var dials []targetDial
+	newClientImpl := fallback.NewClientImpl
+	fallback.NewClientImpl = func(clientConfig config.ClientConfig) (common.ClientImpl, error) {
+		return &targetImpl{address: clientConfig.TargetAddress, dials: &dials}, nil
+	}
+	defer func() { fallback.NewClientImpl = newClientImpl }()
+
+	c, err := NewClientImpl(config.DynamicConfig{AllowHosts: []string{"*.example.com"}}, config.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClientImpl(config.DynamicConfig{}, config.ClientConfig{}); err == nil {
+		t.Fatal("created with an empty allow-list")
+	}
+	tests := []struct {
+		name        string
+		destination string
+		wantErr     error
+	}{
+		{"missing", "", ErrMissingDestination},
+		{"not allowed", "example.org:443", ErrNotAllowed},
+		{"allowed", "www.example.com:443", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials = nil
+			header := http.Header{}
+			if len(tt.destination) > 0 {
+				header.Set(Header, tt.destination)
+			}
+			if _, err := c.Dial(context.Background(), nil, header); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("dial = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(dials) != 0 {
+					t.Fatalf("dialed %v", dials)
+				}
+				return
+			}
+			expect := targetDial{address: tt.destination, metricsTarget: "dynamic"}
+			if len(dials) != 1 || dials[0] != expect {
+				t.Fatalf("dials = %v, want %v", dials, expect)
+			}
+		})
+	}
+}
+
+func TestDestinationContext(t *testing.T) {
+	ctx := context.Background()
+	if destination := DestinationFromContext(ctx); destination != "" {
+		t.Fatalf("destination = %s, want empty", destination)
+	}
+	if destination := DestinationFromContext(WithDestination(ctx, "example.com:443")); destination != "example.com:443" {
+		t.Fatalf("destination = %s, want example.com:443", destination)
+	}
+	if target := MetricsTarget(ctx, "1.1.1.1:443"); target != "1.1.1.1:443" {
+		t.Fatalf("metrics target = %s, want 1.1.1.1:443", target)
+	}
+}
@@ -1,19 +1,26 @@
 package fallback
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/wwqgtxx/wstunnel/access"
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/fallback/httproute"
 	"github.com/wwqgtxx/wstunnel/fallback/ss2022"
 	"github.com/wwqgtxx/wstunnel/fallback/ssaead"
 	"github.com/wwqgtxx/wstunnel/fallback/tls"
+	"github.com/wwqgtxx/wstunnel/fallback/trojan"
+	"github.com/wwqgtxx/wstunnel/fallback/vless"
 	"github.com/wwqgtxx/wstunnel/fallback/vmessaead"
+	"github.com/wwqgtxx/wstunnel/metrics"
 	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/tunnel"
 )
 
 const (
@@ -29,6 +36,8 @@ type Config struct {
 	config.FallbackConfig
 	config.ProxyConfig
 	IsWebSocketListener bool
+	IsLocalSNI          func(sni string) bool // set when the listener terminates tls itself
+	Sniff               bool                  // sniff to report the access failures even without any fallback
 }
 
 type Fallback struct {
@@ -40,10 +49,15 @@ type Fallback struct {
 	ssTester            *ssaead.Tester[common.ClientImpl]
 	ss2022Tester        *ss2022.Tester[common.ClientImpl]
 	vmessTester         *vmessaead.Tester[common.ClientImpl]
+	trojanTester        *trojan.Tester[common.ClientImpl]
+	vlessTester         *vless.Tester[common.ClientImpl]
+	httpTester          *httproute.Tester[common.ClientImpl]
+	limiters            map[string]*tunnel.Limiter // by the fallback name, eg: SS[name]
 	isWebSocketListener bool
+	isLocalSNI          func(sni string) bool
 }
 
-func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bool {
+func (f *Fallback) Handle(ctx context.Context, conn peek.Conn, edBuf []byte, inHeader http.Header) bool {
 	if f == nil {
 		return false
 	}
@@ -55,19 +69,25 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 	// move SetReadDeadline to accept() and tunnel()
 	//_ = conn.SetReadDeadline(time.Time{})
 
-	tunnel := func(clientImpl common.ClientImpl, name string, isTimeout bool) bool {
+	tunnel := func(clientImpl common.ClientImpl, name string, isTimeout bool, attrs ...any) bool {
 		_ = conn.SetReadDeadline(time.Time{})
-		log.Println("Incoming", name, "Fallback --> ", conn.RemoteAddr(), " --> ", clientImpl.Target(), clientImpl.Proxy(), "isTimeout=", isTimeout)
+		metrics.FallbackHits.With(name).Inc()
+		tunnel.SetFallback(ctx, name)
+		slog.InfoContext(ctx, "Incoming Fallback", append([]any{"fallback", name, "remote", conn.RemoteAddr().String(), "target", clientImpl.Target(), "proxy", clientImpl.Proxy(), "timeout", isTimeout}, attrs...)...)
 		defer func() {
 			_ = conn.Close()
 		}()
-		conn2, err := clientImpl.Dial(edBuf, inHeader)
+		if err := tunnel.Limit(ctx, f.limiters[name]); err != nil {
+			slog.WarnContext(ctx, "Refused", "fallback", name, "err", err)
+			return true
+		}
+		conn2, err := clientImpl.Dial(ctx, edBuf, inHeader)
 		if err != nil {
-			log.Println(err)
+			slog.WarnContext(ctx, "Dial failed", "fallback", name, "target", clientImpl.Target(), "err", err)
 			return false
 		}
 		defer conn2.Close()
-		conn2.TunnelTcp(conn)
+		conn2.TunnelTcp(ctx, conn)
 		return true
 	}
 	accept := func() bool {
@@ -79,11 +99,26 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 		if f.sshClientImpl != nil && IsTimeout(err) { // some client wait SSH server send handshake first (eg: motty).
 			return tunnel(f.sshClientImpl, "SSH", true)
 		}
-		log.Println(err)
+		slog.DebugContext(ctx, "Peek failed", "err", err)
 		return accept()
 	}
+	var ok bool
+	// the reason of the tester rejected the connection, reported if none matched
+	var failReason string
+	if f.httpTester != nil { // classified by the arrived bytes, buf may be padded with zeros
+		ok, err = f.httpTester.Test(conn, func(name string, clientImpl common.ClientImpl) {
+			tunnel(clientImpl, fmt.Sprintf("HTTP[%s]", name), false)
+		})
+		if err != nil && !IsTimeout(err) {
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
+			return accept()
+		}
+		if ok {
+			return true
+		}
+	}
 	bufString := string(buf)
-	//log.Println(bufString)
+	//slog.Debug(bufString)
 	switch bufString {
 	case SSHStartString: // peek size == 5
 		if f.sshClientImpl != nil {
@@ -97,13 +132,62 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 			return accept()
 		}
 	}
-	var ok bool
+	var isTLS bool
+	var sni string
+	if f.isLocalSNI != nil { // peek size == 5 + x
+		sni, isTLS, err = tls.PeekSni(conn)
+		if err != nil && !IsTimeout(err) {
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
+			return accept()
+		}
+		if isTLS && f.isLocalSNI(sni) {
+			return accept()
+		}
+	}
 	if f.tlsTester != nil { // peek size == 5 + x
-		ok, err = f.tlsTester.Test(conn, func(name string, clientImpl common.ClientImpl) {
-			tunnel(clientImpl, fmt.Sprintf("TLS[%s]", name), false)
+		ok, err = f.tlsTester.Test(conn, func(name string, hello tls.ClientHello, clientImpl common.ClientImpl) {
+			metrics.TLSClientHellos.With(hello.Version(), alpnLabel(hello.ALPN)).Inc()
+			// named by the configured pattern rather than the sni, which is chosen by the clients
+			tunnel(clientImpl, fmt.Sprintf("TLS[%s]", name), false, "sni", hello.SNI, "alpn", hello.ALPN, "version", hello.Version())
+		})
+		if err != nil && !IsTimeout(err) {
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
+			return accept()
+		}
+		if ok {
+			return true
+		}
+	}
+	if isTLS { // not matched by tls-fallback, terminate it locally
+		if len(sni) > 0 { // no sni is sent by the clients using an ip address
+			access.Fail(ctx, conn.RemoteAddr().String(), access.FailUnknownSNI)
+		}
+		return accept()
+	}
+	if f.trojanTester != nil { // peek size == 56 + 2
+		ok, err = f.trojanTester.Test(conn, func(name string, clientImpl common.ClientImpl) {
+			tunnel(clientImpl, fmt.Sprintf("TROJAN[%s]", name), false)
 		})
+		if errors.Is(err, trojan.ErrUnknownKey) { // still may be matched by the others
+			failReason, err = access.FailTrojanAuth, nil
+		}
+		if err != nil && !IsTimeout(err) {
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
+			return accept()
+		}
+		if ok {
+			return true
+		}
+	}
+	if f.vlessTester != nil { // peek size == 1 + 16
+		ok, err = f.vlessTester.Test(conn, func(name string, clientImpl common.ClientImpl) {
+			tunnel(clientImpl, fmt.Sprintf("VLESS[%s]", name), false)
+		})
+		if errors.Is(err, vless.ErrUnknownUser) { // still may be matched by the others
+			failReason, err = access.FailVlessAuth, nil
+		}
 		if err != nil && !IsTimeout(err) {
-			log.Println(err)
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
 			return accept()
 		}
 		if ok {
@@ -115,7 +199,7 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 			tunnel(clientImpl, fmt.Sprintf("VMESS[%s]", name), false)
 		})
 		if err != nil && !IsTimeout(err) {
-			log.Println(err)
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
 			return accept()
 		}
 		if ok {
@@ -127,7 +211,7 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 			tunnel(clientImpl, fmt.Sprintf("SS[%s]", name), false)
 		})
 		if err != nil && !IsTimeout(err) {
-			log.Println(err)
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
 			return accept()
 		}
 		if ok {
@@ -139,19 +223,50 @@ func (f *Fallback) Handle(conn peek.Conn, edBuf []byte, inHeader http.Header) bo
 			tunnel(clientImpl, fmt.Sprintf("SS2022[%s]", name), false)
 		})
 		if err != nil && !IsTimeout(err) {
-			log.Println(err)
+			slog.DebugContext(ctx, "Test fallback failed", "err", err)
 			return accept()
 		}
 		if ok {
 			return true
 		}
 	}
+	// the unrecognized ones of a client listener are served by its target
+	if len(failReason) == 0 && f.isWebSocketListener && !isHTTP(buf) {
+		failReason = access.FailUnrecognized
+	}
+	if len(failReason) > 0 {
+		access.Fail(ctx, conn.RemoteAddr().String(), failReason)
+	}
 	if f.unknownClientImpl != nil {
 		return tunnel(f.unknownClientImpl, "Unknown", false)
 	}
 	return accept()
 }
 
+// alpnLabel bounds the alpn label values since they are chosen by the clients
+func alpnLabel(alpn []string) string {
+	if len(alpn) == 0 {
+		return ""
+	}
+	switch alpn[0] {
+	case "h2", "http/1.1", "http/1.0", "h3", "acme-tls/1":
+		return alpn[0]
+	}
+	return "other"
+}
+
+// httpPrefixes are the starts of the requests which may be served by the http server of a WebSocket listener
+var httpPrefixes = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "PRI * "}
+
+func isHTTP(buf []byte) bool {
+	for _, prefix := range httpPrefixes {
+		if n := min(len(buf), len(prefix)); string(buf[:n]) == prefix[:n] {
+			return true
+		}
+	}
+	return false
+}
+
 func NewFallback(fallbackConfig Config) (*Fallback, error) {
 	var err error
 	var clientImpl common.ClientImpl
@@ -162,20 +277,34 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 	var ssTester *ssaead.Tester[common.ClientImpl]
 	var ss2022Tester *ss2022.Tester[common.ClientImpl]
 	var vmessTester *vmessaead.Tester[common.ClientImpl]
+	var trojanTester *trojan.Tester[common.ClientImpl]
+	var vlessTester *vless.Tester[common.ClientImpl]
+	var httpTester *httproute.Tester[common.ClientImpl]
+	limiters := make(map[string]*tunnel.Limiter)
+	addLimiter := func(name, limiterName string, limitConfig config.LimitConfig) error {
+		limiter, err := tunnel.NewLimiter(limiterName, limitConfig)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if limiter != nil {
+			limiters[name] = limiter
+		}
+		return nil
+	}
 	if len(fallbackConfig.SshFallbackAddress) > 0 {
-		sshClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.SshFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig})
+		sshClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.SshFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 		if err != nil {
 			return nil, err
 		}
 	}
 	if len(fallbackConfig.WSFallbackAddress) > 0 {
-		wsClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.WSFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig})
+		wsClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.WSFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 		if err != nil {
 			return nil, err
 		}
 	}
 	if len(fallbackConfig.UnknownFallbackAddress) > 0 {
-		unknownClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.UnknownFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig})
+		unknownClientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: fallbackConfig.UnknownFallbackAddress, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 		if err != nil {
 			return nil, err
 		}
@@ -191,9 +320,10 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 		for _, tlsFallbackConfig := range fallbackConfig.TLSFallback {
 			sni := tlsFallbackConfig.SNI
 			clientImpl, err = NewClientImpl(config.ClientConfig{
-				TargetAddress: tlsFallbackConfig.Address,
-				Mtp:           tlsFallbackConfig.Mtp,
-				ProxyConfig:   fallbackConfig.ProxyConfig,
+				TargetAddress:     tlsFallbackConfig.Address,
+				Mtp:               tlsFallbackConfig.Mtp,
+				ProxyConfig:       fallbackConfig.ProxyConfig,
+				SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol,
 			})
 			if err != nil {
 				return nil, err
@@ -204,16 +334,16 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 			if len(sni) == 0 && len(tlsFallbackConfig.Mtp) > 0 {
 				return nil, fmt.Errorf("not faketls mtp: %s", tlsFallbackConfig.Mtp)
 			}
-			err = tlsTester.Add(sni, clientImpl)
+			err = tlsTester.Add(sni, tlsFallbackConfig.ALPN, clientImpl)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("invalid tls-fallback sni %s: %w", sni, err)
 			}
 		}
 	}
 	if len(fallbackConfig.SSFallback) > 0 {
 		ssTester = ssaead.NewTester[common.ClientImpl]()
 		for _, ssFallbackConfig := range fallbackConfig.SSFallback {
-			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: ssFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig})
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: ssFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 			if err != nil {
 				return nil, err
 			}
@@ -226,12 +356,16 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 			if err != nil {
 				return nil, err
 			}
+			err = addLimiter(fmt.Sprintf("SS[%s]", ssFallbackConfig.Name), "ss/"+ssFallbackConfig.Name, ssFallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 	if len(fallbackConfig.SS2022Fallback) > 0 {
 		ss2022Tester = ss2022.NewTester[common.ClientImpl]()
 		for _, ss2022FallbackConfig := range fallbackConfig.SS2022Fallback {
-			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: ss2022FallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig})
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: ss2022FallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 			if err != nil {
 				return nil, err
 			}
@@ -244,12 +378,16 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 			if err != nil {
 				return nil, err
 			}
+			err = addLimiter(fmt.Sprintf("SS2022[%s]", ss2022FallbackConfig.Name), "ss2022/"+ss2022FallbackConfig.Name, ss2022FallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 	if len(fallbackConfig.VmessFallback) > 0 {
 		vmessTester = vmessaead.NewTester[common.ClientImpl]()
 		for _, vmessFallbackConfig := range fallbackConfig.VmessFallback {
-			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: vmessFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig})
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: vmessFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
 			if err != nil {
 				return nil, err
 			}
@@ -261,9 +399,78 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 			if err != nil {
 				return nil, err
 			}
+			err = addLimiter(fmt.Sprintf("VMESS[%s]", vmessFallbackConfig.Name), "vmess/"+vmessFallbackConfig.Name, vmessFallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(fallbackConfig.TrojanFallback) > 0 {
+		trojanTester = trojan.NewTester[common.ClientImpl]()
+		for _, trojanFallbackConfig := range fallbackConfig.TrojanFallback {
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: trojanFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
+			if err != nil {
+				return nil, err
+			}
+			err = trojanTester.Add(
+				trojanFallbackConfig.Name,
+				trojanFallbackConfig.Password,
+				clientImpl,
+			)
+			if err != nil {
+				return nil, err
+			}
+			err = addLimiter(fmt.Sprintf("TROJAN[%s]", trojanFallbackConfig.Name), "trojan/"+trojanFallbackConfig.Name, trojanFallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(fallbackConfig.VlessFallback) > 0 {
+		vlessTester = vless.NewTester[common.ClientImpl]()
+		for _, vlessFallbackConfig := range fallbackConfig.VlessFallback {
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: vlessFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
+			if err != nil {
+				return nil, err
+			}
+			err = vlessTester.Add(
+				vlessFallbackConfig.Name,
+				vlessFallbackConfig.UUID,
+				clientImpl,
+			)
+			if err != nil {
+				return nil, err
+			}
+			err = addLimiter(fmt.Sprintf("VLESS[%s]", vlessFallbackConfig.Name), "vless/"+vlessFallbackConfig.Name, vlessFallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(fallbackConfig.HTTPFallback) > 0 {
+		httpTester = httproute.NewTester[common.ClientImpl]()
+		for _, httpFallbackConfig := range fallbackConfig.HTTPFallback {
+			clientImpl, err = NewClientImpl(config.ClientConfig{TargetAddress: httpFallbackConfig.Address, ProxyConfig: fallbackConfig.ProxyConfig, SendProxyProtocol: fallbackConfig.FallbackSendProxyProtocol})
+			if err != nil {
+				return nil, err
+			}
+			err = httpTester.Add(
+				httpFallbackConfig.Name,
+				httpFallbackConfig.Host,
+				httpFallbackConfig.Path,
+				httpFallbackConfig.Upgrade,
+				clientImpl,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("invalid http-fallback %s: %w", httpFallbackConfig.Name, err)
+			}
+			err = addLimiter(fmt.Sprintf("HTTP[%s]", httpFallbackConfig.Name), "http/"+httpFallbackConfig.Name, httpFallbackConfig.LimitConfig)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
-	if sshClientImpl != nil || wsClientImpl != nil || unknownClientImpl != nil || tlsTester != nil || ssTester != nil || vmessTester != nil {
+	if sshClientImpl != nil || wsClientImpl != nil || unknownClientImpl != nil || tlsTester != nil || ssTester != nil || vmessTester != nil || trojanTester != nil || vlessTester != nil || httpTester != nil || fallbackConfig.Sniff {
 		f := &Fallback{
 			sshClientImpl:       sshClientImpl,
 			sshFallbackTimeout:  time.Duration(fallbackConfig.SshFallbackTimeout) * time.Second,
@@ -273,7 +480,12 @@ func NewFallback(fallbackConfig Config) (*Fallback, error) {
 			ssTester:            ssTester,
 			ss2022Tester:        ss2022Tester,
 			vmessTester:         vmessTester,
+			trojanTester:        trojanTester,
+			vlessTester:         vlessTester,
+			httpTester:          httpTester,
+			limiters:            limiters,
 			isWebSocketListener: fallbackConfig.IsWebSocketListener,
+			isLocalSNI:          fallbackConfig.IsLocalSNI,
 		}
 		return f, nil
 	}
@@ -0,0 +1,144 @@
+package httproute
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+const MaxHeaderSize = 8192
+
+var headerEnd = []byte("\r\n\r\n")
+
+// methods are the starts of the HTTP/1.x requests, the HTTP/2 preface is not included
+var methods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "}
+
+type Route[T any] struct {
+	Name    string
+	Host    string // the host pattern
+	Path    string // prefix, any if empty
+	Upgrade *bool  // whether the Upgrade header presents, any if nil
+	Val     T
+}
+
+type Routes[T any] []Route[T]
+
+func (r Routes[T]) match(path string, upgrade bool) *Route[T] {
+	for i, route := range r {
+		if strings.HasPrefix(path, route.Path) && (route.Upgrade == nil || *route.Upgrade == upgrade) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// Tester routes the HTTP/1.x requests by the Host with a utils.DomainMatcher,
+// then by the first matched Route in the added order among the same host pattern
+type Tester[T any] struct {
+	Matcher  *utils.DomainMatcher[*Routes[T]]
+	Patterns map[string]*Routes[T] // by utils.NormalizePattern
+}
+
+func NewTester[T any]() *Tester[T] {
+	return &Tester[T]{Matcher: utils.NewDomainMatcher[*Routes[T]](), Patterns: make(map[string]*Routes[T])}
+}
+
+func (t *Tester[T]) Add(name, host, path string, upgrade *bool, val T) (err error) {
+	if len(path) > 0 && !strings.HasPrefix(path, "/") {
+		return errors.New("path must start with /: " + path)
+	}
+	key := utils.NormalizePattern(host)
+	routes, ok := t.Patterns[key]
+	if !ok {
+		routes = &Routes[T]{}
+		if err = t.Matcher.Add(host, routes); err != nil {
+			return
+		}
+		t.Patterns[key] = routes
+	}
+	*routes = append(*routes, Route[T]{Name: name, Host: host, Path: path, Upgrade: upgrade, Val: val})
+	return
+}
+
+// IsRequest reports whether head is the start of an HTTP/1.x request
+func IsRequest(head []byte) bool {
+	for _, method := range methods {
+		if n := min(len(head), len(method)); string(head[:n]) == method[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tester[T]) Test(peeker peek.Peeker, cb func(name string, val T)) (bool, error) {
+	header, err := PeekHeader(peeker)
+	if err != nil || header == nil {
+		return false, err
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return false, nil
+	}
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	upgrade := len(request.Header.Get("Upgrade")) > 0
+
+	routes, ok := t.Matcher.Match(host)
+	if ok {
+		if route := routes.match(request.URL.Path, upgrade); route != nil {
+			cb(route.Name, route.Val)
+			return true, nil
+		}
+	}
+	// no route of the matched host accepts the path
+	if def, ok := t.Matcher.Default(); ok && def != routes {
+		if route := def.match(request.URL.Path, upgrade); route != nil {
+			cb(route.Name, route.Val)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PeekHeader peeks the request line and headers, returns nil if they are not an HTTP/1.x request
+// or not complete within MaxHeaderSize.
+// It grows the peek by the arrived bytes and only waits for the bytes which must be a part of the header,
+// so it never blocks waiting for the bytes after the header
+func PeekHeader(peeker peek.Peeker) ([]byte, error) {
+	need := 1
+	for {
+		buf, err := peek.PeekAtLeast(peeker, need, MaxHeaderSize)
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) { // larger than the buffer of peek.BufferedConn
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !IsRequest(buf) {
+			return nil, nil
+		}
+		if i := bytes.Index(buf, headerEnd); i >= 0 {
+			return buf[:i+len(headerEnd)], nil
+		}
+		if len(buf) >= MaxHeaderSize {
+			return nil, nil
+		}
+		// the header needs at least the rest of headerEnd
+		matched := 0
+		for m := len(headerEnd) - 1; m > 0; m-- {
+			if bytes.HasSuffix(buf, headerEnd[:m]) {
+				matched = m
+				break
+			}
+		}
+		need = len(buf) + len(headerEnd) - matched
+	}
+}
@@ -0,0 +1,178 @@
+package httproute
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// chunkPeeker delivers data in chunks like a connection, the next chunk arrives only when more bytes are needed
+type chunkPeeker struct {
+	data    []byte
+	chunks  []int // the sizes
+	arrived int
+	maxNeed int
+}
+
+func (p *chunkPeeker) Peek(n int) ([]byte, error) {
+	return p.PeekAtLeast(n, n)
+}
+
+func (p *chunkPeeker) PeekAtLeast(lo, hi int) ([]byte, error) {
+	p.maxNeed = max(p.maxNeed, lo)
+	for p.arrived < lo && len(p.chunks) > 0 {
+		p.arrived = min(len(p.data), p.arrived+p.chunks[0])
+		p.chunks = p.chunks[1:]
+	}
+	if p.arrived < lo {
+		return p.data[:p.arrived], io.EOF
+	}
+	return p.data[:min(p.arrived, hi)], nil
+}
+
+func TestPeekHeader(t *testing.T) {
+	const header = "GET /ws HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	tests := []struct {
+		name    string
+		data    string
+		chunks  []int
+		expect  string
+		wantErr error
+	}{
+		{name: "complete", data: header, chunks: []int{len(header)}, expect: header},
+		{name: "with body", data: header + "body", chunks: []int{len(header) + 4}, expect: header},
+		{name: "split method", data: header + "body", chunks: []int{2, len(header) + 2}, expect: header},
+		{name: "split header end", data: header + "body", chunks: []int{len(header) - 2, 6}, expect: header},
+		{name: "byte by byte", data: header, chunks: slices.Repeat([]int{1}, len(header)), expect: header},
+		{name: "not http", data: "\x05\x01\x00", chunks: []int{3}},
+		{name: "http2 preface", data: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", chunks: []int{24}},
+		{name: "too large", data: "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", MaxHeaderSize), chunks: []int{MaxHeaderSize + 32}},
+		{name: "truncated", data: "GET / HTTP/1.1\r\n", chunks: []int{16}, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &chunkPeeker{data: []byte(tt.data), chunks: tt.chunks}
+			buf, err := PeekHeader(p)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(buf) != tt.expect {
+				t.Fatalf("header = %q, want %q", buf, tt.expect)
+			}
+			if len(tt.expect) > 0 && p.maxNeed > len(tt.expect) {
+				t.Fatalf("waited for %d bytes, more than the header", p.maxNeed)
+			}
+		})
+	}
+}
+
+func TestPeekHeaderPeeker(t *testing.T) {
+	const header = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	buf, err := PeekHeader(bufio.NewReader(strings.NewReader(header + "body")))
+	if err != nil || string(buf) != header {
+		t.Fatalf("header = %q %v", buf, err)
+	}
+	// larger than the buffer of the peeker
+	buf, err = PeekHeader(bufio.NewReaderSize(strings.NewReader(header+strings.Repeat("a", 64)), 16))
+	if err != nil || buf != nil {
+		t.Fatalf("header = %q %v, want nil", buf, err)
+	}
+}
+
+func TestIsRequest(t *testing.T) {
+	tests := []struct {
+		head   string
+		expect bool
+	}{
+		{"GET / HTTP/1.1", true},
+		{"G", true},
+		{"DEL", true},
+		{"CONNECT example.com:443 HTTP/1.1", true},
+		{"", true},
+		{"GET/", false},
+		{"get / HTTP/1.1", false},
+		{"PRI * HTTP/2.0", false},
+		{"\x16\x03\x01", false},
+	}
+	for _, tt := range tests {
+		if IsRequest([]byte(tt.head)) != tt.expect {
+			t.Errorf("IsRequest(%q) = %t, want %t", tt.head, !tt.expect, tt.expect)
+		}
+	}
+}
+
+func TestTest(t *testing.T) {
+	upgrade, noUpgrade := true, false
+	tester := NewTester[int]()
+	routes := []struct {
+		name, host, path string
+		upgrade          *bool
+	}{
+		{"ws", "example.com", "/ws", &upgrade},
+		{"api", "example.com", "/api", nil},
+		{"web", "example.com", "", &noUpgrade},
+		{"wildcard", "*.example.com", "", nil},
+		{"default", "", "/default", nil},
+	}
+	for i, route := range routes {
+		if err := tester.Add(route.name, route.host, route.path, route.upgrade, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		request string
+		matched string
+	}{
+		{"upgrade", "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n", "ws"},
+		{"path prefix", "GET /api/v1 HTTP/1.1\r\nHost: example.com\r\n\r\n", "api"},
+		{"no upgrade", "GET /ws HTTP/1.1\r\nHost: example.com\r\n\r\n", "web"},
+		{"case insensitive host with port", "GET / HTTP/1.1\r\nHost: EXAMPLE.com:8080\r\n\r\n", "web"},
+		{"wildcard", "POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "wildcard"},
+		{"default", "GET /default HTTP/1.1\r\nHost: other.com\r\n\r\n", "default"},
+		{"default of a matched host", "GET /default HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n", "default"},
+		{"not matched", "GET / HTTP/1.1\r\nHost: other.com\r\n\r\n", ""},
+		{"no route accepts", "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n", ""},
+		{"invalid request", "GET /\r\n\r\n", ""},
+		{"not http", "\x16\x03\x01\x00\x05hello", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var matched string
+			ok, err := tester.Test(bufio.NewReader(strings.NewReader(tt.request)), func(name string, val int) {
+				if routes[val].name != name {
+					t.Fatalf("val %d of %s", val, name)
+				}
+				matched = name
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (len(tt.matched) > 0) || matched != tt.matched {
+				t.Fatalf("test = %t %q, want %q", ok, matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tester := NewTester[int]()
+	if err := tester.Add("a", "Example.com.", "/a", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the same host bucket
+	if err := tester.Add("b", "example.com", "/b", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(tester.Patterns) != 1 || len(*tester.Patterns["example.com"]) != 2 {
+		t.Fatalf("patterns = %v", tester.Patterns)
+	}
+	if err := tester.Add("c", "example.com", "c", nil, 0); err == nil {
+		t.Fatal("path without / added")
+	}
+	if err := tester.Add("d", "regexp:[", "/", nil, 0); err == nil {
+		t.Fatal("invalid regexp added")
+	}
+}
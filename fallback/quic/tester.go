@@ -2,19 +2,21 @@ package quic
 
 import (
 	"errors"
+
+	"github.com/wwqgtxx/wstunnel/utils"
 )
 
 type Tester[T any] struct {
-	Map map[string]T
+	Matcher *utils.DomainMatcher[T]
 }
 
 func NewTester[T any]() *Tester[T] {
-	return &Tester[T]{Map: make(map[string]T)}
+	return &Tester[T]{Matcher: utils.NewDomainMatcher[T]()}
 }
 
+// Add adds a utils.DomainMatcher pattern
 func (t *Tester[T]) Add(name string, val T) (err error) {
-	t.Map[name] = val
-	return
+	return t.Matcher.Add(name, val)
 }
 
 func (t *Tester[T]) TestPacket(packet []byte) (bool, string, T) {
@@ -26,10 +28,7 @@ func (t *Tester[T]) TestPacket(packet []byte) (bool, string, T) {
 		return false, "", emptyVal
 	}
 
-	if val, ok := t.Map[sni]; ok {
-		return true, sni, val
-	}
-	if val, ok := t.Map[""]; ok {
+	if val, ok := t.Matcher.Match(sni); ok {
 		return true, sni, val
 	}
 
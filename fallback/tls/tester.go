@@ -7,9 +7,11 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"slices"
 	"time"
 
 	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/utils"
 )
 
 type Pair[T any] struct {
@@ -17,55 +19,140 @@ type Pair[T any] struct {
 	Val  T
 }
 
+// Route is selected when the client offers any of ALPN, or for any client if ALPN is empty
+type Route[T any] struct {
+	Name string // the sni pattern
+	ALPN []string
+	Val  T
+}
+
+type Routes[T any] []Route[T]
+
+func (r Routes[T]) match(alpn []string) *Route[T] {
+	for i, route := range r {
+		if len(route.ALPN) > 0 && slices.ContainsFunc(alpn, func(proto string) bool { return slices.Contains(route.ALPN, proto) }) {
+			return &r[i]
+		}
+	}
+	for i, route := range r {
+		if len(route.ALPN) == 0 {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
 type Tester[T any] struct {
-	Map map[string]T
+	Matcher  *utils.DomainMatcher[*Routes[T]]
+	Patterns map[string]*Routes[T] // by utils.NormalizePattern
 }
 
 func NewTester[T any]() *Tester[T] {
-	return &Tester[T]{Map: make(map[string]T)}
+	return &Tester[T]{Matcher: utils.NewDomainMatcher[*Routes[T]](), Patterns: make(map[string]*Routes[T])}
 }
 
 var (
 	StartBytes = [3]byte{0x16, 0x03, 0x01} // TLS1.0 Handshake (works on TLS1.0, 1.1, 1.2, 1.3)
 )
 
-func (t *Tester[T]) Add(name string, val T) (err error) {
-	t.Map[name] = val
+// Add adds a utils.DomainMatcher pattern with the alpn list to select among the same pattern
+func (t *Tester[T]) Add(name string, alpn []string, val T) (err error) {
+	key := utils.NormalizePattern(name)
+	routes, ok := t.Patterns[key]
+	if !ok {
+		routes = &Routes[T]{}
+		if err = t.Matcher.Add(name, routes); err != nil {
+			return
+		}
+		t.Patterns[key] = routes
+	}
+	*routes = append(*routes, Route[T]{Name: name, ALPN: alpn, Val: val})
 	return
 }
 
-func (t *Tester[T]) Test(peeker peek.Peeker, cb func(name string, val T)) (bool, error) {
+// Test calls cb with the sni pattern of the selected route
+func (t *Tester[T]) Test(peeker peek.Peeker, cb func(name string, hello ClientHello, val T)) (bool, error) {
+	hello, isTLS, err := PeekClientHello(peeker)
+	if err != nil || !isTLS {
+		return false, err
+	}
+
+	routes, ok := t.Matcher.Match(hello.SNI)
+	if ok {
+		if route := routes.match(hello.ALPN); route != nil {
+			cb(route.Name, hello, route.Val)
+			return true, nil
+		}
+	}
+	// no route of the matched pattern accepts the alpn
+	if def, ok := t.Matcher.Default(); ok && def != routes {
+		if route := def.match(hello.ALPN); route != nil {
+			cb(route.Name, hello, route.Val)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClientHello is the parsed info of a TLS ClientHello
+type ClientHello struct {
+	SNI               string
+	ALPN              []string
+	SupportedVersions []uint16
+}
+
+// Version returns the name of the highest supported TLS version
+func (h ClientHello) Version() string {
+	var version uint16
+	for _, v := range h.SupportedVersions {
+		if v >= tls.VersionTLS10 && v <= tls.VersionTLS13 && v > version { // skip GREASE
+			version = v
+		}
+	}
+	if version == 0 {
+		return ""
+	}
+	return tls.VersionName(version)
+}
+
+// PeekSni peeks the whole ClientHello record and returns its SNI,
+// isTLS will be false if the peeked bytes are not a TLS handshake.
+func PeekSni(peeker peek.Peeker) (sni string, isTLS bool, err error) {
+	hello, isTLS, err := PeekClientHello(peeker)
+	return hello.SNI, isTLS, err
+}
+
+// PeekClientHello peeks the whole ClientHello record and parses it,
+// isTLS will be false if the peeked bytes are not a TLS handshake.
+func PeekClientHello(peeker peek.Peeker) (hello ClientHello, isTLS bool, err error) {
 	const recordHeaderLen = 5
 	hdr, err := peeker.Peek(recordHeaderLen)
 	if err != nil {
-		return false, err
+		return ClientHello{}, false, err
 	}
 	if hdr[0] != StartBytes[0] || hdr[1] != StartBytes[1] || hdr[2] != StartBytes[2] {
-		return false, nil
+		return ClientHello{}, false, nil
 	}
 	recLen := int(hdr[3])<<8 | int(hdr[4]) // ignoring version in hdr[1:3]
 	helloBytes, err := peeker.Peek(recordHeaderLen + recLen)
 	if err != nil {
-		return false, nil
-	}
-
-	sni := ExtractSniFromBytes(helloBytes)
-
-	if val, ok := t.Map[sni]; ok {
-		cb(sni, val)
-		return true, nil
+		return ClientHello{}, false, nil
 	}
-	if val, ok := t.Map[""]; ok {
-		cb(sni, val)
-		return true, nil
-	}
-	return false, nil
+	return ExtractClientHelloFromBytes(helloBytes), true, nil
 }
 
 func ExtractSniFromBytes(helloBytes []byte) (sni string) {
+	return ExtractClientHelloFromBytes(helloBytes).SNI
+}
+
+func ExtractClientHelloFromBytes(helloBytes []byte) (hello ClientHello) {
 	_ = tls.Server(sniSniffConn{r: bytes.NewReader(helloBytes)}, &tls.Config{
-		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
-			sni = hello.ServerName
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = ClientHello{
+				SNI:               info.ServerName,
+				ALPN:              slices.Clone(info.SupportedProtos),
+				SupportedVersions: slices.Clone(info.SupportedVersions),
+			}
 			return nil, nil
 		},
 	}).Handshake()
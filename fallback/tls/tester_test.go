@@ -0,0 +1,173 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the ClientHello record sent by crypto/tls
+func clientHello(t *testing.T, sni string, alpn []string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	}()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+func TestRoutesMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes Routes[string]
+		alpn   []string
+		expect string // "" if nil
+	}{
+		{
+			name:   "specific alpn over no alpn",
+			routes: Routes[string]{{Val: "any"}, {ALPN: []string{"h2"}, Val: "h2"}},
+			alpn:   []string{"h2", "http/1.1"},
+			expect: "h2",
+		},
+		{
+			name:   "no alpn route for other alpn",
+			routes: Routes[string]{{ALPN: []string{"h2"}, Val: "h2"}, {Val: "any"}},
+			alpn:   []string{"http/1.1"},
+			expect: "any",
+		},
+		{
+			name:   "no alpn route for no alpn",
+			routes: Routes[string]{{ALPN: []string{"h2"}, Val: "h2"}, {Val: "any"}},
+			expect: "any",
+		},
+		{
+			name:   "first route of offered alpn",
+			routes: Routes[string]{{ALPN: []string{"http/1.1"}, Val: "http1"}, {ALPN: []string{"h2"}, Val: "h2"}},
+			alpn:   []string{"h2", "http/1.1"},
+			expect: "http1",
+		},
+		{
+			name:   "route of any of its alpn",
+			routes: Routes[string]{{ALPN: []string{"h2", "http/1.1"}, Val: "http"}, {Val: "any"}},
+			alpn:   []string{"http/1.1"},
+			expect: "http",
+		},
+		{
+			name:   "not matched",
+			routes: Routes[string]{{ALPN: []string{"h2"}, Val: "h2"}},
+			alpn:   []string{"http/1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.routes.match(tt.alpn)
+			val := ""
+			if route != nil {
+				val = route.Val
+			}
+			if val != tt.expect {
+				t.Fatalf("match = %q, want %q", val, tt.expect)
+			}
+		})
+	}
+}
+
+func TestTest(t *testing.T) {
+	tester := NewTester[string]()
+	for _, route := range []struct {
+		name string
+		alpn []string
+		val  string
+	}{
+		{"example.com", []string{"h2"}, "example-h2"},
+		{"Example.com.", nil, "example"}, // the same pattern
+		{"h2.example.org", []string{"h2"}, "org-h2"},
+		{"", []string{"http/1.1"}, "default-http1"},
+		{"", nil, "default"},
+	} {
+		if err := tester.Add(route.name, route.alpn, route.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noDefault := NewTester[string]()
+	if err := noDefault.Add("h2.example.org", []string{"h2"}, "org-h2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tester  *Tester[string]
+		sni     string
+		alpn    []string
+		expect  string
+		pattern string
+		matched bool
+	}{
+		{"specific alpn", tester, "example.com", []string{"h2", "http/1.1"}, "example-h2", "example.com", true},
+		{"no alpn route", tester, "example.com", []string{"http/1.1"}, "example", "Example.com.", true},
+		{"no alpn offered", tester, "example.com", nil, "example", "Example.com.", true},
+		{"only alpn route", tester, "h2.example.org", []string{"h2"}, "org-h2", "h2.example.org", true},
+		{"default of alpn", tester, "h2.example.org", []string{"http/1.1"}, "default-http1", "", true},
+		{"default without alpn", tester, "h2.example.org", nil, "default", "", true},
+		{"unknown sni", tester, "other.com", []string{"http/1.1"}, "default-http1", "", true},
+		{"unknown sni of other alpn", tester, "other.com", []string{"h2"}, "default", "", true},
+		{"no default", noDefault, "h2.example.org", []string{"http/1.1"}, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := clientHello(t, tt.sni, tt.alpn)
+			var val, pattern string
+			matched, err := tt.tester.Test(bufio.NewReader(bytes.NewReader(hello)), func(name string, hello ClientHello, v string) {
+				val, pattern = v, name
+				if hello.SNI != tt.sni {
+					t.Errorf("sni = %s, want %s", hello.SNI, tt.sni)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched != tt.matched || val != tt.expect || pattern != tt.pattern {
+				t.Fatalf("test = %t %q %q, want %t %q %q", matched, val, pattern, tt.matched, tt.expect, tt.pattern)
+			}
+		})
+	}
+}
+
+func TestTestNotTLS(t *testing.T) {
+	tester := NewTester[string]()
+	if err := tester.Add("", nil, "default"); err != nil {
+		t.Fatal(err)
+	}
+	matched, err := tester.Test(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))), func(string, ClientHello, string) {
+		t.Fatal("called for a http request")
+	})
+	if matched || err != nil {
+		t.Fatalf("test = %t %v, want false", matched, err)
+	}
+}
+
+func TestClientHello(t *testing.T) {
+	hello, isTLS, err := PeekClientHello(bufio.NewReader(bytes.NewReader(clientHello(t, "example.com", []string{"h2", "http/1.1"}))))
+	if err != nil || !isTLS {
+		t.Fatalf("peek = %t %v", isTLS, err)
+	}
+	if hello.SNI != "example.com" || len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" || hello.ALPN[1] != "http/1.1" {
+		t.Fatalf("hello = %+v", hello)
+	}
+	if version := hello.Version(); version != "TLS 1.3" {
+		t.Fatalf("version = %s, want TLS 1.3", version)
+	}
+}
@@ -0,0 +1,78 @@
+package trojan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+)
+
+const (
+	KeySize  = 56 // hex(SHA224(password))
+	PeekSize = KeySize + 2
+)
+
+// ErrUnknownKey is returned for a trojan header with a password not added
+var ErrUnknownKey = errors.New("unknown trojan password")
+
+type Pair[T any] struct {
+	Name string
+	Val  T
+}
+
+type Tester[T any] struct {
+	Keys map[[KeySize]byte]Pair[T]
+}
+
+func NewTester[T any]() *Tester[T] {
+	return &Tester[T]{Keys: make(map[[KeySize]byte]Pair[T])}
+}
+
+func Key(password string) (key [KeySize]byte) {
+	sum := sha256.Sum224([]byte(password))
+	hex.Encode(key[:], sum[:])
+	return
+}
+
+func (t *Tester[T]) Add(name, password string, val T) error {
+	key := Key(password)
+	if _, ok := t.Keys[key]; ok {
+		return errors.New("duplicate trojan password: " + name)
+	}
+	t.Keys[key] = Pair[T]{Name: name, Val: val}
+	return nil
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Tester[T]) Test(peeker peek.Peeker, cb func(name string, val T)) (bool, error) {
+	// check the peeked head first, so a short non-trojan request will not be blocked
+	head, err := peeker.Peek(8)
+	if err != nil {
+		return false, err
+	}
+	if !isHex(head) {
+		return false, nil
+	}
+	header, err := peeker.Peek(PeekSize)
+	if err != nil {
+		return false, err
+	}
+	if header[KeySize] != '\r' || header[KeySize+1] != '\n' || !isHex(header[:KeySize]) {
+		return false, nil
+	}
+	pair, ok := t.Keys[[KeySize]byte(header[:KeySize])]
+	if !ok {
+		return false, ErrUnknownKey
+	}
+	cb(pair.Name, pair.Val)
+	return true, nil
+}
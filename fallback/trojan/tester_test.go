@@ -0,0 +1,62 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTest(t *testing.T) {
+	tester := NewTester[int]()
+	if err := tester.Add("user1", "password1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Add("user2", "password2", 2); err != nil {
+		t.Fatal(err)
+	}
+	key := Key("password2")
+	unknown := Key("password3")
+	tests := []struct {
+		name    string
+		data    string
+		matched string
+		wantErr error
+	}{
+		{name: "matched", data: string(key[:]) + "\r\n\x01\x01", matched: "user2"},
+		{name: "matched header only", data: string(key[:]) + "\r\n", matched: "user2"},
+		{name: "unknown key", data: string(unknown[:]) + "\r\n\x01", wantErr: ErrUnknownKey},
+		{name: "not hex", data: "GET / HTTP/1.1\r\n\r\n"},
+		{name: "upper case hex", data: strings.ToUpper(string(key[:])) + "\r\n"},
+		{name: "non hex in key", data: string(key[:KeySize-1]) + "g\r\n"},
+		{name: "no crlf", data: string(key[:]) + "\n\r"},
+		{name: "socks", data: "\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x50"},
+		{name: "short hex", data: "0123", wantErr: io.EOF},
+		{name: "truncated header", data: string(key[:KeySize-2]), wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var matched string
+			ok, err := tester.Test(bufio.NewReader(bytes.NewReader([]byte(tt.data))), func(name string, val int) {
+				matched = name
+			})
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if ok != (len(tt.matched) > 0) || matched != tt.matched {
+				t.Fatalf("test = %t %q, want %q", ok, matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tester := NewTester[int]()
+	if err := tester.Add("user1", "password", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Add("user2", "password", 2); err == nil {
+		t.Fatal("duplicated password added")
+	}
+}
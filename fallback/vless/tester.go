@@ -0,0 +1,61 @@
+package vless
+
+import (
+	"errors"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/utils"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	Version  = 0
+	PeekSize = 1 + uuid.Size // version, uuid
+)
+
+// ErrUnknownUser is returned for a vless header with an uuid not added
+var ErrUnknownUser = errors.New("unknown vless uuid")
+
+type Pair[T any] struct {
+	Name string
+	Val  T
+}
+
+type Tester[T any] struct {
+	Users map[uuid.UUID]Pair[T]
+}
+
+func NewTester[T any]() *Tester[T] {
+	return &Tester[T]{Users: make(map[uuid.UUID]Pair[T])}
+}
+
+func (t *Tester[T]) Add(name, userId string, val T) error {
+	userUUID := utils.UUIDFromString(userId)
+	if _, ok := t.Users[userUUID]; ok {
+		return errors.New("duplicate vless uuid: " + name)
+	}
+	t.Users[userUUID] = Pair[T]{Name: name, Val: val}
+	return nil
+}
+
+func (t *Tester[T]) Test(peeker peek.Peeker, cb func(name string, val T)) (bool, error) {
+	// check the version first, so a short non-vless request will not be blocked
+	version, err := peeker.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if version[0] != Version {
+		return false, nil
+	}
+	header, err := peeker.Peek(PeekSize)
+	if err != nil {
+		return false, err
+	}
+	pair, ok := t.Users[uuid.UUID(header[1:PeekSize])]
+	if !ok {
+		return false, ErrUnknownUser
+	}
+	cb(pair.Name, pair.Val)
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package vless
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/wwqgtxx/wstunnel/utils"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestTest(t *testing.T) {
+	const id = "b831381d-6324-4d53-ad4f-8cda48b30811"
+	tester := NewTester[int]()
+	if err := tester.Add("user1", id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Add("user2", "password", 2); err != nil {
+		t.Fatal(err)
+	}
+	header := func(version byte, u uuid.UUID) string {
+		return string(append([]byte{version}, u.Bytes()...))
+	}
+	tests := []struct {
+		name    string
+		data    string
+		matched string
+		wantErr error
+	}{
+		{name: "matched", data: header(Version, uuid.Must(uuid.FromString(id))) + "\x00\x01", matched: "user1"},
+		{name: "matched header only", data: header(Version, uuid.Must(uuid.FromString(id))), matched: "user1"},
+		{name: "matched non uuid id", data: header(Version, utils.UUIDFromString("password")), matched: "user2"},
+		{name: "unknown uuid", data: header(Version, uuid.Must(uuid.NewV4())), wantErr: ErrUnknownUser},
+		{name: "other version", data: header(1, uuid.Must(uuid.FromString(id)))},
+		{name: "http", data: "GET / HTTP/1.1\r\n\r\n"},
+		{name: "truncated header", data: header(Version, uuid.Must(uuid.FromString(id)))[:10], wantErr: io.EOF},
+		{name: "empty", data: "", wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var matched string
+			ok, err := tester.Test(bufio.NewReader(bytes.NewReader([]byte(tt.data))), func(name string, val int) {
+				matched = name
+			})
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if ok != (len(tt.matched) > 0) || matched != tt.matched {
+				t.Fatalf("test = %t %q, want %q", ok, matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tester := NewTester[int]()
+	if err := tester.Add("user1", "B831381D-6324-4D53-AD4F-8CDA48B30811", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Add("user2", "b831381d-6324-4d53-ad4f-8cda48b30811", 2); err == nil {
+		t.Fatal("duplicated uuid added")
+	}
+}
@@ -7,8 +7,7 @@ import (
 	"hash/crc32"
 
 	"github.com/wwqgtxx/wstunnel/peek"
-
-	"github.com/gofrs/uuid/v5"
+	"github.com/wwqgtxx/wstunnel/utils"
 )
 
 type Pair[T any] struct {
@@ -31,10 +30,7 @@ const (
 
 func (t *Tester[T]) Add(name, userId string, val T) (err error) {
 	pair := Pair[T]{Name: name, Val: val}
-	userUUID := uuid.FromStringOrNil(userId)
-	if userUUID == uuid.Nil {
-		userUUID = uuid.NewV5(userUUID, userId)
-	}
+	userUUID := utils.UUIDFromString(userId)
 	userCmdKey, err := Key(userUUID)
 	if err != nil {
 		return
@@ -0,0 +1,133 @@
+package h2
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/proxy"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	readIdleTimeout = 30 * time.Second
+	pingTimeout     = 15 * time.Second
+)
+
+// Client opens each WebSocket as a stream of extended CONNECT (RFC 8441),
+// the streams to the same host share one HTTP/2 connection
+type Client struct {
+	transport *http2.Transport
+}
+
+// NewClient returns a Client using h2c prior knowledge if tlsConfig is nil
+func NewClient(dialer proxy.ContextDialer, tlsConfig *tls.Config) *Client {
+	cleartext := tlsConfig == nil
+	if !cleartext {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return &Client{transport: &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		AllowHTTP:       cleartext,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if cleartext {
+				return conn, nil
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		ReadIdleTimeout: readIdleTimeout,
+		PingTimeout:     pingTimeout,
+	}}
+}
+
+// Dial opens a stream to uri, the stream lives after ctx done
+func (c *Client) Dial(ctx context.Context, uri url.URL, cHeaders http.Header) (net.Conn, http.Header, error) {
+	streamCtx := context.WithoutCancel(ctx)
+	switch uri.Scheme {
+	case "ws":
+		uri.Scheme = "http"
+	case "wss":
+		uri.Scheme = "https"
+	}
+	if !strings.HasPrefix(uri.Path, "/") {
+		uri.Path = "/" + uri.Path
+	}
+	header := cHeaders.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	host := header.Get("Host")
+	// connection-specific headers are not allowed in HTTP/2
+	header.Del("Host")
+	header.Del("Connection")
+	header.Del("Upgrade")
+	header.Del("Sec-WebSocket-Key")
+	header.Set(":protocol", "websocket")
+	header.Set("Sec-WebSocket-Version", "13")
+
+	var localAddr, remoteAddr net.Addr = stringAddr(""), stringAddr(uri.Host)
+	streamCtx = httptrace.WithClientTrace(streamCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr, remoteAddr = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	})
+	streamCtx, cancel := context.WithCancel(streamCtx)
+	stop := context.AfterFunc(ctx, cancel)
+
+	pr, pw := net.Pipe() // not io.Pipe, for the write deadline
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &uri,
+		Host:   host,
+		Header: header,
+		Body:   pr,
+	}
+	request = request.WithContext(streamCtx)
+	response, err := c.transport.RoundTrip(request)
+	if !stop() { // ctx done before the response
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		_ = pw.Close()
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		cancel()
+		_ = pw.Close()
+		_ = response.Body.Close()
+		return nil, response.Header, fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	conn := newConn(response.Body, pw, localAddr, remoteAddr)
+	conn.setWriteDeadline = pw.SetWriteDeadline
+	conn.onClose = func() {
+		_ = pw.Close()
+		cancel()
+	}
+	return conn, response.Header, nil
+}
+
+// Close closes the idle HTTP/2 connections, the active ones are closed after their streams finished
+func (c *Client) Close() {
+	c.transport.CloseIdleConnections()
+}
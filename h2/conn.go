@@ -0,0 +1,166 @@
+package h2
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/peek/deadline"
+)
+
+const readBufferSize = 32 * 1024
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+// Conn is a net.Conn over an HTTP/2 stream,
+// the read deadline is emulated because interrupting a stream body read resets the stream
+type Conn struct {
+	reader           io.ReadCloser
+	writer           io.Writer
+	flush            func() error // nil if writer needn't flush
+	setWriteDeadline func(t time.Time) error
+	onClose          func()
+	localAddr        net.Addr
+	remoteAddr       net.Addr
+
+	readOnce     sync.Once
+	readMu       sync.Mutex
+	readCh       chan readResult
+	readAck      chan struct{}
+	pending      []byte
+	readErr      error
+	readDeadline *deadline.PipeDeadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConn(reader io.ReadCloser, writer io.Writer, localAddr, remoteAddr net.Addr) *Conn {
+	return &Conn{
+		reader:       reader,
+		writer:       writer,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		readCh:       make(chan readResult),
+		readAck:      make(chan struct{}, 1),
+		readDeadline: deadline.NewPipeDeadline(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// readLoop reads the stream body in background, the buffer is reused after Read acked it
+func (c *Conn) readLoop() {
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := c.reader.Read(buf)
+		select {
+		case c.readCh <- readResult{buf: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-c.readAck:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.readOnce.Do(func() { go c.readLoop() })
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		select {
+		case result := <-c.readCh:
+			c.pending, c.readErr = result.buf, result.err
+			if len(c.pending) == 0 && c.readErr == nil {
+				c.readAck <- struct{}{}
+			}
+		case <-c.readDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 && c.readErr == nil {
+		c.readAck <- struct{}{}
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	n, err = c.writer.Write(b)
+	if err != nil {
+		return
+	}
+	if c.flush != nil {
+		err = c.flush()
+	}
+	return
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_ = c.reader.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.setWriteDeadline != nil {
+		return c.setWriteDeadline(t)
+	}
+	return nil
+}
+
+// stringAddr is a net.Addr from the string form, eg: http.Request.RemoteAddr
+type stringAddr string
+
+func (a stringAddr) Network() string {
+	return "tcp"
+}
+
+func (a stringAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,80 @@
+package h2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ErrExtendedConnectDisabled is returned by ConfigureServer when golang.org/x/net/http2 doesn't accept extended CONNECT,
+// which is only enabled by GODEBUG=http2xconnect=1 in the environment when the process starts
+var ErrExtendedConnectDisabled = errors.New("http2 extended connect is disabled, set GODEBUG=http2xconnect=1 to accept websocket over http2")
+
+// extendedConnectEnabled checks whether an http2.Server advertises SETTINGS_ENABLE_CONNECT_PROTOCOL
+var extendedConnectEnabled = sync.OnceValue(func() bool {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go (&http2.Server{}).ServeConn(serverConn, &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+	_ = clientConn.SetDeadline(time.Now().Add(time.Second))
+	go func() {
+		_, _ = io.WriteString(clientConn, http2.ClientPreface)
+	}()
+	frame, err := http2.NewFramer(io.Discard, clientConn).ReadFrame()
+	if err != nil {
+		return false
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		return false
+	}
+	v, ok := settings.Value(http2.SettingEnableConnectProtocol)
+	return ok && v == 1
+})
+
+// IsWebSocketConnect reports whether r is a WebSocket over HTTP/2 extended CONNECT (RFC 8441)
+func IsWebSocketConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// ConfigureServer enables HTTP/2 with extended CONNECT for s, both over TLS (ALPN "h2") and cleartext (h2c prior knowledge),
+// HTTP/2 is still enabled when ErrExtendedConnectDisabled returned
+func ConfigureServer(s *http.Server) error {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(s, h2s); err != nil {
+		return err
+	}
+	s.Handler = h2c.NewHandler(s.Handler, h2s)
+	if !extendedConnectEnabled() {
+		return ErrExtendedConnectDisabled
+	}
+	return nil
+}
+
+// Upgrade accepts the extended CONNECT and returns the stream as a net.Conn,
+// which must be closed before the handler returns
+func Upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if !IsWebSocketConnect(r) {
+		return nil, errors.New("not a websocket extended connect")
+	}
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, fmt.Errorf("flush response: %w", err)
+	}
+	var localAddr net.Addr = stringAddr("")
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+	c := newConn(r.Body, w, localAddr, stringAddr(r.RemoteAddr))
+	c.flush = rc.Flush
+	c.setWriteDeadline = rc.SetWriteDeadline
+	return c, nil
+}
@@ -2,27 +2,56 @@ package listener
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/wwqgtxx/wstunnel/access"
+	"github.com/wwqgtxx/wstunnel/atomic"
 	"github.com/wwqgtxx/wstunnel/config"
 	"github.com/wwqgtxx/wstunnel/fallback"
+	"github.com/wwqgtxx/wstunnel/metrics"
 	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/proxyproto"
+	"github.com/wwqgtxx/wstunnel/tunnel"
+	"github.com/wwqgtxx/wstunnel/utils"
 )
 
 type Config struct {
 	config.ListenerConfig
 	config.ProxyConfig
+	TLSConfig           config.TLSConfig
 	IsWebSocketListener bool
+	TrustedProxies      utils.Prefixes // skip the access check of these peers, their forwarded clients are checked per request
 }
 
+type Listener interface {
+	net.Listener
+	// Update swaps the fallback and tls certificates, the accepted connections are not affected
+	Update(listenerConfig Config) error
+}
+
+// ProxyHeaderTimeout is the max time to wait the PROXY protocol header after accepted
+const ProxyHeaderTimeout = 10 * time.Second
+
 type tcpListener struct {
 	net.Listener
-	closeOnce sync.Once
-	closed    chan struct{}
-	ch        chan acceptResult
-	fallback  *fallback.Fallback
+	closeOnce     sync.Once
+	closed        chan struct{}
+	ch            chan acceptResult
+	fallback      atomic.Pointer[fallback.Fallback]
+	tlsConfig     atomic.Pointer[tls.Config]
+	proxyProtocol atomic.Bool
+	trusted       atomic.TypedValue[utils.Prefixes]
+	timeouts      atomic.TypedValue[config.TimeoutConfig]
+	limiter       *access.Limiter
+	address       string
+	active        *metrics.Gauge
+	total         *metrics.Counter
 }
 
 type acceptResult struct {
@@ -43,7 +72,7 @@ func (l *tcpListener) Accept() (net.Conn, error) {
 	case r := <-l.ch:
 		return r.conn, r.err
 	case <-l.closed:
-		return nil, errors.New("listener closed")
+		return nil, net.ErrClosed
 	}
 }
 
@@ -58,13 +87,50 @@ func (l *tcpListener) loop() {
 			}
 			continue
 		}
+		l.total.Inc()
+		l.active.Inc()
 		go func() {
-			conn := peek.NewPeekConn(conn)
-			if l.fallback.Handle(conn, nil, nil) {
+			cc := &countedConn{Conn: peek.NewPeekConn(conn), active: l.active}
+			pc := peek.Conn(cc)
+			if l.proxyProtocol.Load() {
+				_ = pc.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+				src, dst, err := proxyproto.ReadHeader(pc)
+				if err != nil {
+					slog.Warn("Read proxy protocol header failed", "remote", conn.RemoteAddr().String(), "err", err)
+					_ = pc.Close()
+					return
+				}
+				_ = pc.SetReadDeadline(time.Time{})
+				pc = proxyproto.NewConn(pc, src, dst)
+			}
+			if !l.trusted.Load().Contains(utils.ParseAddr(pc.RemoteAddr().String())) {
+				release, err := l.limiter.Acquire(pc.RemoteAddr().String())
+				if err != nil {
+					level := slog.LevelWarn
+					if errors.Is(err, access.ErrBanned) { // logged when banned
+						level = slog.LevelDebug
+					}
+					slog.Log(context.Background(), level, "Access rejected", "address", l.address, "remote", pc.RemoteAddr().String(), "err", err)
+					_ = pc.Close()
+					return
+				}
+				cc.release = release
+			}
+			ctx := tunnel.NewContext(context.Background(), "tcp", l.address, pc.RemoteAddr().String())
+			tunnel.SetLocal(ctx, pc.LocalAddr().String())
+			ctx = access.WithLimiter(ctx, l.limiter)
+			tunnel.SetTimeouts(ctx, l.timeouts.Load())
+			if l.fallback.Load().Handle(ctx, pc, nil, nil) {
 				return
 			}
+			conn := net.Conn(pc)
+			if tlsConfig := l.tlsConfig.Load(); tlsConfig != nil {
+				// terminate tls after fallback sniffing, so unmatched SNIs still could be routed by tls-fallback
+				conn = tls.Server(conn, tlsConfig)
+			}
 			select {
 			case <-l.closed:
+				_ = conn.Close()
 				return
 			case l.ch <- acceptResult{conn: conn, err: err}:
 			}
@@ -72,27 +138,98 @@ func (l *tcpListener) loop() {
 	}
 }
 
-func ListenTcp(listenerConfig Config) (net.Listener, error) {
-	lc := net.ListenConfig{}
-	lc.SetMultipathTCP(true)
-	netLn, err := lc.Listen(context.Background(), "tcp", listenerConfig.BindAddress)
+// countedConn decreases the active connections of the listener when closed
+type countedConn struct {
+	peek.Conn
+	closeOnce sync.Once
+	active    *metrics.Gauge
+	release   func() // of the access limiter
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.active.Dec()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (c *countedConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *countedConn) ToReader() io.Reader {
+	return c.Conn
+}
+
+func (c *countedConn) WriterReplaceable() bool {
+	return true
+}
+
+func (c *countedConn) ToWriter() io.Writer {
+	return c.Conn
+}
+
+func (l *tcpListener) Update(listenerConfig Config) error {
+	store, err := newCertStore(listenerConfig.TLSConfig)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	f, err := fallback.NewFallback(fallback.Config{
+	fallbackConfig := fallback.Config{
 		FallbackConfig:      listenerConfig.FallbackConfig,
 		ProxyConfig:         listenerConfig.ProxyConfig,
 		IsWebSocketListener: listenerConfig.IsWebSocketListener,
-	})
-	if f != nil {
-		ln := &tcpListener{
-			Listener: netLn,
-			closed:   make(chan struct{}),
-			ch:       make(chan acceptResult),
-			fallback: f,
+		Sniff:               listenerConfig.BanMaxFails > 0,
+	}
+	var tlsConfig *tls.Config
+	if store != nil {
+		fallbackConfig.IsLocalSNI = store.HasSNI
+		tlsConfig = store.TLSConfig()
+		if listenerConfig.IsWebSocketListener {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 		}
-		go ln.loop()
-		return ln, nil
 	}
-	return netLn, nil
+	f, err := fallback.NewFallback(fallbackConfig)
+	if err != nil {
+		return err
+	}
+	if err = l.limiter.Update(listenerConfig.AccessConfig); err != nil {
+		return err
+	}
+	l.fallback.Store(f)
+	l.tlsConfig.Store(tlsConfig)
+	l.proxyProtocol.Store(listenerConfig.AcceptProxyProtocol)
+	l.trusted.Store(listenerConfig.TrustedProxies)
+	l.timeouts.Store(listenerConfig.TimeoutConfig)
+	return nil
+}
+
+func ListenTcp(listenerConfig Config) (Listener, error) {
+	lc := net.ListenConfig{}
+	lc.SetMultipathTCP(true)
+	netLn, err := lc.Listen(context.Background(), "tcp", listenerConfig.BindAddress)
+	if err != nil {
+		return nil, err
+	}
+	typ := "client"
+	if listenerConfig.IsWebSocketListener {
+		typ = "server"
+	}
+	ln := &tcpListener{
+		Listener: netLn,
+		closed:   make(chan struct{}),
+		ch:       make(chan acceptResult),
+		address:  listenerConfig.BindAddress,
+		limiter:  access.NewLimiter(listenerConfig.BindAddress),
+		active:   metrics.ConnectionsActive.With(typ, listenerConfig.BindAddress),
+		total:    metrics.ConnectionsTotal.With(typ, listenerConfig.BindAddress),
+	}
+	if err = ln.Update(listenerConfig); err != nil {
+		_ = netLn.Close()
+		return nil, err
+	}
+	go ln.loop()
+	return ln, nil
 }
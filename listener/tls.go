@@ -0,0 +1,131 @@
+package listener
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+const certCheckInterval = 10 * time.Second
+
+type certPair struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func (p *certPair) load() (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cert != nil && time.Since(p.lastCheck) < certCheckInterval {
+		return p.cert, nil
+	}
+	p.lastCheck = time.Now()
+
+	var modTime time.Time
+	for _, file := range []string{p.certFile, p.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if p.cert != nil { // keep using the old one
+				slog.Warn("Check certificate failed, keep the old one", "err", err)
+				return p.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if p.cert != nil && modTime.Equal(p.modTime) {
+		return p.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		if p.cert != nil {
+			slog.Warn("Reload certificate failed, keep the old one", "err", err)
+			return p.cert, nil
+		}
+		return nil, err
+	}
+	if p.cert != nil {
+		slog.Info("Reload certificate", "file", p.certFile)
+	}
+	p.cert = &cert
+	p.modTime = modTime
+	return p.cert, nil
+}
+
+type certStore struct {
+	pairs []*certPair
+}
+
+func newCertStore(tlsConfig config.TLSConfig) (*certStore, error) {
+	s := &certStore{}
+	if len(tlsConfig.TLSCert) > 0 || len(tlsConfig.TLSKey) > 0 {
+		s.pairs = append(s.pairs, &certPair{certFile: tlsConfig.TLSCert, keyFile: tlsConfig.TLSKey})
+	}
+	for _, certConfig := range tlsConfig.TLSCerts {
+		s.pairs = append(s.pairs, &certPair{certFile: certConfig.Cert, keyFile: certConfig.Key})
+	}
+	if len(s.pairs) == 0 {
+		return nil, nil
+	}
+	for _, pair := range s.pairs { // check at startup
+		if _, err := pair.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *certStore) match(sni string) *tls.Certificate {
+	if len(sni) == 0 {
+		return nil
+	}
+	for _, pair := range s.pairs {
+		cert, err := pair.load()
+		if err != nil {
+			slog.Warn("Load certificate failed", "err", err)
+			continue
+		}
+		if cert.Leaf != nil && cert.Leaf.VerifyHostname(sni) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// HasSNI reports whether the sni is served by a local certificate
+func (s *certStore) HasSNI(sni string) bool {
+	return s.match(sni) != nil
+}
+
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.match(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	for _, pair := range s.pairs { // default certificate
+		if cert, err := pair.load(); err == nil {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("no certificate available")
+}
+
+func (s *certStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/tunnel"
+)
+
+// contextHandler adds the connection ID carried by the context to every record,
+// so all lines of one session can be correlated
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := tunnel.InfoFromContext(ctx); info != nil {
+		r.AddAttrs(slog.Uint64("conn", info.ID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if len(level) == 0 {
+		return slog.LevelInfo, nil
+	}
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// Setup replaces the default slog logger (and the standard log package which writes to it)
+func Setup(level string, format string, disable bool) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stderr
+	if disable {
+		w = io.Discard
+	}
+	opts := &slog.HandlerOptions{Level: l, AddSource: l <= slog.LevelDebug}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log-format: %s", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
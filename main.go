@@ -1,26 +1,107 @@
 package main
 
 import (
-	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/wwqgtxx/wstunnel/admin"
 	"github.com/wwqgtxx/wstunnel/client"
 	"github.com/wwqgtxx/wstunnel/client/mtproxy/tools"
+	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/logging"
+	"github.com/wwqgtxx/wstunnel/metrics"
 	"github.com/wwqgtxx/wstunnel/server"
+	"github.com/wwqgtxx/wstunnel/tunnel"
 	"github.com/wwqgtxx/wstunnel/udp"
 )
 
+func loadConfig(configFile string) (*config.Config, error) {
+	buf, err := config.ReadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseConfig(buf)
+}
+
+// apply builds everything from cfg and makes the running listeners match it,
+// listeners on an unchanged port are updated in place without dropping live tunnels
+func apply(cfg *config.Config) {
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat, cfg.DisableLog); err != nil {
+		slog.Error("Invalid log config, keep the old one", "err", err)
+	}
+	tunnel.SetQuotaStateFile(cfg.QuotaStateFile)
+	common.PortToServer = make(map[string]common.Server)
+	common.PortToClient = make(map[string]common.Client)
+	for _, clientConfig := range cfg.ClientConfigs {
+		client.BuildClient(clientConfig)
+	}
+	for _, serverConfig := range cfg.ServerConfigs {
+		server.BuildServer(serverConfig)
+	}
+	if !cfg.DisableUdp {
+		for _, udpConfig := range cfg.UdpConfigs {
+			udp.BuildUdp(udpConfig)
+		}
+	}
+	if !cfg.DisableClient {
+		for _, reverseConfig := range cfg.ReverseConfigs {
+			client.BuildReverse(reverseConfig)
+		}
+	}
+	if cfg.DisableClient {
+		clear(common.PortToClient)
+	} else {
+		client.ResolveClients()
+	}
+	if cfg.DisableServer {
+		clear(common.PortToServer)
+	}
+	metrics.Serve(cfg.MetricsAddress)
+	admin.Serve(cfg.AdminAddress, cfg.AdminToken)
+	common.StartListeners()
+	udp.StartUdps()
+	client.StartReverses() // after servers, so that a local reverse server is ready
+}
+
+// shutdown stops accepting and waits the active tunnels finish,
+// the remaining ones are interrupted after timeout or on another signal
+func shutdown(timeout time.Duration, sigCh <-chan os.Signal) {
+	slog.Info("Shutting down, waiting tunnels finish", "tunnels", tunnel.Count(), "timeout", timeout)
+	common.StopListeners()
+	udp.StopUdps()
+	client.StopReverses()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel.Wait(timeout)
+	}()
+	select {
+	case <-done:
+	case <-sigCh:
+	}
+	if n := tunnel.Count(); n > 0 {
+		slog.Info("Interrupt tunnels", "tunnels", n)
+		tunnel.InterruptAll()
+		tunnel.Wait(5 * time.Second) // for the websocket close frames
+	}
+	tunnel.CloseSessions()
+	if err := tunnel.SaveQuotaState(); err != nil {
+		slog.Error("Save quota state failed", "err", err)
+	}
+	slog.Info("Shutdown finished")
+}
+
 func main() {
 	if len(os.Args) > 2 && os.Args[1] == "generate-secret" {
 		tools.Generate(os.Args[2])
 		return
 	}
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	configFile := "config.yaml"
 	if len(os.Args) == 2 {
 		configFile = os.Args[1]
@@ -29,36 +110,54 @@ func main() {
 		currentDir, _ := os.Getwd()
 		configFile = filepath.Join(currentDir, configFile)
 	}
-	buf, err := config.ReadConfig(configFile)
+	cfg, err := loadConfig(configFile)
 	if err != nil {
 		panic(err)
 	}
-	cfg, err := config.ParseConfig(buf)
-	if err != nil {
-		panic(err)
-	}
-	if cfg.DisableLog {
-		log.SetOutput(io.Discard)
-	}
-	for _, clientConfig := range cfg.ClientConfigs {
-		client.BuildClient(clientConfig)
-	}
-	for _, serverConfig := range cfg.ServerConfigs {
-		server.BuildServer(serverConfig)
-	}
-	for _, udpConfig := range cfg.UdpConfigs {
-		udp.BuildUdp(udpConfig)
-	}
-	if !cfg.DisableClient {
-		client.StartClients()
-	}
-	if !cfg.DisableServer {
-		server.StartServers()
+	apply(cfg)
+
+	var modTime time.Time
+	if info, err := os.Stat(configFile); err == nil {
+		modTime = info.ModTime()
 	}
-	if !cfg.DisableUdp {
-		udp.StartUdps()
+	reload := func() {
+		if info, err := os.Stat(configFile); err == nil {
+			modTime = info.ModTime()
+		}
+		newCfg, err := loadConfig(configFile)
+		if err != nil {
+			slog.Error("Reload config failed, keep the old one", "err", err)
+			return
+		}
+		slog.Info("Reload config", "file", configFile)
+		cfg = newCfg
+		apply(cfg)
 	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPoll := time.Now()
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				shutdown(time.Duration(cfg.ShutdownTimeout)*time.Second, sigCh)
+				return
+			}
+			reload()
+		case <-ticker.C:
+			if cfg.ReloadInterval <= 0 || time.Since(lastPoll) < time.Duration(cfg.ReloadInterval)*time.Second {
+				continue
+			}
+			lastPoll = time.Now()
+			info, err := os.Stat(configFile)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			reload()
+		}
+	}
 }
@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w io.Writer, name string, labels string)
+}
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	_, _ = fmt.Fprintf(w, "%s%s %d\n", name, labels, c.v.Load())
+}
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels string) {
+	_, _ = fmt.Fprintf(w, "%s%s %d\n", name, labels, g.v.Load())
+}
+
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(bound)), h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	_, _ = fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// family is a metric with the same name and different label values
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	newMetric  func() metric
+
+	mu       sync.Mutex
+	children map[string]metric
+}
+
+var (
+	familiesMu sync.Mutex
+	families   []*family
+)
+
+func newFamily(name, help, typ string, labelNames []string, newMetric func() metric) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		newMetric:  newMetric,
+		children:   make(map[string]metric),
+	}
+	familiesMu.Lock()
+	defer familiesMu.Unlock()
+	families = append(families, f)
+	return f
+}
+
+func (f *family) with(labelValues []string) metric {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Errorf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	var b strings.Builder
+	if len(labelValues) > 0 {
+		b.WriteByte('{')
+		for i, value := range labelValues {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(f.labelNames[i])
+			b.WriteString(`="`)
+			b.WriteString(escape(value))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	labels := b.String()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.children[labels]
+	if !ok {
+		m = f.newMetric()
+		f.children[labels] = m
+	}
+	return m
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	labels := make([]string, 0, len(f.children))
+	for l := range f.children {
+		labels = append(labels, l)
+	}
+	f.mu.Unlock()
+	slices.Sort(labels)
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, l := range labels {
+		f.mu.Lock()
+		m := f.children[l]
+		f.mu.Unlock()
+		m.write(w, f.name, l)
+	}
+}
+
+type CounterVec struct{ f *family }
+
+func NewCounterVec(name, help string, labelNames ...string) CounterVec {
+	return CounterVec{newFamily(name, help, "counter", labelNames, func() metric { return &Counter{} })}
+}
+
+func (v CounterVec) With(labelValues ...string) *Counter {
+	return v.f.with(labelValues).(*Counter)
+}
+
+type GaugeVec struct{ f *family }
+
+func NewGaugeVec(name, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{newFamily(name, help, "gauge", labelNames, func() metric { return &Gauge{} })}
+}
+
+func (v GaugeVec) With(labelValues ...string) *Gauge {
+	return v.f.with(labelValues).(*Gauge)
+}
+
+type HistogramVec struct{ f *family }
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) HistogramVec {
+	return HistogramVec{newFamily(name, help, "histogram", labelNames, func() metric {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+}
+
+func (v HistogramVec) With(labelValues ...string) *Histogram {
+	return v.f.with(labelValues).(*Histogram)
+}
+
+// WriteText writes all metrics in the prometheus text exposition format
+func WriteText(w io.Writer) {
+	familiesMu.Lock()
+	fs := slices.Clone(families)
+	familiesMu.Unlock()
+	for _, f := range fs {
+		f.write(w)
+	}
+}
+
+func withLabel(labels string, name, value string) string {
+	label := name + `="` + value + `"`
+	if len(labels) == 0 {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
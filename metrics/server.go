@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	serverMu      sync.Mutex
+	server        *http.Server
+	serverAddress string
+)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteText(w)
+}
+
+// Serve serves the metrics on address at /metrics, an empty address stops serving,
+// calling it again with the same address does nothing
+func Serve(address string) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	if address == serverAddress && server != nil {
+		return
+	}
+	if server != nil {
+		slog.Info("Close Metrics Listening", "address", serverAddress)
+		_ = server.Close()
+		server = nil
+	}
+	serverAddress = address
+	if len(address) == 0 {
+		return
+	}
+	slog.Info("New Metrics Listening", "address", address)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("Listen failed", "address", address, "err", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handler)
+	server = &http.Server{Handler: mux}
+	go func(server *http.Server) {
+		err := server.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Serve failed", "address", ln.Addr().String(), "err", err)
+		}
+	}(server)
+}
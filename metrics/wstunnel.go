@@ -0,0 +1,23 @@
+package metrics
+
+var DialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	ConnectionsActive = NewGaugeVec("wstunnel_connections_active", "Active connections of the listener.", "type", "listener")
+	ConnectionsTotal  = NewCounterVec("wstunnel_connections_total", "Total accepted connections of the listener.", "type", "listener")
+
+	TunnelReceivedBytes = NewCounterVec("wstunnel_tunnel_received_bytes_total", "Bytes received from the incoming side of tunnels.").With()
+	TunnelSentBytes     = NewCounterVec("wstunnel_tunnel_sent_bytes_total", "Bytes sent to the incoming side of tunnels.").With()
+
+	DialDuration = NewHistogramVec("wstunnel_dial_duration_seconds", "Duration of successful dials to targets.", DialBuckets, "type", "target")
+	DialErrors   = NewCounterVec("wstunnel_dial_errors_total", "Failed dials to targets.", "type", "target")
+
+	FallbackHits    = NewCounterVec("wstunnel_fallback_hits_total", "Connections handled by fallbacks.", "fallback")
+	TLSClientHellos = NewCounterVec("wstunnel_tls_client_hellos_total", "ClientHellos routed by tls-fallback, by the highest supported version and the first offered alpn.", "version", "alpn")
+
+	AccessRejected = NewCounterVec("wstunnel_access_rejected_total", "Connections or udp associations rejected by access control.", "listener", "reason")
+	AccessBans     = NewCounterVec("wstunnel_access_bans_total", "Ips banned for repeated failures.", "listener", "reason")
+
+	UdpAssociationsActive = NewGaugeVec("wstunnel_udp_associations_active", "Live udp associations.", "listener")
+	UdpAssociationsTotal  = NewCounterVec("wstunnel_udp_associations_total", "Total udp associations.", "listener")
+)
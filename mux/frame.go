@@ -0,0 +1,65 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// modify from https://github.com/xtaci/smux
+
+const (
+	version = 1
+)
+
+const (
+	cmdSYN byte = iota // stream open
+	cmdFIN             // stream close, a.k.a EOF mark
+	cmdPSH             // data push
+	cmdNOP             // no operation, used as keepalive
+	cmdUPD             // notify bytes consumed by remote peer-end
+)
+
+const (
+	headerSize    = 8
+	updSize       = 4
+	maxFrameSize  = 32 * 1024
+	streamWindow  = 512 * 1024
+	acceptBacklog = 1024
+)
+
+var (
+	ErrInvalidProtocol = errors.New("mux: invalid protocol")
+	ErrSessionClosed   = errors.New("mux: session closed")
+	ErrStreamClosed    = errors.New("mux: stream closed")
+	ErrGoAway          = errors.New("mux: stream id overflows")
+)
+
+type frameHeader [headerSize]byte
+
+func (h frameHeader) Version() byte {
+	return h[0]
+}
+
+func (h frameHeader) Cmd() byte {
+	return h[1]
+}
+
+func (h frameHeader) Length() uint16 {
+	return binary.BigEndian.Uint16(h[2:])
+}
+
+func (h frameHeader) StreamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:])
+}
+
+func writeFrame(w io.Writer, cmd byte, sid uint32, data []byte) error {
+	buf := make([]byte, headerSize+len(data))
+	buf[0] = version
+	buf[1] = cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], sid)
+	copy(buf[headerSize:], data)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,453 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  byte
+		sid  uint32
+		data []byte
+	}{
+		{"syn", cmdSYN, 1, nil},
+		{"fin", cmdFIN, 0xfffffffe, nil},
+		{"psh", cmdPSH, 3, []byte("hello")},
+		{"psh max", cmdPSH, 5, make([]byte, maxFrameSize)},
+		{"upd", cmdUPD, 7, []byte{0, 0, 1, 0}},
+		{"nop", cmdNOP, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.cmd, tt.sid, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != headerSize+len(tt.data) {
+				t.Fatalf("frame size = %d, want %d", buf.Len(), headerSize+len(tt.data))
+			}
+			var hdr frameHeader
+			copy(hdr[:], buf.Next(headerSize))
+			if hdr.Version() != version || hdr.Cmd() != tt.cmd || hdr.StreamID() != tt.sid || int(hdr.Length()) != len(tt.data) {
+				t.Fatalf("header = %d %d %d %d", hdr.Version(), hdr.Cmd(), hdr.StreamID(), hdr.Length())
+			}
+			if !bytes.Equal(buf.Bytes(), tt.data) && len(tt.data) > 0 {
+				t.Fatal("payload mismatch")
+			}
+		})
+	}
+}
+
+func newSessionPair(t *testing.T) (client, server *Session) {
+	c, s := net.Pipe()
+	client, server = Client(c), Server(s)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return
+}
+
+func TestStreamTransfer(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"one byte", 1},
+		{"one frame", maxFrameSize},
+		{"split frames", maxFrameSize + 1},
+		{"over window", 3 * streamWindow}, // needs the cmdUPD from the reader
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newSessionPair(t)
+			data := make([]byte, tt.size)
+			_, _ = rand.Read(data)
+
+			go func() {
+				stream, err := client.OpenStream()
+				if err != nil {
+					return
+				}
+				_, _ = stream.Write(data)
+				_ = stream.Close()
+			}()
+
+			stream, err := server.AcceptStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("received %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStreamIDs(t *testing.T) {
+	client, server := newSessionPair(t)
+	for i, want := range []uint32{1, 3, 5} {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.ID() != want {
+			t.Fatalf("stream %d id = %d, want %d", i, stream.ID(), want)
+		}
+		accepted, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted.ID() != want {
+			t.Fatalf("accepted stream %d id = %d, want %d", i, accepted.ID(), want)
+		}
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := newSessionPair(t)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+// rawPeer reads the frames sent by a Session to the other side of a net.Pipe
+type rawPeer struct {
+	conn   net.Conn
+	frames chan frameHeader
+}
+
+func newRawPeer(t *testing.T) (*Session, *rawPeer) {
+	c, s := net.Pipe()
+	server := Server(s)
+	p := &rawPeer{conn: c, frames: make(chan frameHeader, 16)}
+	go func() {
+		var hdr frameHeader
+		for {
+			if _, err := io.ReadFull(c, hdr[:]); err != nil {
+				close(p.frames)
+				return
+			}
+			if _, err := io.CopyN(io.Discard, c, int64(hdr.Length())); err != nil {
+				close(p.frames)
+				return
+			}
+			if hdr.Cmd() != cmdNOP {
+				p.frames <- hdr
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = c.Close()
+	})
+	return server, p
+}
+
+func (p *rawPeer) expect(t *testing.T, cmd byte, sid uint32) {
+	t.Helper()
+	select {
+	case hdr, ok := <-p.frames:
+		if !ok {
+			t.Fatal("session closed")
+		}
+		if hdr.Cmd() != cmd || hdr.StreamID() != sid {
+			t.Fatalf("frame = cmd %d sid %d, want cmd %d sid %d", hdr.Cmd(), hdr.StreamID(), cmd, sid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame")
+	}
+}
+
+func TestWindowOverflow(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+		reset bool
+	}{
+		{"within window", []int{maxFrameSize, streamWindow - maxFrameSize}, false},
+		{"over window", []int{streamWindow, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, peer := newRawPeer(t)
+			if err := writeFrame(peer.conn, cmdSYN, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			stream, err := server.AcceptStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range tt.sizes {
+				for size > 0 { // never read, so nothing is consumed
+					n := min(size, maxFrameSize)
+					if err = writeFrame(peer.conn, cmdPSH, 1, make([]byte, n)); err != nil {
+						t.Fatal(err)
+					}
+					size -= n
+				}
+			}
+			if !tt.reset {
+				_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err = io.ReadFull(stream, make([]byte, sum(tt.sizes))); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			peer.expect(t, cmdFIN, 1)
+		})
+	}
+}
+
+func sum(sizes []int) (n int) {
+	for _, size := range sizes {
+		n += size
+	}
+	return
+}
+
+func TestUpdateAfterRead(t *testing.T) {
+	server, peer := newRawPeer(t)
+	if err := writeFrame(peer.conn, cmdSYN, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < streamWindow/2/maxFrameSize; i++ {
+		if err = writeFrame(peer.conn, cmdPSH, 1, make([]byte, maxFrameSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = io.ReadFull(stream, make([]byte, streamWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	peer.expect(t, cmdUPD, 1)
+}
+
+func TestDrain(t *testing.T) {
+	client, server := newSessionPair(t)
+	first, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Drain()
+	if server.CanOpenStream() {
+		t.Fatal("draining session can open streams")
+	}
+	if _, err = server.OpenStream(); err != ErrGoAway {
+		t.Fatalf("open stream error = %v, want %v", err, ErrGoAway)
+	}
+
+	// refused by the draining peer
+	second, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read refused stream error = %v, want EOF", err)
+	}
+
+	// the existing stream still works
+	go func() { _, _ = first.Write([]byte("ping")) }()
+	buf := make([]byte, 4)
+	_ = accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read = %q %v", buf, err)
+	}
+
+	_ = accepted.Close()
+	if !server.IsClosed() {
+		t.Fatal("drained session not closed after its streams closed")
+	}
+}
+
+func TestUpdateFrameSize(t *testing.T) {
+	server, peer := newRawPeer(t)
+	if err := writeFrame(peer.conn, cmdSYN, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	var buf [updSize + 1]byte
+	binary.BigEndian.PutUint32(buf[:], 1)
+	if err := writeFrame(peer.conn, cmdUPD, 1, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-peer.frames:
+		for ok {
+			_, ok = <-peer.frames
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session with an invalid cmdUPD not closed")
+	}
+}
+
+// testDialer dials the net.Pipes served by Server sessions
+type testDialer struct {
+	mu    sync.Mutex
+	dials int
+	delay time.Duration
+	err   error
+	peers []*Session
+}
+
+func (d *testDialer) dial() (net.Conn, error) {
+	time.Sleep(d.delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, s := net.Pipe()
+	d.peers = append(d.peers, Server(s))
+	return c, nil
+}
+
+func (d *testDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, peer := range d.peers {
+		_ = peer.Close()
+	}
+}
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConnections int
+		maxStreams     int
+		streams        int
+		concurrent     bool
+		wantDials      int
+	}{
+		{"one stream", 2, 2, 1, false, 1},
+		{"second session", 2, 2, 3, false, 2},
+		{"over max streams", 2, 2, 6, false, 2},
+		{"one stream per session", 3, 1, 3, false, 3},
+		{"concurrent wait dialing", 2, 100, 10, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &testDialer{delay: 10 * time.Millisecond}
+			defer d.close()
+			p := NewPool(d.dial, tt.maxConnections, tt.maxStreams)
+			defer p.Close()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.streams)
+			for i := 0; i < tt.streams; i++ {
+				open := func() {
+					defer wg.Done()
+					if _, err := p.OpenStream(); err != nil {
+						errs <- err
+					}
+				}
+				wg.Add(1)
+				if tt.concurrent {
+					go open()
+				} else {
+					open()
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if d.dials != tt.wantDials {
+				t.Fatalf("dials = %d, want %d", d.dials, tt.wantDials)
+			}
+		})
+	}
+}
+
+func TestPoolConcurrentDial(t *testing.T) {
+	d := &testDialer{delay: 10 * time.Millisecond}
+	defer d.close()
+	p := NewPool(d.dial, 4, 1)
+	defer p.Close()
+	if _, err := p.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	// the first session is full, so they dial concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.OpenStream(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if d.dials != 4 {
+		t.Fatalf("dials = %d, want 4", d.dials)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	dialErr := errors.New("dial failed")
+	d := &testDialer{err: dialErr}
+	p := NewPool(d.dial, 1, 1)
+	if _, err := p.OpenStream(); !errors.Is(err, dialErr) {
+		t.Fatalf("open stream error = %v, want %v", err, dialErr)
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	d := &testDialer{}
+	defer d.close()
+	p := NewPool(d.dial, 1, 1)
+	stream, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Drain()
+	if stream.sess.IsClosed() {
+		t.Fatal("session closed before its stream")
+	}
+	_ = stream.Close()
+	if !stream.sess.IsClosed() {
+		t.Fatal("drained session not closed after its stream closed")
+	}
+}
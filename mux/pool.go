@@ -0,0 +1,128 @@
+package mux
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	DefaultMaxConnections = 4
+	DefaultMaxStreams     = 8
+)
+
+type Pool struct {
+	dial           func() (net.Conn, error)
+	maxConnections int
+	maxStreams     int
+
+	mu       sync.Mutex
+	sessions []*Session
+	dialing  int
+	dialed   chan struct{} // closed when a dial finished, not nil while dialing
+	closed   bool
+}
+
+func NewPool(dial func() (net.Conn, error), maxConnections, maxStreams int) *Pool {
+	if maxConnections <= 0 {
+		maxConnections = DefaultMaxConnections
+	}
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreams
+	}
+	return &Pool{
+		dial:           dial,
+		maxConnections: maxConnections,
+		maxStreams:     maxStreams,
+	}
+}
+
+// pick returns the session with the fewest streams, the sessions which can't open stream any more are drained
+func (p *Pool) pick() *Session {
+	var best *Session
+	sessions := p.sessions[:0]
+	for _, session := range p.sessions {
+		if !session.CanOpenStream() {
+			session.Drain() // closed after its last stream ended
+			continue
+		}
+		sessions = append(sessions, session)
+		if best == nil || session.NumStreams() < best.NumStreams() {
+			best = session
+		}
+	}
+	clear(p.sessions[len(sessions):])
+	p.sessions = sessions
+	return best
+}
+
+// OpenStream dials a new session without holding the lock, so the other streams don't wait it
+func (p *Pool) OpenStream() (*Stream, error) {
+	for {
+		p.mu.Lock()
+		best := p.pick()
+		if best != nil && (best.NumStreams() < p.maxStreams || len(p.sessions)+p.dialing >= p.maxConnections) {
+			p.mu.Unlock()
+			return best.OpenStream()
+		}
+		if best == nil && p.dialing > 0 { // wait the dialing session instead of dialing more
+			dialed := p.dialed
+			p.mu.Unlock()
+			<-dialed
+			continue
+		}
+		p.dialing++
+		if p.dialed == nil {
+			p.dialed = make(chan struct{})
+		}
+		p.mu.Unlock()
+
+		conn, err := p.dial()
+
+		p.mu.Lock()
+		p.dialing--
+		close(p.dialed) // wake the waiters, a new channel for the other dials still in progress
+		p.dialed = nil
+		if p.dialing > 0 {
+			p.dialed = make(chan struct{})
+		}
+		if err != nil {
+			p.mu.Unlock()
+			if best == nil {
+				return nil, err
+			}
+			return best.OpenStream()
+		}
+		session := Client(conn)
+		if p.closed { // drained or closed while dialing
+			p.mu.Unlock()
+			stream, err := session.OpenStream()
+			session.Drain()
+			return stream, err
+		}
+		p.sessions = append(p.sessions, session)
+		p.mu.Unlock()
+		return session.OpenStream()
+	}
+}
+
+// Drain drains all sessions, see Session.Drain
+func (p *Pool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range p.sessions {
+		session.Drain()
+	}
+	p.sessions = nil
+	p.closed = true
+}
+
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range p.sessions {
+		_ = session.Close()
+	}
+	p.sessions = nil
+	p.closed = true
+	return nil
+}
@@ -0,0 +1,260 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HeaderKey   = "X-Wstunnel-Mux"
+	HeaderValue = "1"
+
+	KeepAliveInterval = 10 * time.Second
+	KeepAliveTimeout  = 30 * time.Second
+)
+
+func IsMuxRequest(r *http.Request) bool {
+	return r.Header.Get(HeaderKey) == HeaderValue
+}
+
+func IsMuxResponse(header http.Header) bool {
+	return header.Get(HeaderKey) == HeaderValue
+}
+
+type Session struct {
+	conn net.Conn
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	goAway   bool
+	draining bool
+
+	acceptCh chan *Stream
+	writeMu  sync.Mutex
+	lastRecv atomic.Int64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, nextID uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		nextID:   nextID,
+		acceptCh: make(chan *Stream, acceptBacklog),
+		die:      make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+	s.mu.Lock()
+	if s.goAway {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+	id := s.nextID
+	s.nextID += 2
+	if s.nextID < id { // overflow
+		s.goAway = true
+	}
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) CanOpenStream() bool {
+	if s.IsClosed() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.goAway
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) writeFrame(cmd byte, sid uint32, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	err := writeFrame(s.conn, cmd, sid, data)
+	if err != nil {
+		_ = s.Close()
+	}
+	return err
+}
+
+func (s *Session) getStream(sid uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[sid]
+}
+
+func (s *Session) removeStream(sid uint32) {
+	s.mu.Lock()
+	delete(s.streams, sid)
+	idle := s.draining && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		_ = s.Close()
+	}
+}
+
+// Drain stops opening and accepting new streams and closes the session after all existing streams closed
+func (s *Session) Drain() {
+	s.mu.Lock()
+	s.goAway = true
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		_ = s.Close()
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	var hdr frameHeader
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		if hdr.Version() != version {
+			return
+		}
+		sid := hdr.StreamID()
+		var data []byte
+		if length := hdr.Length(); length > 0 {
+			data = make([]byte, length)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				return
+			}
+		}
+		switch hdr.Cmd() {
+		case cmdNOP:
+		case cmdSYN:
+			s.mu.Lock()
+			if _, ok := s.streams[sid]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			if s.draining { // refuse the new streams of the peer
+				s.mu.Unlock()
+				_ = s.writeFrame(cmdFIN, sid, nil)
+				continue
+			}
+			stream := newStream(sid, s)
+			s.streams[sid] = stream
+			s.mu.Unlock()
+			select {
+			case s.acceptCh <- stream:
+			case <-s.die:
+				return
+			}
+		case cmdFIN:
+			if stream := s.getStream(sid); stream != nil {
+				stream.fin()
+			}
+		case cmdPSH:
+			if stream := s.getStream(sid); stream != nil && !stream.push(data) {
+				_ = stream.Close() // reset the stream overflowing the window
+			}
+		case cmdUPD:
+			if len(data) != updSize {
+				return
+			}
+			if stream := s.getStream(sid); stream != nil {
+				stream.update(binary.BigEndian.Uint32(data))
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastRecv.Load())) > KeepAliveTimeout {
+				_ = s.Close()
+				return
+			}
+			_ = s.writeFrame(cmdNOP, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
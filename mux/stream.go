@@ -0,0 +1,241 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/atomic"
+)
+
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu       sync.Mutex
+	buffers  [][]byte
+	buffered uint32 // bytes in buffers
+	consumed uint32 // bytes read but not yet reported to peer by cmdUPD
+	inflight uint32 // bytes written but not yet consumed by peer
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	readDeadline  atomic.TypedValue[time.Time]
+	writeDeadline atomic.TypedValue[time.Time]
+
+	finEvent chan struct{}
+	finOnce  sync.Once
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		finEvent:   make(chan struct{}),
+		die:        make(chan struct{}),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		s.mu.Lock()
+		for len(s.buffers) > 0 && n < len(b) {
+			nn := copy(b[n:], s.buffers[0])
+			n += nn
+			if nn < len(s.buffers[0]) {
+				s.buffers[0] = s.buffers[0][nn:]
+			} else {
+				s.buffers[0] = nil
+				s.buffers = s.buffers[1:]
+			}
+		}
+		var incr uint32
+		if n > 0 {
+			s.buffered -= uint32(n)
+			s.consumed += uint32(n)
+			if s.consumed >= streamWindow/2 {
+				incr = s.consumed
+				s.consumed = 0
+			}
+		}
+		s.mu.Unlock()
+
+		if n > 0 {
+			if incr > 0 {
+				var buf [updSize]byte
+				binary.BigEndian.PutUint32(buf[:], incr)
+				_ = s.sess.writeFrame(cmdUPD, s.id, buf[:])
+			}
+			return n, nil
+		}
+
+		select {
+		case <-s.finEvent:
+			return 0, io.EOF
+		case <-s.die:
+			return 0, io.ErrClosedPipe
+		case <-s.sess.die:
+			return 0, io.EOF
+		default:
+		}
+
+		if err = s.wait(s.readEvent, s.readDeadline.Load()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.mu.Lock()
+		window := streamWindow - int(s.inflight)
+		if window > 0 {
+			size := min(len(b), maxFrameSize, window)
+			s.inflight += uint32(size)
+			s.mu.Unlock()
+
+			select {
+			case <-s.die:
+				return n, io.ErrClosedPipe
+			default:
+			}
+			if err = s.sess.writeFrame(cmdPSH, s.id, b[:size]); err != nil {
+				return
+			}
+			n += size
+			b = b[size:]
+			continue
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.finEvent: // peer closed the stream, no one will consume our data
+			return n, io.ErrClosedPipe
+		case <-s.die:
+			return n, io.ErrClosedPipe
+		case <-s.sess.die:
+			return n, ErrSessionClosed
+		default:
+		}
+
+		if err = s.wait(s.writeEvent, s.writeDeadline.Load()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Stream) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+		return nil
+	case <-s.finEvent:
+		return nil
+	case <-s.die:
+		return nil
+	case <-s.sess.die:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *Stream) Close() error {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		_ = s.sess.writeFrame(cmdFIN, s.id, nil)
+		s.sess.removeStream(s.id)
+	})
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.sess.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.sess.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	_ = s.SetWriteDeadline(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(t)
+	notify(s.readEvent)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(t)
+	notify(s.writeEvent)
+	return nil
+}
+
+// push returns false if the peer sent more than the window
+func (s *Stream) push(data []byte) bool {
+	s.mu.Lock()
+	if uint64(s.buffered)+uint64(s.consumed)+uint64(len(data)) > streamWindow {
+		s.mu.Unlock()
+		return false
+	}
+	s.buffers = append(s.buffers, data)
+	s.buffered += uint32(len(data))
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return true
+}
+
+func (s *Stream) update(consumed uint32) {
+	s.mu.Lock()
+	if consumed > s.inflight {
+		s.inflight = 0
+	} else {
+		s.inflight -= consumed
+	}
+	s.mu.Unlock()
+	notify(s.writeEvent)
+}
+
+func (s *Stream) fin() {
+	s.finOnce.Do(func() {
+		close(s.finEvent)
+	})
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
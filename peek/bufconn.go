@@ -38,6 +38,10 @@ func (c *BufferedConn) Peek(n int) ([]byte, error) {
 	return c.r.Peek(n)
 }
 
+func (c *BufferedConn) PeekAtLeast(lo, hi int) ([]byte, error) {
+	return c.r.Peek(max(lo, min(c.r.Buffered(), hi)))
+}
+
 func (c *BufferedConn) Read(p []byte) (int, error) {
 	return c.r.Read(p)
 }
@@ -76,3 +76,20 @@ func isClosedChan(c <-chan struct{}) bool {
 		return false
 	}
 }
+
+// PipeDeadline is a pipeDeadline for the conns which emulate their own read deadline
+type PipeDeadline struct {
+	pipeDeadline
+}
+
+func NewPipeDeadline() *PipeDeadline {
+	return &PipeDeadline{makePipeDeadline()}
+}
+
+func (d *PipeDeadline) Set(t time.Time) {
+	d.set(t)
+}
+
+func (d *PipeDeadline) Wait() <-chan struct{} {
+	return d.wait()
+}
@@ -48,6 +48,34 @@ func (c *peek) Peek(n int) ([]byte, error) {
 	return buf, sysErr
 }
 
+// PeekAtLeast peeks the arrived bytes up to hi, it waits for more data until at least lo bytes arrived
+func (c *peek) PeekAtLeast(lo, hi int) ([]byte, error) {
+	var sysErr error = nil
+	var arrived int
+	buf := make([]byte, hi)
+	err := c.rc.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK)
+		switch {
+		case n == 0 && err == nil:
+			sysErr = io.EOF
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR:
+			return false
+		case err != nil:
+			sysErr = err
+		case n < lo:
+			// MSG_PEEK leaves the data in socket, the poller wakes up again when more data arrived
+			return false
+		default:
+			arrived = n
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf[:arrived], sysErr
+}
+
 type peekConn struct {
 	net.Conn
 	peek
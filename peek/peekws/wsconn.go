@@ -34,6 +34,20 @@ func (c *edPeekConn) ReaderReplaceable() bool {
 	return true
 }
 
+func (c *edPeekConn) PeekAtLeast(lo, hi int) ([]byte, error) {
+	edBufLen := len(c.edBuf)
+	if lo <= edBufLen {
+		return c.edBuf[:min(hi, edBufLen)], nil
+	}
+	bb, err := peek.PeekAtLeast(c.Conn, lo-edBufLen, hi-edBufLen)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, edBufLen+len(bb))
+	buf = append(buf, c.edBuf...)
+	return append(buf, bb...), nil
+}
+
 func (c *edPeekConn) ToReader() io.Reader {
 	return c.Conn
 }
@@ -18,6 +18,7 @@ type toWriter interface {
 type Conn interface {
 	net.Conn
 	Peeker
+	atLeastPeeker
 	toReader
 	toWriter
 }
@@ -26,6 +27,19 @@ type Peeker interface {
 	Peek(n int) ([]byte, error)
 }
 
+type atLeastPeeker interface {
+	PeekAtLeast(lo, hi int) ([]byte, error)
+}
+
+// PeekAtLeast peeks the arrived bytes up to hi, it only blocks until lo bytes arrived,
+// so a protocol sniffer can grow its peek without waiting for the bytes client never sends
+func PeekAtLeast(peeker Peeker, lo, hi int) ([]byte, error) {
+	if p, ok := peeker.(atLeastPeeker); ok {
+		return p.PeekAtLeast(lo, hi)
+	}
+	return peeker.Peek(lo)
+}
+
 func ToReader(reader io.Reader) io.Reader {
 	if reader, ok := reader.(toReader); ok {
 		if reader.ReaderReplaceable() {
@@ -1,7 +1,7 @@
 package proxy
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"net/url"
 )
@@ -16,7 +16,7 @@ func parseProxy(proxyString string) (proxyUrl *url.URL, proxyStr string) {
 	if len(proxyString) > 0 {
 		u, err := url.Parse(proxyString)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Invalid proxy", "err", err)
 		}
 		proxyUrl = u
 
@@ -34,7 +34,7 @@ func getDialer(proxyUrl *url.URL) ContextDialer {
 	if proxyUrl != nil {
 		dialer, err := FromURL(proxyUrl, tcpDialer)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Invalid proxy", "err", err)
 		} else {
 			proxyDialer = dialer
 		}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/proxy/internal/socks"
+)
+
+const (
+	InboundSocks5 = "socks5"
+	InboundHttp   = "http"
+	InboundMixed  = "mixed" // socks5 or http, detected by the first byte
+)
+
+const (
+	socksAuthVersion   = 0x01
+	socksAuthSucceeded = 0x00
+	socksAuthFailed    = 0x01
+
+	socksGeneralFailure       socks.Reply = 0x01
+	socksCommandNotSupported  socks.Reply = 0x07
+	socksAddrTypeNotSupported socks.Reply = 0x08
+)
+
+var ErrInboundAuth = errors.New("invalid inbound username or password")
+
+// Inbound accepts the SOCKS5 (CONNECT only) and HTTP CONNECT requests of the local applications
+type Inbound struct {
+	mode     string
+	username string
+	password string
+}
+
+func NewInbound(mode, username, password string) (*Inbound, error) {
+	switch mode {
+	case InboundSocks5, InboundHttp, InboundMixed:
+	default:
+		return nil, fmt.Errorf("unknown inbound: %s", mode)
+	}
+	return &Inbound{mode: mode, username: username, password: password}, nil
+}
+
+// Handshake reads the request on conn and returns its destination "host:port",
+// reply must be called with the result of dialing the destination before any data is sent
+func (in *Inbound) Handshake(conn *peek.BufferedConn) (destination string, reply func(err error) error, err error) {
+	mode := in.mode
+	if mode == InboundMixed {
+		var b []byte
+		if b, err = conn.Peek(1); err != nil {
+			return
+		}
+		mode = InboundHttp
+		if b[0] == socks.Version5 {
+			mode = InboundSocks5
+		}
+	}
+	if mode == InboundSocks5 {
+		return in.handshakeSocks5(conn)
+	}
+	return in.handshakeHttp(conn)
+}
+
+func (in *Inbound) checkAuth(username, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(username), []byte(in.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(in.password)) == 1
+}
+
+func (in *Inbound) handshakeSocks5(conn *peek.BufferedConn) (destination string, reply func(err error) error, err error) {
+	r := conn.Reader()
+	b := make([]byte, 256)
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	if b[0] != socks.Version5 {
+		err = fmt.Errorf("unexpected socks version: %d", b[0])
+		return
+	}
+	methods := b[:b[1]]
+	if _, err = io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := socks.AuthMethodNotRequired
+	if len(in.username) > 0 || len(in.password) > 0 {
+		method = socks.AuthMethodUsernamePassword
+	}
+	if !bytes.Contains(methods, []byte{byte(method)}) {
+		_, _ = conn.Write([]byte{socks.Version5, byte(socks.AuthMethodNoAcceptableMethods)})
+		err = errors.New("no acceptable socks authentication methods")
+		return
+	}
+	if _, err = conn.Write([]byte{socks.Version5, byte(method)}); err != nil {
+		return
+	}
+	if method == socks.AuthMethodUsernamePassword {
+		// RFC 1929: ver, ulen, uname, plen, passwd
+		var username, password string
+		if _, err = io.ReadFull(r, b[:2]); err != nil {
+			return
+		}
+		if b[0] != socksAuthVersion {
+			err = fmt.Errorf("unexpected socks auth version: %d", b[0])
+			return
+		}
+		if username, err = readSocksString(r, b, int(b[1])); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(r, b[:1]); err != nil {
+			return
+		}
+		if password, err = readSocksString(r, b, int(b[0])); err != nil {
+			return
+		}
+		if !in.checkAuth(username, password) {
+			_, _ = conn.Write([]byte{socksAuthVersion, socksAuthFailed})
+			err = ErrInboundAuth
+			return
+		}
+		if _, err = conn.Write([]byte{socksAuthVersion, socksAuthSucceeded}); err != nil {
+			return
+		}
+	}
+
+	// ver, cmd, rsv, atyp, addr, port
+	if _, err = io.ReadFull(r, b[:4]); err != nil {
+		return
+	}
+	if b[0] != socks.Version5 {
+		err = fmt.Errorf("unexpected socks version: %d", b[0])
+		return
+	}
+	if socks.Command(b[1]) != socks.CmdConnect {
+		_ = writeSocksReply(conn, socksCommandNotSupported)
+		err = fmt.Errorf("unsupported %s", socks.Command(b[1]))
+		return
+	}
+	var host string
+	switch b[3] {
+	case socks.AddrTypeIPv4, socks.AddrTypeIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if b[3] == socks.AddrTypeIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socks.AddrTypeFQDN:
+		if _, err = io.ReadFull(r, b[:1]); err != nil {
+			return
+		}
+		if host, err = readSocksString(r, b, int(b[0])); err != nil {
+			return
+		}
+	default:
+		_ = writeSocksReply(conn, socksAddrTypeNotSupported)
+		err = fmt.Errorf("unknown socks address type: %d", b[3])
+		return
+	}
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	port := int(b[0])<<8 | int(b[1])
+	destination = net.JoinHostPort(host, strconv.Itoa(port))
+	reply = func(err error) error {
+		if err != nil {
+			return writeSocksReply(conn, socksGeneralFailure)
+		}
+		return writeSocksReply(conn, socks.StatusSucceeded)
+	}
+	return
+}
+
+func readSocksString(r io.Reader, b []byte, n int) (string, error) {
+	if _, err := io.ReadFull(r, b[:n]); err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+// writeSocksReply writes a reply with an unspecified bound address
+func writeSocksReply(conn net.Conn, code socks.Reply) error {
+	_, err := conn.Write([]byte{socks.Version5, byte(code), 0, socks.AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (in *Inbound) handshakeHttp(conn *peek.BufferedConn) (destination string, reply func(err error) error, err error) {
+	request, err := http.ReadRequest(conn.Reader())
+	if err != nil {
+		return
+	}
+	if request.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		err = fmt.Errorf("unsupported http method: %s", request.Method)
+		return
+	}
+	if len(in.username) > 0 || len(in.password) > 0 {
+		username, password, ok := parseProxyAuthorization(request.Header.Get("Proxy-Authorization"))
+		if !ok || !in.checkAuth(username, password) {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"wstunnel\"\r\nConnection: close\r\n\r\n")
+			err = ErrInboundAuth
+			return
+		}
+	}
+	if _, _, err = net.SplitHostPort(request.Host); err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return
+	}
+	destination = request.Host
+	reply = func(err error) error {
+		if err != nil {
+			_, err = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+			return err
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	return
+}
+
+func parseProxyAuthorization(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return
+	}
+	return strings.Cut(string(c), ":")
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+	"github.com/wwqgtxx/wstunnel/proxy/internal/socks"
+)
+
+func socksClient(destination, username, password string) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		d := socks.NewDialer("tcp", "inbound")
+		if len(username) > 0 {
+			d.AuthMethods = []socks.AuthMethod{socks.AuthMethodUsernamePassword}
+			d.Authenticate = (&socks.UsernamePassword{Username: username, Password: password}).Authenticate
+		}
+		_, err := d.DialWithConn(context.Background(), conn, "tcp", destination)
+		return err
+	}
+}
+
+func httpClient(request string, expect int) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		if _, err := io.WriteString(conn, request); err != nil {
+			return err
+		}
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != expect {
+			return fmt.Errorf("status = %d, want %d", response.StatusCode, expect)
+		}
+		return nil
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	connect := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	// user:pass
+	connectAuth := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: basic dXNlcjpwYXNz\r\n\r\n"
+	errDial := errors.New("dial failed")
+	tests := []struct {
+		name          string
+		mode          string
+		username      string
+		client        func(conn net.Conn) error
+		replyErr      error
+		expect        string
+		wantErr       error // of Handshake, or errAny
+		wantClientErr bool
+	}{
+		{name: "socks5 fqdn", mode: InboundSocks5, client: socksClient("example.com:443", "", ""), expect: "example.com:443"},
+		{name: "socks5 ipv4", mode: InboundSocks5, client: socksClient("1.2.3.4:80", "", ""), expect: "1.2.3.4:80"},
+		{name: "socks5 ipv6", mode: InboundSocks5, client: socksClient("[2001:db8::1]:443", "", ""), expect: "[2001:db8::1]:443"},
+		{name: "socks5 auth", mode: InboundSocks5, username: "user", client: socksClient("example.com:443", "user", "pass"), expect: "example.com:443"},
+		{name: "socks5 wrong password", mode: InboundSocks5, username: "user", client: socksClient("example.com:443", "user", "wrong"), wantErr: ErrInboundAuth, wantClientErr: true},
+		{name: "socks5 auth not offered", mode: InboundSocks5, username: "user", client: socksClient("example.com:443", "", ""), wantErr: errAny, wantClientErr: true},
+		{name: "socks5 dial failed", mode: InboundSocks5, client: socksClient("example.com:443", "", ""), replyErr: errDial, expect: "example.com:443", wantClientErr: true},
+		{name: "socks5 http request", mode: InboundSocks5, client: httpClient(connect, http.StatusOK), wantErr: errAny, wantClientErr: true},
+		{name: "http connect", mode: InboundHttp, client: httpClient(connect, http.StatusOK), expect: "example.com:443"},
+		{name: "http auth", mode: InboundHttp, username: "user", client: httpClient(connectAuth, http.StatusOK), expect: "example.com:443"},
+		{name: "http auth missing", mode: InboundHttp, username: "user", client: httpClient(connect, http.StatusProxyAuthRequired), wantErr: ErrInboundAuth},
+		{name: "http get", mode: InboundHttp, client: httpClient("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusMethodNotAllowed), wantErr: errAny},
+		{name: "http dial failed", mode: InboundHttp, client: httpClient(connect, http.StatusBadGateway), replyErr: errDial, expect: "example.com:443"},
+		{name: "mixed socks5", mode: InboundMixed, client: socksClient("example.com:443", "", ""), expect: "example.com:443"},
+		{name: "mixed http", mode: InboundMixed, client: httpClient(connect, http.StatusOK), expect: "example.com:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password := ""
+			if len(tt.username) > 0 {
+				password = "pass"
+			}
+			in, err := NewInbound(tt.mode, tt.username, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			type result struct {
+				destination string
+				err         error
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer server.Close()
+				destination, reply, err := in.Handshake(peek.NewBufferedConn(server))
+				if err == nil {
+					_ = reply(tt.replyErr) // may fail as the client stops reading a failure
+				}
+				done <- result{destination, err}
+			}()
+			clientErr := tt.client(client)
+			_ = client.Close()
+			r := <-done
+			switch {
+			case tt.wantErr == errAny:
+				if r.err == nil {
+					t.Fatal("handshake succeeded")
+				}
+			case !errors.Is(r.err, tt.wantErr):
+				t.Fatalf("handshake = %v, want %v", r.err, tt.wantErr)
+			}
+			if r.destination != tt.expect {
+				t.Fatalf("destination = %s, want %s", r.destination, tt.expect)
+			}
+			if (clientErr != nil) != tt.wantClientErr {
+				t.Fatalf("client error = %v, want error %v", clientErr, tt.wantClientErr)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestNewInbound(t *testing.T) {
+	if _, err := NewInbound("socks4", "", ""); err == nil {
+		t.Fatal("created an unknown inbound")
+	}
+}
@@ -0,0 +1,186 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/peek"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2CmdLocal   = 0x20
+	v2CmdProxy   = 0x21
+	v2FamTCP4    = 0x11
+	v2FamTCP6    = 0x21
+	v2FamUnspec  = 0x00
+	v2HeaderSize = 16
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrNoHeader = errors.New("proxy protocol header not found")
+
+// ReadHeader reads a PROXY protocol v1 or v2 header from r without reading any byte after it,
+// src and dst are invalid for the LOCAL command or UNKNOWN protocol
+func ReadHeader(r io.Reader) (src, dst netip.AddrPort, err error) {
+	buf := make([]byte, v2HeaderSize, v1MaxLength)
+	if _, err = io.ReadFull(r, buf[:len(v1Prefix)]); err != nil {
+		return
+	}
+	if string(buf[:len(v1Prefix)]) == v1Prefix {
+		return readV1(r, buf[:len(v1Prefix)])
+	}
+	if !bytes.HasPrefix(v2Signature, buf[:len(v1Prefix)]) {
+		err = ErrNoHeader
+		return
+	}
+	if _, err = io.ReadFull(r, buf[len(v1Prefix):v2HeaderSize]); err != nil {
+		return
+	}
+	return readV2(r, buf)
+}
+
+func readV1(r io.Reader, buf []byte) (src, dst netip.AddrPort, err error) {
+	var b [1]byte
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= v1MaxLength {
+			err = errors.New("proxy protocol v1 header too long")
+			return
+		}
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		buf = append(buf, b[0])
+	}
+	fields := strings.Fields(string(buf[:len(buf)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = fmt.Errorf("invalid proxy protocol v1 header: %q", buf)
+		return
+	}
+	if src, err = parseAddrPort(fields[2], fields[4]); err != nil {
+		return
+	}
+	dst, err = parseAddrPort(fields[3], fields[5])
+	return
+}
+
+func parseAddrPort(addr, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+func readV2(r io.Reader, header []byte) (src, dst netip.AddrPort, err error) {
+	if !bytes.Equal(header[:len(v2Signature)], v2Signature) {
+		err = ErrNoHeader
+		return
+	}
+	cmd, fam := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	switch cmd {
+	case v2CmdLocal:
+		return
+	case v2CmdProxy:
+	default:
+		err = fmt.Errorf("invalid proxy protocol v2 command: %#x", cmd)
+		return
+	}
+	switch fam {
+	case v2FamTCP4:
+		if len(body) < 12 {
+			err = errors.New("proxy protocol v2 header too short")
+			return
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:12]))
+	case v2FamTCP6:
+		if len(body) < 36 {
+			err = errors.New("proxy protocol v2 header too short")
+			return
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:34]))
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:36]))
+	}
+	// other families (eg: unix socket) are treated as UNKNOWN
+	return
+}
+
+// AppendHeader appends a PROXY protocol header of version (1 or 2) to b,
+// an UNKNOWN (v1) or LOCAL (v2) header is appended if src or dst is invalid
+func AppendHeader(b []byte, version int, src, dst netip.AddrPort) []byte {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	known := src.IsValid() && dst.IsValid()
+	if known && src.Addr().Is4() != dst.Addr().Is4() { // mixed families, send both as ipv6
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	if version == 2 {
+		b = append(b, v2Signature...)
+		switch {
+		case !known:
+			return append(b, v2CmdLocal, v2FamUnspec, 0, 0)
+		case src.Addr().Is4():
+			b = append(b, v2CmdProxy, v2FamTCP4, 0, 12)
+		default:
+			b = append(b, v2CmdProxy, v2FamTCP6, 0, 36)
+		}
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		return binary.BigEndian.AppendUint16(b, dst.Port())
+	}
+	if !known {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	proto := "TCP4"
+	if !src.Addr().Is4() {
+		proto = "TCP6"
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+// Conn is a peek.Conn with the addresses from the PROXY protocol header
+type Conn struct {
+	peek.Conn
+	src, dst net.Addr
+}
+
+func NewConn(conn peek.Conn, src, dst netip.AddrPort) peek.Conn {
+	c := &Conn{Conn: conn, src: conn.RemoteAddr(), dst: conn.LocalAddr()}
+	if src.IsValid() && dst.IsValid() {
+		c.src = net.TCPAddrFromAddrPort(src)
+		c.dst = net.TCPAddrFromAddrPort(dst)
+	}
+	return c
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.dst
+}
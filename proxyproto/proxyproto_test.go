@@ -0,0 +1,118 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	v4Src := netip.MustParseAddrPort("1.2.3.4:5678")
+	v4Dst := netip.MustParseAddrPort("10.0.0.1:443")
+	v6Src := netip.MustParseAddrPort("[2001:db8::1]:5678")
+	v6Dst := netip.MustParseAddrPort("[2001:db8::2]:443")
+	mapped := netip.MustParseAddrPort("[::ffff:1.2.3.4]:5678")
+	tests := []struct {
+		name     string
+		src, dst netip.AddrPort
+		wantSrc  netip.AddrPort
+		wantDst  netip.AddrPort
+	}{
+		{"ipv4", v4Src, v4Dst, v4Src, v4Dst},
+		{"ipv6", v6Src, v6Dst, v6Src, v6Dst},
+		{"ipv4 mapped", mapped, v4Dst, v4Src, v4Dst},
+		{"mixed families", v4Src, v6Dst, mapped, v6Dst},
+		{"unknown", netip.AddrPort{}, v4Dst, netip.AddrPort{}, netip.AddrPort{}},
+	}
+	for _, version := range []int{1, 2} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s v%d", tt.name, version), func(t *testing.T) {
+				b := AppendHeader(nil, version, tt.src, tt.dst)
+				r := bytes.NewReader(append(b, "payload"...))
+				src, dst, err := ReadHeader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if src != tt.wantSrc || dst != tt.wantDst {
+					t.Fatalf("addresses = %s %s, want %s %s", src, dst, tt.wantSrc, tt.wantDst)
+				}
+				rest, _ := io.ReadAll(r)
+				if string(rest) != "payload" {
+					t.Fatalf("read after header = %q", rest)
+				}
+			})
+		}
+	}
+}
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	return v2HeaderWithLength(cmd, fam, len(body), body)
+}
+
+func v2HeaderWithLength(cmd, fam byte, length int, body []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, cmd, fam, byte(length>>8), byte(length))
+	return append(b, body...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4Body := []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x16, 0x2e, 0x01, 0xbb}
+	tests := []struct {
+		name    string
+		header  []byte
+		wantSrc string
+		wantErr bool
+		noProxy bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 443\r\n"), wantSrc: "1.2.3.4:5678"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5678 443\r\n"), wantSrc: "[2001:db8::1]:5678"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 1.2.3.4 10.0.0.1"), wantErr: true},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n"), wantErr: true},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678\r\n"), wantErr: true},
+		{name: "v1 invalid protocol", header: []byte("PROXY UDP4 1.2.3.4 10.0.0.1 5678 443\r\n"), wantErr: true},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 1.2.3 10.0.0.1 5678 443\r\n"), wantErr: true},
+		{name: "v1 port out of range", header: []byte("PROXY TCP4 1.2.3.4 10.0.0.1 65536 443\r\n"), wantErr: true},
+		{name: "v2 tcp4", header: v2Header(v2CmdProxy, v2FamTCP4, v4Body), wantSrc: "1.2.3.4:5678"},
+		{name: "v2 tcp4 with tlvs", header: v2Header(v2CmdProxy, v2FamTCP4, append(v4Body, 0x04, 0, 1, 0)), wantSrc: "1.2.3.4:5678"},
+		{name: "v2 local", header: v2Header(v2CmdLocal, v2FamUnspec, nil)},
+		{name: "v2 unix", header: v2Header(v2CmdProxy, 0x31, make([]byte, 216))},
+		{name: "v2 truncated signature", header: v2Signature[:8], wantErr: true},
+		{name: "v2 truncated body", header: v2Header(v2CmdProxy, v2FamTCP4, v4Body)[:v2HeaderSize+4], wantErr: true},
+		{name: "v2 tcp4 short body", header: v2Header(v2CmdProxy, v2FamTCP4, v4Body[:4]), wantErr: true},
+		{name: "v2 tcp6 short body", header: v2Header(v2CmdProxy, v2FamTCP6, v4Body), wantErr: true},
+		{name: "v2 invalid command", header: v2Header(0x22, v2FamTCP4, v4Body), wantErr: true},
+		{name: "v2 oversized body", header: v2HeaderWithLength(v2CmdProxy, v2FamTCP4, 0xffff, v4Body), wantErr: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true, noProxy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, _, err := ReadHeader(bytes.NewReader(tt.header))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got src %s", src)
+				}
+				if errors.Is(err, ErrNoHeader) != tt.noProxy {
+					t.Fatalf("error = %v, no header = %v", err, tt.noProxy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.wantSrc) == 0 {
+				if src.IsValid() {
+					t.Fatalf("src = %s, want invalid", src)
+				}
+				return
+			}
+			if src.String() != tt.wantSrc {
+				t.Fatalf("src = %s, want %s", src, tt.wantSrc)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+// newDecoy returns the handler for the requests which are not a valid WebSocket upgrade,
+// it is a reverse proxy if url is set, or a static directory if dir is set, or a canned response,
+// and closeTcpHandle if decoyConfig is nil
+func newDecoy(decoyConfig *config.DecoyConfig) (http.Handler, error) {
+	switch {
+	case decoyConfig == nil:
+		return http.HandlerFunc(closeTcpHandle), nil
+	case len(decoyConfig.URL) > 0:
+		u, err := url.Parse(decoyConfig.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.New("decoy url must be http or https: " + decoyConfig.URL)
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(u)
+				r.SetXForwarded()
+			},
+		}, nil
+	case len(decoyConfig.Dir) > 0:
+		return http.FileServer(http.Dir(decoyConfig.Dir)), nil
+	default:
+		status := decoyConfig.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for key, value := range decoyConfig.Headers {
+				w.Header().Set(key, value)
+			}
+			if len(w.Header().Get("Content-Type")) == 0 && strings.HasPrefix(strings.TrimSpace(decoyConfig.Body), "<") {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(decoyConfig.Body))
+		}), nil
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+// realRemoteAddr returns the client address from X-Forwarded-For or X-Real-IP if the peer is a trusted proxy,
+// the port of a forwarded address is unknown and set to 0
+func realRemoteAddr(r *http.Request, trusted utils.Prefixes) string {
+	if len(trusted) == 0 || !trusted.Contains(utils.ParseAddr(r.RemoteAddr)) {
+		return r.RemoteAddr
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		// every proxy appends its peer, so the rightmost untrusted hop is the client
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr := utils.ParseAddr(strings.TrimSpace(hops[i]))
+			if !addr.IsValid() {
+				break
+			}
+			if i == 0 || !trusted.Contains(addr) {
+				return netip.AddrPortFrom(addr, 0).String()
+			}
+		}
+	}
+	if addr := utils.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); addr.IsValid() {
+		return netip.AddrPortFrom(addr, 0).String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/atomic"
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/listener"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/tunnel"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+type reverseHandler struct {
+	listenAddress  string
+	refs           int             // protected by reverseHandlersMu
+	listenerConfig listener.Config // protected by reverseHandlersMu
+	ln             listener.Listener
+	timeouts       atomic.TypedValue[config.TimeoutConfig]
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	next     int
+}
+
+var (
+	reverseHandlersMu sync.Mutex
+	reverseHandlers   = make(map[string]*reverseHandler)
+)
+
+// getReverseHandler returns the same handler for the same address with the listener updated,
+// so the reverse clients connected before a config reload are still usable
+func getReverseHandler(target config.ServerTargetConfig) *reverseHandler {
+	listenerConfig := listener.Config{
+		ListenerConfig: config.ListenerConfig{
+			BindAddress:         target.ReverseListen,
+			AcceptProxyProtocol: target.ReverseListener.AcceptProxyProtocol,
+			AccessConfig:        target.ReverseListener.AccessConfig,
+			TimeoutConfig:       target.TimeoutConfig,
+		},
+	}
+	reverseHandlersMu.Lock()
+	defer reverseHandlersMu.Unlock()
+	rh, ok := reverseHandlers[target.ReverseListen]
+	if !ok {
+		rh = &reverseHandler{listenAddress: target.ReverseListen}
+		reverseHandlers[target.ReverseListen] = rh
+	}
+	rh.listenerConfig = listenerConfig
+	rh.timeouts.Store(target.TimeoutConfig)
+	if rh.ln != nil {
+		if err := rh.ln.Update(listenerConfig); err != nil {
+			slog.Error("Update reverse listener failed", "address", rh.listenAddress, "err", err)
+		}
+	}
+	return rh
+}
+
+func (h *reverseHandler) retain() {
+	reverseHandlersMu.Lock()
+	defer reverseHandlersMu.Unlock()
+	h.refs++
+	if h.refs == 1 {
+		reverseHandlers[h.listenAddress] = h
+		h.start()
+	}
+}
+
+func (h *reverseHandler) release() {
+	reverseHandlersMu.Lock()
+	defer reverseHandlersMu.Unlock()
+	h.refs--
+	if h.refs == 0 {
+		if reverseHandlers[h.listenAddress] == h {
+			delete(reverseHandlers, h.listenAddress)
+		}
+		h.close()
+	}
+}
+
+func (h *reverseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !utils.IsWebSocketUpgrade(r) || !mux.IsMuxRequest(r) {
+		closeTcpHandle(w, r)
+		return
+	}
+	slog.Info("Reverse Client", "remote", r.RemoteAddr, "listen", h.listenAddress)
+	slog.Debug("Reverse Client header", "header", r.Header)
+
+	w.Header().Set(mux.HeaderKey, mux.HeaderValue)
+	wsConn, err := utils.ServerWebsocketUpgrade(w, r)
+	if err != nil {
+		slog.Warn("Websocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	session := mux.Server(wsConn)
+	defer session.Close()
+	defer tunnel.TrackSession(session)()
+
+	h.mu.Lock()
+	h.sessions = append(h.sessions, session)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.sessions = slices.DeleteFunc(h.sessions, func(s *mux.Session) bool { return s == session })
+		h.mu.Unlock()
+		slog.Info("Reverse Client Disconnected", "remote", r.RemoteAddr, "listen", h.listenAddress)
+	}()
+
+	// reverse client never open stream, just wait the session close
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		_ = stream.Close()
+	}
+}
+
+func (h *reverseHandler) start() {
+	slog.Info("New Reverse Listening", "address", h.listenAddress)
+	ln, err := listener.ListenTcp(h.listenerConfig)
+	if err != nil {
+		slog.Error("Listen failed", "address", h.listenAddress, "err", err)
+		return
+	}
+	h.ln = ln
+	go func() {
+		for {
+			tcp, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Warn("Accept failed", "address", h.listenAddress, "err", err)
+				<-time.After(3 * time.Second)
+				continue
+			}
+			go h.handle(tcp)
+		}
+	}()
+}
+
+func (h *reverseHandler) close() {
+	slog.Info("Close Reverse Listening", "address", h.listenAddress)
+	if h.ln != nil {
+		_ = h.ln.Close()
+		h.ln = nil
+	}
+	h.mu.Lock()
+	sessions := h.sessions
+	h.sessions = nil
+	h.mu.Unlock()
+	for _, session := range sessions {
+		session.Drain() // let the reverse streams finish
+	}
+}
+
+func (h *reverseHandler) pickSession() *mux.Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for range h.sessions {
+		h.next = (h.next + 1) % len(h.sessions)
+		if session := h.sessions[h.next]; session.CanOpenStream() {
+			return session
+		}
+	}
+	return nil
+}
+
+func (h *reverseHandler) handle(tcp net.Conn) {
+	defer tcp.Close()
+	ctx := tunnel.NewContext(context.Background(), "tcp", h.listenAddress, tcp.RemoteAddr().String())
+	tunnel.SetLocal(ctx, tcp.LocalAddr().String())
+	tunnel.SetTimeouts(ctx, h.timeouts.Load())
+	session := h.pickSession()
+	if session == nil {
+		slog.WarnContext(ctx, "No reverse client, drop", "listen", h.listenAddress, "remote", tcp.RemoteAddr().String())
+		return
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		slog.WarnContext(ctx, "Open reverse stream failed", "err", err)
+		return
+	}
+	defer stream.Close()
+	slog.InfoContext(ctx, "Incoming Reverse", "remote", tcp.RemoteAddr().String(), "client", session.RemoteAddr().String())
+	tunnel.SetTarget(ctx, session.RemoteAddr().String(), "")
+	tunnel.Tunnel(ctx, tcp, stream)
+}
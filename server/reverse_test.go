@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+// dialReverse connects a reverse client session, which writes id then echoes on each stream
+func dialReverse(t *testing.T, wsUrl string, id string) *mux.Session {
+	t.Helper()
+	u, err := url.Parse(wsUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set(mux.HeaderKey, mux.HeaderValue)
+	conn, respHeader, err := utils.ClientWebsocketDial(context.Background(), *u, header, &net.Dialer{}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mux.IsMuxResponse(respHeader) {
+		t.Fatal("not a mux response")
+	}
+	session := mux.Client(conn)
+	t.Cleanup(func() { _ = session.Close() })
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				if _, err := io.WriteString(stream, id); err != nil {
+					return
+				}
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+	return session
+}
+
+func (h *reverseHandler) numSessions() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+// dialReverseListen returns the id of the reverse client which got the connection, after an echo round trip
+func dialReverseListen(t *testing.T, address string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	id := make([]byte, 1)
+	if _, err = io.ReadFull(conn, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("read = %q, want %q", buf, "ping")
+	}
+	return string(id)
+}
+
+func TestReverseHandler(t *testing.T) {
+	target := config.ServerTargetConfig{ReverseListen: "127.0.0.1:0"}
+	rh := getReverseHandler(target)
+	rh.retain()
+	if rh.ln == nil {
+		t.Fatal("not listening")
+	}
+	address := rh.ln.Addr().String()
+	if reloaded := getReverseHandler(target); reloaded != rh {
+		t.Fatal("another handler for the same reverse-listen")
+	}
+
+	// dropped without reverse clients
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want %v", err, io.EOF)
+	}
+	_ = conn.Close()
+
+	s := httptest.NewServer(rh)
+	defer s.Close()
+	wsUrl := "ws" + s.URL[len("http"):] + "/reverse"
+	if _, err = http.Get(s.URL); err == nil {
+		t.Fatal("responded a request without upgrade")
+	}
+
+	// the connections are spread over the reverse clients
+	sessions := []*mux.Session{dialReverse(t, wsUrl, "a"), dialReverse(t, wsUrl, "b")}
+	waitFor(t, func() bool { return rh.numSessions() == 2 })
+	ids := map[string]int{}
+	for i := 0; i < 4; i++ {
+		ids[dialReverseListen(t, address)]++
+	}
+	if ids["a"] != 2 || ids["b"] != 2 {
+		t.Fatalf("connections of reverse clients = %v, want 2 each", ids)
+	}
+
+	// a disconnected reverse client is not picked
+	_ = sessions[0].Close()
+	waitFor(t, func() bool { return rh.numSessions() == 1 })
+	for i := 0; i < 2; i++ {
+		if id := dialReverseListen(t, address); id != "b" {
+			t.Fatalf("connection of reverse client %s, want b", id)
+		}
+	}
+
+	// released by the last target, the listener is closed and the sessions are drained
+	rh.release()
+	if _, err = net.Dial("tcp", address); err == nil {
+		t.Fatal("still listening after released")
+	}
+	waitFor(t, sessions[1].IsClosed)
+}
@@ -1,57 +1,193 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync"
 
+	"github.com/wwqgtxx/wstunnel/access"
+	"github.com/wwqgtxx/wstunnel/atomic"
+	"github.com/wwqgtxx/wstunnel/auth"
 	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/dynamic"
 	"github.com/wwqgtxx/wstunnel/fallback"
+	"github.com/wwqgtxx/wstunnel/h2"
 	"github.com/wwqgtxx/wstunnel/listener"
+	"github.com/wwqgtxx/wstunnel/mux"
+	"github.com/wwqgtxx/wstunnel/peek"
 	"github.com/wwqgtxx/wstunnel/peek/peekws"
+	"github.com/wwqgtxx/wstunnel/tunnel"
+	"github.com/wwqgtxx/wstunnel/udp"
 	"github.com/wwqgtxx/wstunnel/utils"
 )
 
+var warnExtendedConnectOnce sync.Once
+
 type server struct {
-	serverHandler  ServerHandler
-	listenerConfig listener.Config
+	serverHandler   atomic.TypedValue[ServerHandler]
+	trustedProxies  atomic.TypedValue[utils.Prefixes]
+	timeouts        atomic.TypedValue[config.TimeoutConfig]
+	address         atomic.TypedValue[string]      // listenerConfig.BindAddress, for ServeHTTP
+	limiter         atomic.Pointer[access.Limiter] // for the clients forwarded by trusted proxies
+	listenerConfig  atomic.TypedValue[listener.Config]
+	reverseHandlers []*reverseHandler
+	ln              atomic.TypedValue[listener.Listener]
+	httpServer      atomic.Pointer[http.Server] // serving ln
 }
 
 func (s *server) Start() {
-	log.Println("New Server Listening on:", s.Addr())
+	slog.Info("New Server Listening", "address", s.Addr())
+	for _, rh := range s.reverseHandlers {
+		rh.retain()
+	}
+	s.listen()
+}
+
+func (s *server) listen() {
+	ln, err := listener.ListenTcp(s.listenerConfig.Load())
+	if err != nil {
+		slog.Error("Listen failed", "address", s.Addr(), "err", err)
+		return
+	}
+	httpServer := &http.Server{Addr: s.Addr(), Handler: s}
+	s.httpServer.Store(httpServer)
+	s.ln.Store(ln)
+	if err = h2.ConfigureServer(httpServer); err != nil {
+		if errors.Is(err, h2.ErrExtendedConnectDisabled) { // see README for GODEBUG=http2xconnect=1
+			warnExtendedConnectOnce.Do(func() {
+				slog.Warn("Websocket over http2 is disabled", "err", err)
+			})
+		} else {
+			slog.Error("Configure http2 failed", "address", s.Addr(), "err", err)
+		}
+	}
 	go func() {
-		server := &http.Server{Addr: s.Addr(), Handler: s.serverHandler}
-		ln, err := listener.ListenTcp(s.listenerConfig)
-		if err != nil {
-			log.Println(err)
+		err := httpServer.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			slog.Error("Serve failed", "address", s.Addr(), "err", err)
 			return
 		}
-		err = server.Serve(ln)
+	}()
+}
+
+func (s *server) Close() error {
+	slog.Info("Close Server Listening", "address", s.Addr())
+	for _, rh := range s.reverseHandlers {
+		rh.release()
+	}
+	s.reverseHandlers = nil
+	return s.closeListener()
+}
+
+func (s *server) closeListener() error {
+	ln := s.ln.Swap(nil)
+	if ln == nil {
+		return nil
+	}
+	err := ln.Close()
+	// hijacked websocket connections are not tracked by http.Server, so they will keep running,
+	// and the http2 connections are sent GOAWAY and closed after their streams finished,
+	// so that the extended CONNECT tunnels are drained as well
+	httpServer := s.httpServer.Load()
+	go func() {
+		_ = httpServer.Shutdown(context.Background())
+	}()
+	return err
+}
+
+func (s *server) Update(newServer common.Server) {
+	ns := newServer.(*server)
+	slog.Info("Update Server Listening", "address", s.Addr())
+	for _, rh := range ns.reverseHandlers {
+		rh.retain()
+	}
+	for _, rh := range s.reverseHandlers {
+		rh.release()
+	}
+	s.reverseHandlers = ns.reverseHandlers
+	s.serverHandler.Store(ns.serverHandler.Load())
+	s.trustedProxies.Store(ns.trustedProxies.Load())
+	s.timeouts.Store(ns.timeouts.Load())
+	if ns.Addr() != s.Addr() {
+		// same port but another bind address, the old socket can't be reused
+		slog.Info("Listen again", "address", s.Addr(), "new", ns.Addr())
+		_ = s.closeListener()
+		s.limiter.Store(ns.limiter.Load())
+		s.address.Store(ns.Addr())
+	} else if err := s.limiter.Load().Update(ns.listenerConfig.Load().AccessConfig); err != nil {
+		slog.Error("Update access failed", "address", s.Addr(), "err", err)
+	}
+	s.listenerConfig.Store(ns.listenerConfig.Load())
+	ln := s.ln.Load()
+	if ln == nil { // last listen failed or address changed
+		s.listen()
+		return
+	}
+	if err := ln.Update(s.listenerConfig.Load()); err != nil {
+		slog.Error("Update listener failed", "address", s.Addr(), "err", err)
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peer := r.RemoteAddr
+	r.RemoteAddr = realRemoteAddr(r, s.trustedProxies.Load())
+	if r.RemoteAddr != peer { // the peer was not checked by listener
+		release, err := s.limiter.Load().Acquire(r.RemoteAddr)
 		if err != nil {
-			log.Println(err)
+			level := slog.LevelWarn
+			if errors.Is(err, access.ErrBanned) { // logged when banned
+				level = slog.LevelDebug
+			}
+			slog.Log(r.Context(), level, "Access rejected", "address", s.Addr(), "remote", r.RemoteAddr, "by", peer, "err", err)
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-	}()
+		defer release()
+	}
+	ctx := tunnel.NewContext(r.Context(), "tcp", s.Addr(), r.RemoteAddr)
+	ctx = access.WithLimiter(ctx, s.limiter.Load())
+	tunnel.SetTimeouts(ctx, s.timeouts.Load())
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		tunnel.SetLocal(ctx, localAddr.String())
+	}
+	r = r.WithContext(ctx)
+	s.serverHandler.Load().ServeHTTP(w, r)
 }
 
 func (s *server) Addr() string {
-	return s.listenerConfig.BindAddress
+	return s.address.Load()
 }
 
 func (s *server) CloneWithNewAddress(bindAddress string) common.Server {
-	ns := *s
-	ns.listenerConfig.BindAddress = bindAddress
-	return &ns
+	ns := &server{reverseHandlers: s.reverseHandlers}
+	listenerConfig := s.listenerConfig.Load()
+	listenerConfig.BindAddress = bindAddress
+	ns.listenerConfig.Store(listenerConfig)
+	ns.limiter.Store(access.NewLimiter(bindAddress))
+	_ = ns.limiter.Load().Update(listenerConfig.AccessConfig) // checked by s
+	ns.serverHandler.Store(s.serverHandler.Load())
+	ns.trustedProxies.Store(s.trustedProxies.Load())
+	ns.timeouts.Store(s.timeouts.Load())
+	ns.address.Store(bindAddress)
+	return ns
 }
 
 func (s *server) GetListenerConfig() any {
-	return s.listenerConfig
+	return s.listenerConfig.Load()
 }
 
 func (s *server) SetListenerConfig(cfg any) {
-	s.listenerConfig = cfg.(listener.Config)
-	s.listenerConfig.IsWebSocketListener = true
+	listenerConfig := cfg.(listener.Config)
+	listenerConfig.IsWebSocketListener = true
+	listenerConfig.TrustedProxies = s.trustedProxies.Load()
+	s.listenerConfig.Store(listenerConfig)
+	s.timeouts.Store(listenerConfig.TimeoutConfig)
+	s.address.Store(listenerConfig.BindAddress)
+	_ = s.limiter.Load().Update(listenerConfig.AccessConfig) // checked by listener.ListenTcp
 }
 
 type ServerHandler http.Handler
@@ -61,6 +197,8 @@ type serverHandler struct {
 	DestAddress string
 	Fallback    *fallback.Fallback
 	IsInternal  bool
+	Limiter     *tunnel.Limiter
+	Timeouts    config.TimeoutConfig
 }
 
 func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -69,14 +207,23 @@ func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := r.Context()
+	tunnel.SetTimeouts(ctx, s.Timeouts)
+	if err := tunnel.Limit(ctx, s.Limiter); err != nil {
+		slog.WarnContext(ctx, "Refused", "remote", r.RemoteAddr, "target", s.Target(), "err", err)
+		closeTcpHandle(w, r)
+		return
+	}
 	if s.IsInternal {
-		log.Println("Incoming --> ", r.RemoteAddr, r.Header, " --> ( [Client]", s.DestAddress, s.Proxy(), ") --> ", s.Target())
+		slog.InfoContext(ctx, "Incoming", "remote", r.RemoteAddr, "client", s.DestAddress, "proxy", s.Proxy(), "target", s.Target())
 	} else {
-		if len(s.Proxy()) > 0 {
-			log.Println("Incoming --> ", r.RemoteAddr, r.Header, " --> ( ", s.Proxy(), ") --> ", s.Target())
-		} else {
-			log.Println("Incoming --> ", r.RemoteAddr, r.Header, s.Target())
-		}
+		slog.InfoContext(ctx, "Incoming", "remote", r.RemoteAddr, "proxy", s.Proxy(), "target", s.Target())
+	}
+	slog.DebugContext(ctx, "Incoming header", "header", r.Header)
+
+	if mux.IsMuxRequest(r) {
+		s.serveMux(w, r)
+		return
 	}
 
 	edBuf := utils.DecodeXray0rtt(r.Header)
@@ -84,22 +231,22 @@ func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if s.Fallback != nil {
 		wsConn, err := utils.ServerWebsocketUpgrade(w, r)
 		if err != nil {
-			log.Println(err)
+			slog.WarnContext(ctx, "Websocket upgrade failed", "err", err)
 			return
 		}
 		defer wsConn.Close()
 		conn := peekws.New(wsConn, edBuf)
-		if s.Fallback.Handle(conn, edBuf, r.Header) {
+		if s.Fallback.Handle(ctx, conn, edBuf, r.Header) {
 			return
 		}
 		// send inHeader to client for Xray's 0rtt ws
-		target, err := s.Dial(edBuf, r.Header)
+		target, err := s.Dial(ctx, edBuf, r.Header)
 		if err != nil {
-			log.Println(err)
+			slog.WarnContext(ctx, "Dial failed", "target", s.Target(), "err", err)
 			return
 		}
 		defer target.Close()
-		target.TunnelTcp(conn)
+		target.TunnelTcp(ctx, conn)
 		return
 	}
 
@@ -113,9 +260,9 @@ func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer close(ch)
 		// send inHeader to client for Xray's 0rtt ws
-		target, err := s.Dial(edBuf, r.Header)
+		target, err := s.Dial(ctx, edBuf, r.Header)
 		if err != nil {
-			log.Println(err)
+			slog.WarnContext(ctx, "Dial failed", "target", s.Target(), "err", err)
 			return
 		}
 		ch <- target
@@ -123,7 +270,7 @@ func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	wsConn, err := utils.ServerWebsocketUpgrade(w, r)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(r.Context(), "Websocket upgrade failed", "err", err)
 		return
 	}
 	defer wsConn.Close()
@@ -133,7 +280,71 @@ func (s *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer target.Close()
-	target.TunnelWs(wsConn)
+	target.TunnelWs(ctx, wsConn)
+}
+
+func (s *serverHandler) serveMux(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(mux.HeaderKey, mux.HeaderValue)
+	wsConn, err := utils.ServerWebsocketUpgrade(w, r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Websocket upgrade failed", "err", err)
+		return
+	}
+	session := mux.Server(wsConn)
+	defer session.Close()
+	defer tunnel.TrackSession(session)()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go s.handleStream(tunnel.ForkContext(r.Context()), stream)
+	}
+}
+
+func (s *serverHandler) handleStream(ctx context.Context, stream *mux.Stream) {
+	defer stream.Close()
+	if s.Fallback != nil {
+		conn := peek.NewBufferedConn(stream)
+		if s.Fallback.Handle(ctx, conn, nil, nil) {
+			return
+		}
+		target, err := s.Dial(ctx, nil, nil)
+		if err != nil {
+			slog.WarnContext(ctx, "Dial failed", "target", s.Target(), "err", err)
+			return
+		}
+		defer target.Close()
+		target.TunnelTcp(ctx, conn)
+		return
+	}
+	target, err := s.Dial(ctx, nil, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Dial failed", "target", s.Target(), "err", err)
+		return
+	}
+	defer target.Close()
+	target.TunnelTcp(ctx, stream)
+}
+
+// protect serves the decoy for the non-WebSocket requests and the WebSocket upgrades without a valid token,
+// so they are indistinguishable
+func protect(next http.Handler, a *auth.Auth, decoy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utils.IsWebSocketUpgrade(r) {
+			decoy.ServeHTTP(w, r)
+			return
+		}
+		if a != nil {
+			if err := a.VerifyRequest(r); err != nil {
+				slog.WarnContext(r.Context(), "Auth failed", "remote", r.RemoteAddr, "path", r.URL.Path, "err", err)
+				access.Fail(r.Context(), r.RemoteAddr, access.FailWSAuth)
+				decoy.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func closeTcpHandle(writer http.ResponseWriter, request *http.Request) {
@@ -149,8 +360,14 @@ func closeTcpHandle(writer http.ResponseWriter, request *http.Request) {
 }
 
 func BuildServer(serverConfig config.ServerConfig) {
-	mux := http.NewServeMux()
+	decoy, err := newDecoy(serverConfig.Decoy)
+	if err != nil {
+		slog.Error("Invalid decoy", "address", serverConfig.BindAddress, "err", err)
+		return
+	}
+	serveMux := http.NewServeMux()
 	hadRoot := false
+	var reverseHandlers []*reverseHandler
 	for port, _client := range common.PortToClient {
 		wsPath := _client.GetServerWSPath()
 		if len(wsPath) > 0 {
@@ -164,19 +381,34 @@ func BuildServer(serverConfig config.ServerConfig) {
 		if len(target.WSPath) == 0 {
 			target.WSPath = "/"
 		}
+		if len(target.ReverseListen) > 0 {
+			rh := getReverseHandler(target)
+			reverseHandlers = append(reverseHandlers, rh)
+			if target.WSPath == "/" {
+				hadRoot = true
+			}
+			serveMux.Handle(target.WSPath, protect(rh, auth.New(target.AuthConfig), decoy))
+			continue
+		}
 		host, port, err := net.SplitHostPort(target.TargetAddress)
+		if err != nil && target.Type != "dynamic" {
+			slog.Error("Invalid target-address", "address", target.TargetAddress, "err", err)
+			continue
+		}
+		limiter, err := tunnel.NewLimiter("server/"+serverConfig.BindAddress+target.WSPath, target.LimitConfig)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Invalid limit", "ws-path", target.WSPath, "err", err)
 			continue
 		}
 		var sh ServerHandler
 		_client, ok := common.PortToClient[port]
-		if ok && (host == "127.0.0.1" || host == "localhost") {
-			log.Println("Short circuit replace (",
-				target.WSPath, "<->", target.TargetAddress,
-				") to (",
-				target.WSPath, "<->", _client.Target(), _client.Proxy(),
-				")")
+		if ok && len(target.Type) == 0 && (host == "127.0.0.1" || host == "localhost") {
+			slog.Info("Short circuit replace",
+				"ws-path", target.WSPath,
+				"from", target.TargetAddress,
+				"to", _client.Target(),
+				"proxy", _client.Proxy(),
+			)
 			listenerConfig := _client.GetListenerConfig().(listener.Config)
 			fb, _ := fallback.NewFallback(fallback.Config{
 				FallbackConfig:      listenerConfig.FallbackConfig,
@@ -188,50 +420,69 @@ func BuildServer(serverConfig config.ServerConfig) {
 				DestAddress: target.TargetAddress,
 				IsInternal:  true,
 				Fallback:    fb,
+				Limiter:     limiter,
+				Timeouts:    target.TimeoutConfig,
 			}
 		} else {
 			proxyConfig := serverConfig.ProxyConfig
 			if target.ProxyConfig != nil {
 				proxyConfig = *target.ProxyConfig
 			}
-			clientImpl, err := fallback.NewClientImpl(config.ClientConfig{TargetAddress: target.TargetAddress, ProxyConfig: proxyConfig})
+			var clientImpl common.ClientImpl
+			switch target.Type {
+			case "udp":
+				clientImpl, err = udp.NewClientImpl(target.TargetAddress)
+			case "dynamic":
+				clientImpl, err = dynamic.NewClientImpl(target.DynamicConfig, config.ClientConfig{ProxyConfig: proxyConfig, SendProxyProtocol: target.SendProxyProtocol})
+			default:
+				clientImpl, err = fallback.NewClientImpl(config.ClientConfig{TargetAddress: target.TargetAddress, ProxyConfig: proxyConfig, SendProxyProtocol: target.SendProxyProtocol})
+			}
 			if err != nil {
-				log.Println(err)
+				slog.Error("Invalid target", "address", target.TargetAddress, "err", err)
 				continue
 			}
 			sh = &serverHandler{
 				ClientImpl:  clientImpl,
 				DestAddress: target.TargetAddress,
 				IsInternal:  false,
+				Limiter:     limiter,
+				Timeouts:    target.TimeoutConfig,
 			}
 		}
 		if target.WSPath == "/" {
 			hadRoot = true
 		}
-		mux.Handle(target.WSPath, sh)
+		serveMux.Handle(target.WSPath, protect(sh, auth.New(target.AuthConfig), decoy))
 	}
 	if !hadRoot {
-		mux.HandleFunc("/", closeTcpHandle)
+		serveMux.Handle("/", decoy)
 	}
-	var s common.Server
-	s = &server{
-		serverHandler: mux,
-		listenerConfig: listener.Config{
-			ListenerConfig:      serverConfig.ListenerConfig,
-			ProxyConfig:         serverConfig.ProxyConfig,
-			IsWebSocketListener: true,
-		},
+	s := &server{reverseHandlers: reverseHandlers}
+	s.serverHandler.Store(serveMux)
+	trustedProxies, err := utils.ParsePrefixes(serverConfig.TrustedProxies)
+	if err != nil {
+		slog.Error("Invalid trusted-proxies", "address", serverConfig.BindAddress, "err", err)
+		return
+	}
+	s.trustedProxies.Store(trustedProxies)
+	s.listenerConfig.Store(listener.Config{
+		ListenerConfig:      serverConfig.ListenerConfig,
+		ProxyConfig:         serverConfig.ProxyConfig,
+		TLSConfig:           serverConfig.TLSConfig,
+		IsWebSocketListener: true,
+		TrustedProxies:      trustedProxies,
+	})
+	s.timeouts.Store(serverConfig.TimeoutConfig)
+	s.address.Store(serverConfig.BindAddress)
+	s.limiter.Store(access.NewLimiter(serverConfig.BindAddress))
+	if err = s.limiter.Load().Update(serverConfig.AccessConfig); err != nil {
+		slog.Error("Invalid access", "address", serverConfig.BindAddress, "err", err)
+		return
 	}
 	_, port, err := net.SplitHostPort(serverConfig.BindAddress)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Invalid bind-address", "address", serverConfig.BindAddress, "err", err)
 		return
 	}
 	common.PortToServer[port] = s
 }
-
-func StartServers() {
-	for _, server := range common.PortToServer {
-		server.Start()
-	}
-}
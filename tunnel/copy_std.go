@@ -1,21 +1,24 @@
 package tunnel
 
 import (
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 )
 
-func stdCopy(dst io.Writer, src io.Reader) (written int64, err error) {
-	log.Printf("stdCopy %T %T", src, dst)
+func stdCopy(dst io.Writer, src io.Reader, count counter, wait waiter) (written int64, err error) {
+	slog.Debug("stdCopy", "src", fmt.Sprintf("%T", src), "dst", fmt.Sprintf("%T", dst))
 	buf := BufPool.Get().([]byte)
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
+			wait.wait(nr)
 			nw, ew := dst.Write(buf[0:nr])
 			if nw < 0 || nr < nw {
 				nw = 0
 			}
 			written += int64(nw)
+			count.add(nw)
 			if ew != nil {
 				err = ew
 				break
@@ -7,6 +7,6 @@ import (
 	"syscall"
 )
 
-func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer) (handed bool, written int64, err error) {
+func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, count counter) (handed bool, written int64, err error) {
 	return
 }
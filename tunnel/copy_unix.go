@@ -3,13 +3,14 @@
 package tunnel
 
 import (
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"syscall"
 )
 
-func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer) (handed bool, written int64, err error) {
-	log.Printf("syscallCopy %T %T", src, dst)
+func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, count counter) (handed bool, written int64, err error) {
+	slog.Debug("syscallCopy", "src", fmt.Sprintf("%T", src), "dst", fmt.Sprintf("%T", dst))
 	handed = true
 	var sysErr error = nil
 	var buf []byte
@@ -57,6 +58,7 @@ func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer) (handed b
 		wn, err = dst.Write(buf[:rn])
 		putBuf()
 		written += int64(wn)
+		count.add(wn)
 		if rn != wn {
 			err = io.ErrShortWrite
 			return
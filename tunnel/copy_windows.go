@@ -1,8 +1,9 @@
 package tunnel
 
 import (
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"syscall"
 
 	"golang.org/x/sys/windows"
@@ -12,8 +13,8 @@ import (
 
 //sys recv(h windows.Handle, buf []byte, flags int32) (n int32, err error) [failretval==-1] = ws2_32.recv
 
-func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer) (handed bool, written int64, err error) {
-	log.Printf("syscallCopy %T %T", src, dst)
+func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, count counter) (handed bool, written int64, err error) {
+	slog.Debug("syscallCopy", "src", fmt.Sprintf("%T", src), "dst", fmt.Sprintf("%T", dst))
 	handed = true
 	var sysErr error = nil
 	var buf []byte
@@ -69,6 +70,7 @@ func syscallCopy(src io.Reader, srcRaw syscall.RawConn, dst io.Writer) (handed b
 		wn, err = dst.Write(buf[:rn])
 		putBuf()
 		written += int64(wn)
+		count.add(wn)
 		if rn != wn {
 			err = io.ErrShortWrite
 			return
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+// Info describes an incoming connection, it is carried by context.Context from the accepting to the tunneling,
+// the fields except the byte counters are set before the tunnel registered
+type Info struct {
+	ID       uint64
+	Network  string // "tcp" or "udp"
+	Listener string
+	Remote   string
+	Local    string // the address which the remote connected to
+	Fallback string
+	Target   string
+	Proxy    string
+	Start    time.Time
+
+	Received atomic.Int64 // bytes from the incoming side
+	Sent     atomic.Int64 // bytes to the incoming side
+
+	limiters    []*Limiter
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+var lastID atomic.Uint64
+
+func NewInfo(network, listener, remote string) *Info {
+	return &Info{
+		ID:       lastID.Add(1),
+		Network:  network,
+		Listener: listener,
+		Remote:   remote,
+		Start:    time.Now(),
+	}
+}
+
+type infoKey struct{}
+
+// NewContext returns a new context carrying a new Info
+func NewContext(ctx context.Context, network, listener, remote string) context.Context {
+	return context.WithValue(ctx, infoKey{}, NewInfo(network, listener, remote))
+}
+
+// ForkContext returns a new context carrying a new Info which has the same source as the Info of ctx,
+// it is used for the streams multiplexed in one connection
+func ForkContext(ctx context.Context) context.Context {
+	if info := InfoFromContext(ctx); info != nil {
+		ctx = NewContext(ctx, info.Network, info.Listener, info.Remote)
+		SetLocal(ctx, info.Local)
+		forked := InfoFromContext(ctx)
+		forked.limiters = info.limiters
+		forked.idleTimeout = info.idleTimeout
+		forked.maxLifetime = info.maxLifetime
+	}
+	return ctx
+}
+
+// InfoFromContext returns the Info carried by ctx, or nil
+func InfoFromContext(ctx context.Context) *Info {
+	info, _ := ctx.Value(infoKey{}).(*Info)
+	return info
+}
+
+func SetLocal(ctx context.Context, local string) {
+	if info := InfoFromContext(ctx); info != nil {
+		info.Local = local
+	}
+}
+
+func SetFallback(ctx context.Context, name string) {
+	if info := InfoFromContext(ctx); info != nil {
+		info.Fallback = name
+	}
+}
+
+func SetTarget(ctx context.Context, target, proxy string) {
+	if info := InfoFromContext(ctx); info != nil {
+		info.Target = target
+		info.Proxy = proxy
+	}
+}
+
+// SetTimeouts applies the idle-timeout and max-lifetime of timeoutConfig to the tunnel of ctx,
+// the shortest one wins if set several times (eg: by the listener and the target)
+func SetTimeouts(ctx context.Context, timeoutConfig config.TimeoutConfig) {
+	info := InfoFromContext(ctx)
+	if info == nil {
+		return
+	}
+	shorter := func(d time.Duration, seconds int) time.Duration {
+		if seconds <= 0 {
+			return d
+		}
+		if t := time.Duration(seconds) * time.Second; d == 0 || t < d {
+			return t
+		}
+		return d
+	}
+	info.idleTimeout = shorter(info.idleTimeout, timeoutConfig.IdleTimeout)
+	info.maxLifetime = shorter(info.maxLifetime, timeoutConfig.MaxLifetime)
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+var ErrQuotaExceeded = errors.New("monthly quota exceeded")
+
+// Limiter limits the bandwidth and the monthly traffic of all tunnels sharing it
+type Limiter struct {
+	name     string
+	upload   *bucket // from the incoming side, nil if unlimited
+	download *bucket // to the incoming side, nil if unlimited
+	quota    int64
+	usage    *atomic.Int64 // shared by the Limiters of the same name, nil if no quota
+}
+
+// NewLimiter returns nil if limitConfig is empty,
+// the quota usage is kept by name across config reloads
+func NewLimiter(name string, limitConfig config.LimitConfig) (*Limiter, error) {
+	l := &Limiter{name: name}
+	upload, err := parseBytes(limitConfig.UploadLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload-limit: %w", err)
+	}
+	download, err := parseBytes(limitConfig.DownloadLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid download-limit: %w", err)
+	}
+	if l.quota, err = parseBytes(limitConfig.MonthlyQuota); err != nil {
+		return nil, fmt.Errorf("invalid monthly-quota: %w", err)
+	}
+	if upload > 0 {
+		l.upload = newBucket(upload)
+	}
+	if download > 0 {
+		l.download = newBucket(download)
+	}
+	if l.quota > 0 {
+		l.usage = quotaUsage(name)
+	}
+	if l.upload == nil && l.download == nil && l.usage == nil {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// parseBytes parses "1024", "512K", "10M" or "100G" in 1024 units
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		unit = 1 << 10
+	case 'M', 'm':
+		unit = 1 << 20
+	case 'G', 'g':
+		unit = 1 << 30
+	case 'T', 't':
+		unit = 1 << 40
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// Limit makes the tunnel of ctx limited by l, it refuses a new tunnel once the quota of l exceeded
+func Limit(ctx context.Context, l *Limiter) error {
+	if l == nil {
+		return nil
+	}
+	if l.usage != nil {
+		checkQuotaMonth()
+		if l.usage.Load() >= l.quota {
+			return fmt.Errorf("%w: %s", ErrQuotaExceeded, l.name)
+		}
+	}
+	if info := InfoFromContext(ctx); info != nil {
+		info.limiters = append(info.limiters, l)
+	}
+	return nil
+}
+
+// waiter blocks until n bytes are allowed to be written
+type waiter func(n int)
+
+func (w waiter) wait(n int) {
+	if w != nil && n > 0 {
+		w(n)
+	}
+}
+
+// limits returns the waiters of both directions, they are nil if no bandwidth limited,
+// so that the splice and syscall copy still could be used
+func limits(limiters []*Limiter) (received, sent waiter) {
+	var uploads, downloads []*bucket
+	for _, l := range limiters {
+		if l.upload != nil {
+			uploads = append(uploads, l.upload)
+		}
+		if l.download != nil {
+			downloads = append(downloads, l.download)
+		}
+	}
+	wait := func(buckets []*bucket) waiter {
+		if len(buckets) == 0 {
+			return nil
+		}
+		return func(n int) {
+			for _, b := range buckets {
+				b.wait(n)
+			}
+		}
+	}
+	return wait(uploads), wait(downloads)
+}
+
+// bucket is a token bucket refilled rate bytes per second with a burst of one second
+type bucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens and sleeps until they are refilled if the bucket owed,
+// so the concurrent waiters are served in order
+func (b *bucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/config"
+)
+
+var limiterSeq int
+
+// limiterName returns a unique name, as the quota usages are shared by the Limiters of the same name
+func limiterName(t *testing.T) string {
+	limiterSeq++
+	return fmt.Sprintf("%s-%d", t.Name(), limiterSeq)
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		s       string
+		expect  int64
+		wantErr bool
+	}{
+		{s: "", expect: 0},
+		{s: "1024", expect: 1024},
+		{s: " 512K ", expect: 512 << 10},
+		{s: "10m", expect: 10 << 20},
+		{s: "100G", expect: 100 << 30},
+		{s: "1T", expect: 1 << 40},
+		{s: "K", wantErr: true},
+		{s: "1.5M", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "10MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			n, err := parseBytes(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if n != tt.expect {
+				t.Fatalf("parse = %d, want %d", n, tt.expect)
+			}
+		})
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	tests := []struct {
+		name         string
+		limitConfig  config.LimitConfig
+		wantNil      bool
+		wantErr      bool
+		wantUpload   bool
+		wantDownload bool
+	}{
+		{name: "empty", wantNil: true},
+		{name: "zero", limitConfig: config.LimitConfig{UploadLimit: "0", MonthlyQuota: "0G"}, wantNil: true},
+		{name: "upload", limitConfig: config.LimitConfig{UploadLimit: "1M"}, wantUpload: true},
+		{name: "download", limitConfig: config.LimitConfig{DownloadLimit: "1M"}, wantDownload: true},
+		{name: "quota only", limitConfig: config.LimitConfig{MonthlyQuota: "1G"}},
+		{name: "invalid upload", limitConfig: config.LimitConfig{UploadLimit: "fast"}, wantErr: true},
+		{name: "invalid download", limitConfig: config.LimitConfig{DownloadLimit: "1X"}, wantErr: true},
+		{name: "invalid quota", limitConfig: config.LimitConfig{MonthlyQuota: "-1G"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(t.Name(), tt.limitConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (l == nil) != tt.wantNil {
+				t.Fatalf("limiter = %v, want nil %v", l, tt.wantNil)
+			}
+			if l == nil {
+				return
+			}
+			received, sent := limits([]*Limiter{l})
+			if (received != nil) != tt.wantUpload || (sent != nil) != tt.wantDownload {
+				t.Fatalf("waiters = %t %t, want %t %t", received != nil, sent != nil, tt.wantUpload, tt.wantDownload)
+			}
+		})
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(10 << 10)
+	start := time.Now()
+	b.wait(10 << 10) // the burst of one second
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("burst waited %s", elapsed)
+	}
+	b.wait(5 << 10)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("waited %s, want about 500ms", elapsed)
+	}
+}
+
+func TestLimitedCopy(t *testing.T) {
+	l, err := NewLimiter(t.Name(), config.LimitConfig{UploadLimit: "10K"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, sent := limits([]*Limiter{l})
+	if sent != nil {
+		t.Fatal("download limited")
+	}
+	data := make([]byte, 15<<10)
+	var dst bytes.Buffer
+	start := time.Now()
+	n, err := copyCount(&dst, bytes.NewReader(data), nil, received)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copy = %d %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("copied in %s, want about 500ms", elapsed)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	name := limiterName(t)
+	limitConfig := config.LimitConfig{MonthlyQuota: "1K"}
+	l, err := NewLimiter(name, limitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), "tcp", "test", "1.1.1.1:1")
+	if err = Limit(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+
+	// both directions are counted
+	client, incoming := net.Pipe()
+	outgoing, target := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Tunnel(ctx, incoming, outgoing)
+		close(done)
+	}()
+	go func() {
+		_, _ = target.Write(make([]byte, 512))
+		_, _ = io.Copy(io.Discard, target)
+	}()
+	if _, err = io.ReadFull(client, make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	<-done
+	_ = target.Close()
+	if usage := l.usage.Load(); usage != 1112 {
+		t.Fatalf("usage = %d, want 1112", usage)
+	}
+
+	// the usage is kept by a reload
+	reloaded, err := NewLimiter(name, limitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Limit(NewContext(context.Background(), "tcp", "test", "1.1.1.1:2"), reloaded); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("limit = %v, want %v", err, ErrQuotaExceeded)
+	}
+	// but not shared with other names
+	other, err := NewLimiter(limiterName(t), limitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Limit(context.Background(), other); err != nil {
+		t.Fatalf("limit of another name = %v", err)
+	}
+}
+
+func TestQuotaState(t *testing.T) {
+	month := time.Now().Format("2006-01")
+	tests := []struct {
+		name   string
+		month  string
+		expect int64
+	}{
+		{"current month", month, 100},
+		{"stale month", "2000-01", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := limiterName(t)
+			path := filepath.Join(t.TempDir(), "quota.json")
+			data, _ := json.Marshal(quotaState{Month: tt.month, Usages: map[string]int64{name: 100}})
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			SetQuotaStateFile(path)
+			defer SetQuotaStateFile("")
+			l, err := NewLimiter(name, config.LimitConfig{MonthlyQuota: "1K"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage := l.usage.Load(); usage != tt.expect {
+				t.Fatalf("loaded usage = %d, want %d", usage, tt.expect)
+			}
+
+			l.usage.Add(24)
+			if err = SaveQuotaState(); err != nil {
+				t.Fatal(err)
+			}
+			data, err = os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved quotaState
+			if err = json.Unmarshal(data, &saved); err != nil {
+				t.Fatal(err)
+			}
+			if saved.Month != month || saved.Usages[name] != tt.expect+24 {
+				t.Fatalf("saved state = %+v", saved)
+			}
+		})
+	}
+}
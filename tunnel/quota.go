@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const quotaSaveInterval = time.Minute
+
+type quotaState struct {
+	Month  string           `json:"month"` // "2006-01" in local time
+	Usages map[string]int64 `json:"usages"`
+}
+
+var (
+	quotaMu     sync.Mutex
+	quotaMonth  = time.Now().Format("2006-01")
+	quotaUsages = make(map[string]*atomic.Int64)
+	quotaFile   string
+	quotaSaver  sync.Once
+)
+
+func quotaUsage(name string) *atomic.Int64 {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	usage, ok := quotaUsages[name]
+	if !ok {
+		usage = &atomic.Int64{}
+		quotaUsages[name] = usage
+	}
+	return usage
+}
+
+// checkQuotaMonth resets all usages when a new month began
+func checkQuotaMonth() {
+	month := time.Now().Format("2006-01")
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if month == quotaMonth {
+		return
+	}
+	slog.Info("Reset monthly quotas", "month", month)
+	quotaMonth = month
+	for _, usage := range quotaUsages {
+		usage.Store(0)
+	}
+}
+
+// SetQuotaStateFile loads the usages from path and saves them back every minute,
+// the usages are only kept in memory if path is empty
+func SetQuotaStateFile(path string) {
+	quotaMu.Lock()
+	if path == quotaFile {
+		quotaMu.Unlock()
+		return
+	}
+	quotaFile = path
+	quotaMu.Unlock()
+	if len(path) == 0 {
+		return
+	}
+	if err := loadQuotaState(path); err != nil {
+		slog.Error("Load quota state failed", "file", path, "err", err)
+	}
+	quotaSaver.Do(func() {
+		go func() {
+			for range time.Tick(quotaSaveInterval) {
+				if err := SaveQuotaState(); err != nil {
+					slog.Warn("Save quota state failed", "err", err)
+				}
+			}
+		}()
+	})
+}
+
+func loadQuotaState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state quotaState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if state.Month != quotaMonth { // a stale state of the last month
+		return nil
+	}
+	for name, n := range state.Usages {
+		usage, ok := quotaUsages[name]
+		if !ok {
+			usage = &atomic.Int64{}
+			quotaUsages[name] = usage
+		}
+		usage.Store(n)
+	}
+	return nil
+}
+
+// SaveQuotaState writes the usages to the state file if set
+func SaveQuotaState() error {
+	checkQuotaMonth()
+	quotaMu.Lock()
+	path := quotaFile
+	state := quotaState{Month: quotaMonth, Usages: make(map[string]int64, len(quotaUsages))}
+	for name, usage := range quotaUsages {
+		state.Usages[name] = usage.Load()
+	}
+	quotaMu.Unlock()
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write a temporary file then rename, so a crash never leaves a broken state
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is an active tunnel in the registry
+type Entry struct {
+	*Info
+	ctx         context.Context
+	conns       []net.Conn
+	interrupted atomic.Pointer[string] // the reason
+}
+
+// Interrupt makes the blocking Read and Write of the tunnel return immediately,
+// so the owner can finish its deferred Close (eg: sending websocket close frame) as usual
+func (e *Entry) Interrupt() {
+	e.interrupt("interrupted")
+}
+
+func (e *Entry) interrupt(reason string) {
+	e.interrupted.CompareAndSwap(nil, &reason)
+	now := time.Now()
+	for _, conn := range e.conns {
+		_ = conn.SetDeadline(now)
+	}
+}
+
+// Finish must be called when the tunnel finished, it removes the tunnel from the registry and writes the access log
+func (e *Entry) Finish(reason string) {
+	registryMu.Lock()
+	delete(entries, e.ID)
+	registryMu.Unlock()
+	if interrupted := e.interrupted.Load(); interrupted != nil {
+		reason = *interrupted
+	}
+	slog.InfoContext(e.ctx, "access",
+		"network", e.Network,
+		"listener", e.Listener,
+		"remote", e.Remote,
+		"fallback", e.Fallback,
+		"target", e.Target,
+		"proxy", e.Proxy,
+		"duration", time.Since(e.Start),
+		"received", e.Received.Load(),
+		"sent", e.Sent.Load(),
+		"reason", reason,
+	)
+}
+
+var (
+	registryMu sync.Mutex
+	entries    = make(map[uint64]*Entry)
+	sessions   = make(map[io.Closer]struct{})
+)
+
+// Register adds a tunnel with the Info carried by ctx to the registry
+func Register(ctx context.Context, conns ...net.Conn) *Entry {
+	info := InfoFromContext(ctx)
+	if info == nil {
+		info = NewInfo("tcp", "", conns[0].RemoteAddr().String())
+		ctx = context.WithValue(ctx, infoKey{}, info)
+	}
+	e := &Entry{Info: info, ctx: ctx, conns: conns}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	entries[e.ID] = e
+	return e
+}
+
+// List returns the active tunnels sorted by ID
+func List() []*Entry {
+	registryMu.Lock()
+	list := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	registryMu.Unlock()
+	slices.SortFunc(list, func(a, b *Entry) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// Kill interrupts the tunnel with id, return false if not found
+func Kill(id uint64) bool {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	e, ok := entries[id]
+	if ok {
+		e.Interrupt()
+	}
+	return ok
+}
+
+// Count returns the number of active tunnels
+func Count() int {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return len(entries)
+}
+
+func InterruptAll() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, e := range entries {
+		e.Interrupt()
+	}
+}
+
+// Wait waits all tunnels finished, return false if timeout
+func Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for Count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// TrackSession tracks a long-lived connection which carries tunnels (eg: mux session),
+// it will be closed by CloseSessions after all tunnels finished
+func TrackSession(session io.Closer) (untrack func()) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	sessions[session] = struct{}{}
+	return func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(sessions, session)
+	}
+}
+
+func CloseSessions() {
+	registryMu.Lock()
+	closers := make([]io.Closer, 0, len(sessions))
+	for session := range sessions {
+		closers = append(closers, session)
+	}
+	clear(sessions)
+	registryMu.Unlock()
+	var wg sync.WaitGroup
+	for _, session := range closers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = session.Close()
+		}()
+	}
+	wg.Wait()
+}
@@ -3,7 +3,7 @@ package tunnel
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -11,8 +11,8 @@ import (
 
 const maxSpliceSize = 1 << 20
 
-func splice(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, srcDst syscall.RawConn) (handed bool, n int64, err error) {
-	log.Printf("splice %T %T", src, dst)
+func splice(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, srcDst syscall.RawConn, count counter) (handed bool, n int64, err error) {
+	slog.Debug("splice", "src", fmt.Sprintf("%T", src), "dst", fmt.Sprintf("%T", dst))
 	handed = true
 	var pipeFDs [2]int
 	err = unix.Pipe2(pipeFDs[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK)
@@ -42,6 +42,8 @@ func splice(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, srcDst syscall
 				return writeErr != unix.EAGAIN
 			}
 			writeSize -= writeN
+			n += int64(writeN)
+			count.add(writeN)
 		}
 		return true
 	}
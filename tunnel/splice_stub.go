@@ -7,6 +7,6 @@ import (
 	"syscall"
 )
 
-func splice(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, srcDst syscall.RawConn) (handed bool, n int64, err error) {
+func splice(src io.Reader, srcRaw syscall.RawConn, dst io.Writer, srcDst syscall.RawConn, count counter) (handed bool, n int64, err error) {
 	return
 }
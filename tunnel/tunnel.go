@@ -1,13 +1,18 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/gobwas/ws/wsutil"
+	"github.com/wwqgtxx/wstunnel/metrics"
 	"github.com/wwqgtxx/wstunnel/peek"
 	"github.com/wwqgtxx/wstunnel/utils"
 )
@@ -20,40 +25,141 @@ var (
 	BufPool = sync.Pool{New: func() any { return make([]byte, BufSize) }}
 )
 
-func Tunnel(tcp1 net.Conn, tcp2 net.Conn) {
+// Tunnel copies data between tcp1 (the incoming side) and tcp2 until both directions finished
+func Tunnel(ctx context.Context, tcp1 net.Conn, tcp2 net.Conn) {
+	e := Register(ctx, tcp1, tcp2)
+	var reason string
+	var reasonOnce sync.Once
+	defer func() { e.Finish(reason) }()
 	setKeepAlive(tcp1)
 	setKeepAlive(tcp2)
 
+	// the direction finished first decides why the tunnel closed
+	setReason := func(closed string, err error) {
+		reasonOnce.Do(func() {
+			var closedErr wsutil.ClosedError
+			if errors.As(err, &closedErr) { // a normal websocket close
+				err = nil
+			}
+			if err != nil {
+				reason = err.Error()
+			} else {
+				reason = closed
+			}
+		})
+	}
+
+	received, sent := limits(e.limiters)
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	active := func(n int64) {
+		if e.idleTimeout > 0 {
+			lastActive.Store(time.Now().UnixNano())
+		}
+		for _, l := range e.limiters {
+			if l.usage != nil {
+				l.usage.Add(n)
+			}
+		}
+	}
+	if e.idleTimeout > 0 || e.maxLifetime > 0 {
+		defer e.watch(&lastActive)()
+	}
+
 	exit := make(chan struct{}, 1)
 
 	go func() {
-		_, err := Copy(tcp1, tcp2)
-		if err != nil && err == io.EOF {
-			log.Println(err)
+		_, err := copyCount(tcp1, tcp2, func(n int64) {
+			e.Sent.Add(n)
+			metrics.TunnelSentBytes.Add(uint64(n))
+			active(n)
+		}, sent)
+		if err == io.EOF {
+			slog.DebugContext(ctx, "Copy finished", "err", err)
 		}
+		setReason("target closed", err)
 		_ = tcp1.SetReadDeadline(time.Now())
 		exit <- struct{}{}
 	}()
 
-	_, err := Copy(tcp2, tcp1)
-	if err != nil && err == io.EOF {
-		log.Println(err)
+	_, err := copyCount(tcp2, tcp1, func(n int64) {
+		e.Received.Add(n)
+		metrics.TunnelReceivedBytes.Add(uint64(n))
+		active(n)
+	}, received)
+	if err == io.EOF {
+		slog.DebugContext(ctx, "Copy finished", "err", err)
 	}
+	setReason("client closed", err)
 	_ = tcp2.SetReadDeadline(time.Now())
 
 	<-exit
 }
 
+// watch interrupts the tunnel once it is idle for idleTimeout or lived for maxLifetime,
+// the deadlines also stop the splice, so the fast paths are kept
+func (e *Entry) watch(lastActive *atomic.Int64) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			now := time.Now()
+			var next time.Time
+			if e.maxLifetime > 0 {
+				next = e.Start.Add(e.maxLifetime)
+				if !now.Before(next) {
+					e.interrupt("max lifetime")
+					return
+				}
+			}
+			if e.idleTimeout > 0 {
+				idle := time.Unix(0, lastActive.Load()).Add(e.idleTimeout)
+				if !now.Before(idle) {
+					e.interrupt("idle timeout")
+					return
+				}
+				if next.IsZero() || idle.Before(next) {
+					next = idle
+				}
+			}
+			timer.Reset(next.Sub(now))
+		}
+	}()
+	return func() { close(done) }
+}
+
+// counter receives the size of every write while copying, so the stats of a long-lived tunnel are live
+type counter func(n int64)
+
+func (c counter) add(n int) {
+	if c != nil && n > 0 {
+		c(int64(n))
+	}
+}
+
 func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
+	return copyCount(dst, src, nil, nil)
+}
+
+// copyCount copies with the splice or syscall copy if possible, only the std copy is used if wait is not nil
+func copyCount(dst io.Writer, src io.Reader, count counter, wait waiter) (written int64, err error) {
 	dst = peek.ToWriter(dst)
 	for {
 		src = peek.ToReader(src)
 		if rc, ok := src.(peek.ReadCached); ok {
 			b := rc.ReadCached()
 			if len(b) > 0 {
+				wait.wait(len(b))
 				var n int
 				n, err = dst.Write(b)
 				written += int64(n)
+				count.add(n)
 				if err != nil {
 					return
 				}
@@ -62,20 +168,20 @@ func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
 		}
 		break
 	}
-	if srcSyscall, ok := src.(syscall.Conn); ok {
+	if srcSyscall, ok := src.(syscall.Conn); ok && wait == nil {
 		if srcRaw, sErr := srcSyscall.SyscallConn(); sErr == nil {
 			var handle bool
 			var n int64
 			if dstSyscall, ok := dst.(syscall.Conn); ok {
 				if dstRaw, sErr := dstSyscall.SyscallConn(); sErr == nil {
-					handle, n, err = splice(src, srcRaw, dst, dstRaw)
+					handle, n, err = splice(src, srcRaw, dst, dstRaw, count)
 					written += n
 					if handle {
 						return
 					}
 				}
 			}
-			handle, n, err = syscallCopy(src, srcRaw, dst)
+			handle, n, err = syscallCopy(src, srcRaw, dst, count)
 			written += n
 			if handle {
 				return
@@ -83,7 +189,7 @@ func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
 		}
 	}
 	var n int64
-	n, err = stdCopy(dst, src)
+	n, err = stdCopy(dst, src, count, wait)
 	written += n
 	return
 }
@@ -0,0 +1,123 @@
+package udp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wwqgtxx/wstunnel/common"
+	tunnelpkg "github.com/wwqgtxx/wstunnel/tunnel"
+	"github.com/wwqgtxx/wstunnel/utils"
+)
+
+// clientImpl is used by server side to decapsulate datagrams from websocket and send to udp target
+type clientImpl struct {
+	targetAddress string
+}
+
+var _ common.ClientImpl = (*clientImpl)(nil)
+
+func NewClientImpl(targetAddress string) (common.ClientImpl, error) {
+	return &clientImpl{targetAddress: targetAddress}, nil
+}
+
+func (c *clientImpl) Target() string {
+	return c.targetAddress
+}
+
+func (c *clientImpl) Proxy() string {
+	return ""
+}
+
+func (c *clientImpl) Handle(ctx context.Context, tcp net.Conn) {
+	defer tcp.Close()
+	slog.InfoContext(ctx, "Incoming", "remote", tcp.RemoteAddr().String(), "target", c.Target(), "network", "udp")
+	conn, err := c.Dial(ctx, nil, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Dial failed", "target", c.Target(), "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.TunnelTcp(ctx, tcp)
+}
+
+func (c *clientImpl) Dial(ctx context.Context, edBuf []byte, inHeader http.Header) (common.ClientConn, error) {
+	tunnelpkg.SetTarget(ctx, c.Target(), c.Proxy())
+	if info := tunnelpkg.InfoFromContext(ctx); info != nil {
+		info.Network = "udp"
+	}
+	udpConn, err := net.Dial("udp", c.targetAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{udpConn: udpConn, edBuf: edBuf}, nil
+}
+
+type clientConn struct {
+	udpConn net.Conn
+	edBuf   []byte
+	close   sync.Once
+}
+
+func (c *clientConn) Close() {
+	c.close.Do(func() {
+		_ = c.udpConn.Close()
+	})
+}
+
+func (c *clientConn) TunnelTcp(ctx context.Context, tcp net.Conn) {
+	if len(c.edBuf) > 0 {
+		tcp = utils.NewCachedConn(tcp, c.edBuf)
+	}
+	streamConn := NewStreamPacketConn(tcp)
+	e := tunnelpkg.Register(ctx, tcp, c.udpConn)
+	reason := "client closed"
+	defer func() { e.Finish(reason) }()
+	slog.InfoContext(ctx, "Associate", "from", tcp.RemoteAddr().String(), "to", c.udpConn.RemoteAddr().String(), "by", c.udpConn.LocalAddr().String())
+
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		buf := BufPool.Get().([]byte)
+		defer BufPool.Put(buf)
+		for {
+			n, err := streamConn.Read(buf)
+			if err != nil {
+				break
+			}
+			_, err = c.udpConn.Write(buf[:n])
+			if err != nil {
+				break
+			}
+			e.Received.Add(int64(n))
+			_ = c.udpConn.SetReadDeadline(time.Now().Add(MaxUdpAge)) // refresh timeout
+		}
+		c.Close() // stop reading from udpConn
+	}()
+
+	buf := BufPool.Get().([]byte)
+	defer BufPool.Put(buf)
+	for {
+		_ = c.udpConn.SetReadDeadline(time.Now().Add(MaxUdpAge)) // set timeout
+		n, err := c.udpConn.Read(buf)
+		if err != nil {
+			slog.InfoContext(ctx, "Delete and close", "by", c.udpConn.LocalAddr().String(), "for", tcp.RemoteAddr().String(), "to", c.udpConn.RemoteAddr().String(), "err", err)
+			reason = err.Error()
+			break
+		}
+		_, err = streamConn.Write(buf[:n])
+		if err != nil {
+			break
+		}
+		e.Sent.Add(int64(n))
+	}
+	_ = tcp.SetReadDeadline(time.Now())
+	<-exit
+}
+
+func (c *clientConn) TunnelWs(ctx context.Context, wsConn *utils.WebsocketConn) {
+	c.TunnelTcp(ctx, wsConn)
+}
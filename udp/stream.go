@@ -0,0 +1,57 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// streamPacketConn carries udp datagrams over a stream connection (eg: websocket),
+// every datagram is prefixed with its length in a 2 bytes big-endian integer.
+type streamPacketConn struct {
+	net.Conn
+	rMu sync.Mutex
+	wMu sync.Mutex
+}
+
+func NewStreamPacketConn(conn net.Conn) net.Conn {
+	return &streamPacketConn{Conn: conn}
+}
+
+func (c *streamPacketConn) Read(p []byte) (n int, err error) {
+	c.rMu.Lock()
+	defer c.rMu.Unlock()
+	var lenBuf [2]byte
+	_, err = io.ReadFull(c.Conn, lenBuf[:])
+	if err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if length > len(p) { // drop the exceeded part
+		n, err = io.ReadFull(c.Conn, p)
+		if err != nil {
+			return
+		}
+		_, err = io.CopyN(io.Discard, c.Conn, int64(length-len(p)))
+		return
+	}
+	return io.ReadFull(c.Conn, p[:length])
+}
+
+func (c *streamPacketConn) Write(p []byte) (n int, err error) {
+	if len(p) > 0xffff {
+		return 0, errors.New("udp packet too large")
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	_, err = c.Conn.Write(buf) // write in once to keep a datagram in single websocket frame
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
@@ -0,0 +1,80 @@
+package udp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// bufferConn is a net.Conn reading what written to it
+type bufferConn struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.Buffer.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.Buffer.Write(p) }
+
+func TestStreamPacketConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		readBuf int
+		expect  [][]byte
+	}{
+		{"one", [][]byte{[]byte("hello")}, 1500, [][]byte{[]byte("hello")}},
+		{"several", [][]byte{[]byte("a"), []byte("bc"), []byte("def")}, 1500, [][]byte{[]byte("a"), []byte("bc"), []byte("def")}},
+		{"empty", [][]byte{{}, []byte("a")}, 1500, [][]byte{{}, []byte("a")}},
+		{"max size", [][]byte{bytes.Repeat([]byte{1}, 0xffff)}, 0xffff, [][]byte{bytes.Repeat([]byte{1}, 0xffff)}},
+		{"exceeded part dropped", [][]byte{[]byte("hello"), []byte("world")}, 3, [][]byte{[]byte("hel"), []byte("wor")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &bufferConn{}
+			conn := NewStreamPacketConn(raw)
+			for _, packet := range tt.packets {
+				if n, err := conn.Write(packet); err != nil || n != len(packet) {
+					t.Fatalf("write = %d %v", n, err)
+				}
+			}
+			buf := make([]byte, tt.readBuf)
+			for _, expect := range tt.expect {
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], expect) {
+					t.Fatalf("read = %q, want %q", buf[:n], expect)
+				}
+			}
+			if _, err := conn.Read(buf); err != io.EOF {
+				t.Fatalf("read after all = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestStreamPacketConnErrors(t *testing.T) {
+	conn := NewStreamPacketConn(&bufferConn{})
+	if _, err := conn.Write(make([]byte, 0x10000)); err == nil {
+		t.Fatal("wrote a packet larger than 0xffff")
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated length", []byte{0}},
+		{"truncated packet", []byte{0, 5, 'a', 'b'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &bufferConn{}
+			raw.Buffer.Write(tt.raw)
+			if _, err := NewStreamPacketConn(raw).Read(make([]byte, 1500)); err != io.ErrUnexpectedEOF {
+				t.Fatalf("read = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
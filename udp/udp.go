@@ -1,7 +1,7 @@
 package udp
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"time"
 
@@ -12,26 +12,62 @@ const MaxUdpAge = 5 * time.Minute
 
 type Tunnel interface {
 	Handle()
+	Close() error
+	// Update swaps the config of a running tunnel, return false if it can't be done in place
+	Update(newTunnel Tunnel) bool
 }
 
-var tunnels = make(map[string]Tunnel)
+var (
+	tunnels        = make(map[string]Tunnel) // built, wait for StartUdps
+	runningTunnels = make(map[string]Tunnel)
+)
 
 func BuildUdp(udpConfig config.UdpConfig) {
 	_, port, err := net.SplitHostPort(udpConfig.BindAddress)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Invalid udp bind-address", "address", udpConfig.BindAddress, "err", err)
+		return
+	}
+	if udpConfig.MMsg && len(udpConfig.WSUrl) > 0 {
+		slog.Error("Invalid udp config, mmsg only support udp target, not ws-url", "address", udpConfig.BindAddress)
 		return
 	}
+	var tunnel Tunnel
 	if udpConfig.MMsg {
-		tunnels[port] = NewMmsgTunnel(udpConfig)
+		tunnel, err = NewMmsgTunnel(udpConfig)
 	} else {
-		tunnels[port] = NewStdTunnel(udpConfig)
+		tunnel, err = NewStdTunnel(udpConfig)
 	}
-
+	if err != nil {
+		slog.Error("Invalid udp config", "address", udpConfig.BindAddress, "err", err)
+		return
+	}
+	tunnels[port] = tunnel
 }
 
+// StartUdps starts the built tunnels, the running ones on an unchanged port are updated in place
 func StartUdps() {
-	for _, tunnel := range tunnels {
+	for port, tunnel := range runningTunnels {
+		newTunnel, ok := tunnels[port]
+		if ok && tunnel.Update(newTunnel) {
+			tunnels[port] = tunnel
+			continue
+		}
+		_ = tunnel.Close()
+		delete(runningTunnels, port)
+	}
+	for port, tunnel := range tunnels {
+		if _, ok := runningTunnels[port]; ok {
+			continue
+		}
 		go tunnel.Handle()
+		runningTunnels[port] = tunnel
 	}
+	tunnels = make(map[string]Tunnel)
+}
+
+// StopUdps closes all running tunnels
+func StopUdps() {
+	clear(tunnels)
+	StartUdps()
 }
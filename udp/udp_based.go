@@ -1,34 +1,67 @@
 package udp
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"slices"
+	"strings"
 
+	"github.com/wwqgtxx/wstunnel/access"
+	"github.com/wwqgtxx/wstunnel/atomic"
+	"github.com/wwqgtxx/wstunnel/common"
 	"github.com/wwqgtxx/wstunnel/config"
+	"github.com/wwqgtxx/wstunnel/fallback"
 	"github.com/wwqgtxx/wstunnel/fallback/quic"
 	"github.com/wwqgtxx/wstunnel/fallback/ss2022"
 	"github.com/wwqgtxx/wstunnel/fallback/ssaead"
+	"github.com/wwqgtxx/wstunnel/metrics"
+	tunnelpkg "github.com/wwqgtxx/wstunnel/tunnel"
 )
 
 type tunnel struct {
 	address  string
 	target   string
 	reserved []byte
+	wsDialer common.ConnDialer
+	access   config.AccessConfig
 
 	ssTester     *ssaead.Tester[string]
 	ss2022Tester *ss2022.Tester[string]
 	quicTester   *quic.Tester[string]
 }
 
-func newTunnel(udpConfig config.UdpConfig) tunnel {
-	t := tunnel{
+func newTunnel(udpConfig config.UdpConfig) (*tunnel, error) {
+	t := &tunnel{
 		address:  udpConfig.BindAddress,
 		target:   udpConfig.TargetAddress,
 		reserved: slices.Clone(udpConfig.Reserved),
+		access:   udpConfig.AccessConfig,
 	}
 
 	var err error
+	if len(udpConfig.WSUrl) > 0 {
+		t.target = udpConfig.WSUrl
+		var clientImpl common.ClientImpl
+		clientImpl, err = fallback.NewClientImpl(config.ClientConfig{
+			ProxyConfig:    udpConfig.ProxyConfig,
+			AuthConfig:     udpConfig.AuthConfig,
+			WSUrl:          udpConfig.WSUrl,
+			WSHeaders:      udpConfig.WSHeaders,
+			SkipCertVerify: udpConfig.SkipCertVerify,
+			ServerName:     udpConfig.ServerName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid ws-url: %w", err)
+		}
+		wsDialer, ok := clientImpl.(common.ConnDialer)
+		if !ok {
+			return nil, errors.New("invalid ws-url: not a conn dialer: " + udpConfig.WSUrl)
+		}
+		t.wsDialer = wsDialer
+	}
 	if len(udpConfig.SSFallback) > 0 {
 		t.ssTester = ssaead.NewTester[string]()
 		for _, ssFallbackConfig := range udpConfig.SSFallback {
@@ -39,7 +72,7 @@ func newTunnel(udpConfig config.UdpConfig) tunnel {
 				ssFallbackConfig.Address,
 			)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Invalid ss-fallback", "name", ssFallbackConfig.Name, "err", err)
 			}
 		}
 	}
@@ -53,7 +86,7 @@ func newTunnel(udpConfig config.UdpConfig) tunnel {
 				ss2022FallbackConfig.Address,
 			)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Invalid ss2022-fallback", "name", ss2022FallbackConfig.Name, "err", err)
 			}
 		}
 	}
@@ -65,11 +98,11 @@ func newTunnel(udpConfig config.UdpConfig) tunnel {
 				quicFallbackConfig.Address,
 			)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Invalid quic-fallback", "sni", quicFallbackConfig.SNI, "err", err)
 			}
 		}
 	}
-	return t
+	return t, nil
 }
 
 func (t *tunnel) getTarget(packet []byte) (target, addition string) {
@@ -100,3 +133,85 @@ func (t *tunnel) getTarget(packet []byte) (target, addition string) {
 	}
 	return
 }
+
+// associate counts a new association in metrics and registers it to the tunnel registry,
+// done must be called with the reason after the association removed
+func (t *tunnel) associate(from string, target string, addition string, remoteConn net.Conn, release func()) (ctx context.Context, entry *tunnelpkg.Entry, done func(reason string)) {
+	active := metrics.UdpAssociationsActive.With(t.address)
+	active.Inc()
+	metrics.UdpAssociationsTotal.With(t.address).Inc()
+	ctx = tunnelpkg.NewContext(context.Background(), "udp", t.address, from)
+	tunnelpkg.SetFallback(ctx, addition)
+	tunnelpkg.SetTarget(ctx, target, "")
+	entry = tunnelpkg.Register(ctx, remoteConn)
+	return ctx, entry, func(reason string) {
+		active.Dec()
+		release()
+		entry.Finish(reason)
+	}
+}
+
+func (t *tunnel) dial(target string) (net.Conn, error) {
+	if strings.HasPrefix(target, "ws") {
+		if t.wsDialer == nil {
+			return nil, errors.New("invalid ws-url: " + target)
+		}
+		conn, err := t.wsDialer.DialConn(context.Background(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewStreamPacketConn(conn), nil
+	}
+	return net.Dial("udp", target)
+}
+
+type baseTunnel struct {
+	tunnel  atomic.Pointer[tunnel]
+	udpConn atomic.Pointer[net.UDPConn]
+	closed  atomic.Bool
+	limiter *access.Limiter // limits the associations, kept across updates
+}
+
+func (t *baseTunnel) init(udpConfig config.UdpConfig) error {
+	tunnel, err := newTunnel(udpConfig)
+	if err != nil {
+		return err
+	}
+	t.tunnel.Store(tunnel)
+	t.limiter = access.NewLimiter(udpConfig.BindAddress)
+	if err = t.limiter.Update(udpConfig.AccessConfig); err != nil {
+		return fmt.Errorf("invalid access: %w", err)
+	}
+	return nil
+}
+
+func (t *baseTunnel) listen() (*net.UDPConn, error) {
+	udpConn, err := ListenUdp("udp", t.tunnel.Load().address)
+	if err != nil {
+		return nil, err
+	}
+	t.udpConn.Store(udpConn)
+	if t.closed.Load() { // closed before listen
+		_ = udpConn.Close()
+		return nil, net.ErrClosed
+	}
+	return udpConn, nil
+}
+
+func (t *baseTunnel) Close() error {
+	t.closed.Store(true)
+	if udpConn := t.udpConn.Load(); udpConn != nil {
+		return udpConn.Close()
+	}
+	return nil
+}
+
+func (t *baseTunnel) update(newTunnel *baseTunnel) bool {
+	if t.tunnel.Load().address != newTunnel.tunnel.Load().address {
+		return false
+	}
+	// the associated sessions keep using the old tunnel config until they expire
+	t.tunnel.Store(newTunnel.tunnel.Load())
+	_ = t.limiter.Update(newTunnel.tunnel.Load().access) // checked by BuildUdp
+	return true
+}
@@ -1,14 +1,16 @@
 package udp
 
 import (
+	"context"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/wwqgtxx/wstunnel/config"
+	tunnelpkg "github.com/wwqgtxx/wstunnel/tunnel"
 )
 
 const (
@@ -42,24 +44,46 @@ var _ ipv4.Message = ipv6.Message{}
 type MmsgMapItem struct {
 	net.Conn
 	*ipv4.PacketConn
+	*tunnelpkg.Entry
 	sync.Mutex
 }
 
 type MmsgTunnel struct {
 	connMap sync.Map
-	tunnel
+	baseTunnel
 }
 
-func NewMmsgTunnel(udpConfig config.UdpConfig) Tunnel {
-	return &MmsgTunnel{
-		tunnel: newTunnel(udpConfig),
+func NewMmsgTunnel(udpConfig config.UdpConfig) (Tunnel, error) {
+	t := &MmsgTunnel{}
+	if err := t.init(udpConfig); err != nil {
+		return nil, err
 	}
+	return t, nil
+}
+
+func (t *MmsgTunnel) Update(newTunnel Tunnel) bool {
+	nt, ok := newTunnel.(*MmsgTunnel)
+	return ok && t.update(&nt.baseTunnel)
+}
+
+func (t *MmsgTunnel) Close() error {
+	err := t.baseTunnel.Close()
+	t.connMap.Range(func(key, value any) bool {
+		mapItem := value.(*MmsgMapItem)
+		mapItem.Mutex.Lock()
+		if mapItem.Conn != nil {
+			_ = mapItem.Conn.Close()
+		}
+		mapItem.Mutex.Unlock()
+		return true
+	})
+	return err
 }
 
 func (t *MmsgTunnel) Handle() {
-	udpConn, err := ListenUdp("udp", t.address)
+	udpConn, err := t.listen()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Listen udp failed", "err", err)
 		return
 	}
 	packetConn := ipv4.NewPacketConn(udpConn)
@@ -85,8 +109,10 @@ func (t *MmsgTunnel) Handle() {
 		n, err := packetConn.ReadBatch(rMsgs, 0)
 		lastN = n
 		if err != nil {
-			// TODO: handle close
-			log.Println(err)
+			if t.closed.Load() {
+				return
+			}
+			slog.Warn("Read udp failed", "err", err)
 			continue
 		}
 		for i := 0; i < n; i++ {
@@ -121,21 +147,36 @@ func (t *MmsgTunnel) Handle() {
 					}
 					WriteMsgsBufPool.Put(wMsgs)
 				}()
+				tun := t.tunnel.Load()
 				v, _ := t.connMap.LoadOrStore(addr, &MmsgMapItem{})
 				mapItem := v.(*MmsgMapItem)
 				mapItem.Mutex.Lock()
 				remoteConn := mapItem.Conn
 				remotePacketConn := mapItem.PacketConn
+				entry := mapItem.Entry
 				if remoteConn == nil || remotePacketConn == nil {
-					target, addition := t.getTarget(wMsgs[0].Buffers[0])
-					log.Println("Dial", addition, "to", target, "for", addr)
+					release, err := t.limiter.Acquire(addr)
+					if err != nil {
+						t.connMap.Delete(addr)
+						mapItem.Mutex.Unlock()
+						// logged in debug level since it happens for every packet of the rejected clients
+						slog.Debug("Access rejected", "address", tun.address, "remote", addr, "err", err)
+						return
+					}
+					target, addition := tun.getTarget(wMsgs[0].Buffers[0])
+					slog.Debug("Dial", "fallback", addition, "target", target, "for", addr)
 					remoteConn, err = net.Dial("udp", target)
 					if err != nil {
+						release()
 						mapItem.Mutex.Unlock()
-						log.Println(err)
+						slog.Warn("Dial failed", "fallback", addition, "target", target, "for", addr, "err", err)
 						return
 					}
-					log.Println("Associate from", addr, "to", remoteConn.RemoteAddr(), "by", remoteConn.LocalAddr())
+					var ctx context.Context
+					var done func(reason string)
+					ctx, entry, done = tun.associate(addr, target, addition, remoteConn, release)
+					slog.InfoContext(ctx, "Associate", "fallback", addition, "from", addr, "to", remoteConn.RemoteAddr().String(), "by", remoteConn.LocalAddr().String())
+					mapItem.Entry = entry
 					remotePacketConn = ipv4.NewPacketConn(remoteConn.(*net.UDPConn))
 					mapItem.Conn = remoteConn
 					mapItem.PacketConn = remotePacketConn
@@ -151,14 +192,15 @@ func (t *MmsgTunnel) Handle() {
 							n, err := remotePacketConn.ReadBatch(rMsgs, 0)
 							if err != nil {
 								t.connMap.Delete(addr)
-								log.Println("Delete and close", remoteConn.LocalAddr(), "for", addr, "to", remoteConn.RemoteAddr(), "because", err)
+								slog.InfoContext(ctx, "Delete and close", "by", remoteConn.LocalAddr().String(), "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 								_ = remoteConn.Close()
+								done(err.Error())
 								return
 							}
 							for i := 0; i < n; i++ {
 								buf := rMsgs[i].Buffers[0][:rMsgs[i].N]
-								if len(t.reserved) > 0 && len(buf) > len(t.reserved) { // wireguard reserved
-									for i := range t.reserved {
+								if len(tun.reserved) > 0 && len(buf) > len(tun.reserved) { // wireguard reserved
+									for i := range tun.reserved {
 										buf[i+1] = 0
 									}
 								}
@@ -173,10 +215,12 @@ func (t *MmsgTunnel) Handle() {
 							}
 							if err != nil {
 								t.connMap.Delete(addr)
-								log.Println("Delete and close", remoteConn.LocalAddr(), "for", addr, "to", remoteConn.RemoteAddr(), "because", err)
+								slog.InfoContext(ctx, "Delete and close", "by", remoteConn.LocalAddr().String(), "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 								_ = remoteConn.Close()
+								done(err.Error())
 								return
 							}
+							entry.Sent.Add(msgsLen(wMsgs[:wMsgsN]))
 						}
 					}()
 				}
@@ -184,8 +228,8 @@ func (t *MmsgTunnel) Handle() {
 
 				for _, wMsg := range wMsgs[:wMsgsN] {
 					buf := wMsg.Buffers[0]
-					if len(t.reserved) > 0 && len(buf) > len(t.reserved) { // wireguard reserved
-						copy(buf[1:], t.reserved)
+					if len(tun.reserved) > 0 && len(buf) > len(tun.reserved) { // wireguard reserved
+						copy(buf[1:], tun.reserved)
 					}
 					wMsg.Addr = nil // set nil for connection-oriented udp from net.Dial
 				}
@@ -196,9 +240,10 @@ func (t *MmsgTunnel) Handle() {
 					err = writeBatch(remotePacketConn, wMsgs[:wMsgsN])
 				}
 				if err != nil {
-					log.Println(err)
+					slog.Warn("Write udp failed", "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 					return
 				}
+				entry.Received.Add(msgsLen(wMsgs[:wMsgsN]))
 				_ = remoteConn.SetReadDeadline(time.Now().Add(MaxUdpAge)) // refresh timeout
 
 			}()
@@ -208,6 +253,13 @@ func (t *MmsgTunnel) Handle() {
 
 }
 
+func msgsLen(ms []ipv4.Message) (n int64) {
+	for _, m := range ms {
+		n += int64(len(m.Buffers[0]))
+	}
+	return
+}
+
 func writeBatch(conn *ipv4.PacketConn, ms []ipv4.Message) error {
 	// On success, sendmmsg() returns the number of messages sent from msgvec;
 	// if this is less than vlen, the caller can retry with a further sendmmsg() call to send the remaining messages.
@@ -1,13 +1,15 @@
 package udp
 
 import (
+	"context"
 	"golang.org/x/net/ipv4"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/wwqgtxx/wstunnel/config"
+	tunnelpkg "github.com/wwqgtxx/wstunnel/tunnel"
 )
 
 const BufferSize = 16 * 1024
@@ -25,51 +27,90 @@ func ListenUdp(network, address string) (*net.UDPConn, error) {
 type StdMapItem struct {
 	net.Conn
 	*ipv4.PacketConn
+	*tunnelpkg.Entry
 	sync.Mutex
 }
 
 type StdTunnel struct {
 	connMap sync.Map
-	tunnel
+	baseTunnel
 }
 
-func NewStdTunnel(udpConfig config.UdpConfig) Tunnel {
-	return &StdTunnel{
-		tunnel: newTunnel(udpConfig),
+func NewStdTunnel(udpConfig config.UdpConfig) (Tunnel, error) {
+	t := &StdTunnel{}
+	if err := t.init(udpConfig); err != nil {
+		return nil, err
 	}
+	return t, nil
+}
+
+func (t *StdTunnel) Update(newTunnel Tunnel) bool {
+	nt, ok := newTunnel.(*StdTunnel)
+	return ok && t.update(&nt.baseTunnel)
+}
+
+func (t *StdTunnel) Close() error {
+	err := t.baseTunnel.Close()
+	t.connMap.Range(func(key, value any) bool {
+		mapItem := value.(*StdMapItem)
+		mapItem.Mutex.Lock()
+		if mapItem.Conn != nil {
+			_ = mapItem.Conn.Close()
+		}
+		mapItem.Mutex.Unlock()
+		return true
+	})
+	return err
 }
 
 func (t *StdTunnel) Handle() {
-	udpConn, err := ListenUdp("udp", t.address)
+	udpConn, err := t.listen()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Listen udp failed", "err", err)
 		return
 	}
 	enhanceUDPConn := NewEnhancePacketConn(udpConn)
 	for {
 		data, put, addr, err := enhanceUDPConn.WaitReadFrom()
 		if err != nil {
-			// TODO: handle close
-			log.Println(err)
+			if t.closed.Load() {
+				return
+			}
+			slog.Warn("Read udp failed", "err", err)
 			continue
 		}
 		go func() {
 			defer put()
 			var err error
+			tun := t.tunnel.Load()
 			v, _ := t.connMap.LoadOrStore(addr, &StdMapItem{})
 			mapItem := v.(*StdMapItem)
 			mapItem.Mutex.Lock()
 			remoteConn := mapItem.Conn
+			entry := mapItem.Entry
 			if remoteConn == nil {
-				target, addition := t.getTarget(data)
-				log.Println("Dial", addition, "to", target, "for", addr)
-				remoteConn, err = net.Dial("udp", target)
+				release, err := t.limiter.Acquire(addr.String())
+				if err != nil {
+					t.connMap.Delete(addr)
+					mapItem.Mutex.Unlock()
+					// logged in debug level since it happens for every packet of the rejected clients
+					slog.Debug("Access rejected", "address", tun.address, "remote", addr, "err", err)
+					return
+				}
+				target, addition := tun.getTarget(data)
+				slog.Debug("Dial", "fallback", addition, "target", target, "for", addr)
+				remoteConn, err = tun.dial(target)
 				if err != nil {
+					release()
 					mapItem.Mutex.Unlock()
-					log.Println(err)
+					slog.Warn("Dial failed", "fallback", addition, "target", target, "for", addr, "err", err)
 					return
 				}
-				log.Println("Associate", addition, "from", addr, "to", remoteConn.RemoteAddr(), "by", remoteConn.LocalAddr())
+				var ctx context.Context
+				var done func(reason string)
+				ctx, entry, done = tun.associate(addr.String(), target, addition, remoteConn, release)
+				slog.InfoContext(ctx, "Associate", "fallback", addition, "from", addr, "to", remoteConn.RemoteAddr().String(), "by", remoteConn.LocalAddr().String())
+				mapItem.Entry = entry
 				mapItem.Conn = remoteConn
 				go func() {
 					for {
@@ -79,12 +120,13 @@ func (t *StdTunnel) Handle() {
 						if err != nil {
 							BufPool.Put(buf)
 							t.connMap.Delete(addr)
-							log.Println("Delete and close", remoteConn.LocalAddr(), "for", addr, "to", remoteConn.RemoteAddr(), "because", err)
+							slog.InfoContext(ctx, "Delete and close", "by", remoteConn.LocalAddr().String(), "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 							_ = remoteConn.Close()
+							done(err.Error())
 							return
 						}
-						if len(t.reserved) > 0 && n > len(t.reserved) { // wireguard reserved
-							for i := range t.reserved {
+						if len(tun.reserved) > 0 && n > len(tun.reserved) { // wireguard reserved
+							for i := range tun.reserved {
 								buf[i+1] = 0
 							}
 						}
@@ -92,22 +134,25 @@ func (t *StdTunnel) Handle() {
 						BufPool.Put(buf)
 						if err != nil {
 							t.connMap.Delete(addr)
-							log.Println("Delete and close", remoteConn.LocalAddr(), "for", addr, "to", remoteConn.RemoteAddr(), "because", err)
+							slog.InfoContext(ctx, "Delete and close", "by", remoteConn.LocalAddr().String(), "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 							_ = remoteConn.Close()
+							done(err.Error())
 							return
 						}
+						entry.Sent.Add(int64(n))
 					}
 				}()
 			}
 			mapItem.Mutex.Unlock()
-			if len(t.reserved) > 0 && len(data) > len(t.reserved) { // wireguard reserved
-				copy(data[1:], t.reserved)
+			if len(tun.reserved) > 0 && len(data) > len(tun.reserved) { // wireguard reserved
+				copy(data[1:], tun.reserved)
 			}
 			_, err = remoteConn.Write(data)
 			if err != nil {
-				log.Println(err)
+				slog.Warn("Write udp failed", "for", addr, "to", remoteConn.RemoteAddr().String(), "err", err)
 				return
 			}
+			entry.Received.Add(int64(len(data)))
 			_ = remoteConn.SetReadDeadline(time.Now().Add(MaxUdpAge)) // refresh timeout
 		}()
 
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const RegexpPrefix = "regexp:"
+
+// DomainMatcher matches a domain by the patterns in the precedence of
+// exact > longest wildcard > regexp in the added order > default:
+//
+//	example.com      exact
+//	*.example.com    the subdomains of example.com
+//	.example.com     example.com and its subdomains
+//	regexp:^a\d+\.   searches the domain by the regexp
+//	""               default
+type DomainMatcher[T any] struct {
+	exact     map[string]T
+	wildcards map[string]T // by the suffix with the leading dot
+	apexes    map[string]T // the domains themselves of the .example.com patterns
+	regexps   []domainRegexp[T]
+	def       T
+	hasDef    bool
+}
+
+type domainRegexp[T any] struct {
+	re  *regexp.Regexp
+	val T
+}
+
+func NewDomainMatcher[T any]() *DomainMatcher[T] {
+	return &DomainMatcher[T]{exact: make(map[string]T), wildcards: make(map[string]T), apexes: make(map[string]T)}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// NormalizePattern returns the pattern in the form used as the key of DomainMatcher,
+// the patterns with the same normalized form are the same pattern
+func NormalizePattern(pattern string) string {
+	if strings.HasPrefix(pattern, RegexpPrefix) {
+		return pattern
+	}
+	return normalizeDomain(pattern)
+}
+
+// Add adds a pattern, it fails if the pattern or another one matching the same domains already added,
+// eg: *.example.com and .example.com both match the subdomains of example.com
+func (m *DomainMatcher[T]) Add(pattern string, val T) error {
+	if expr, ok := strings.CutPrefix(pattern, RegexpPrefix); ok {
+		for _, r := range m.regexps {
+			if r.re.String() == expr {
+				return fmt.Errorf("duplicated domain pattern: %s", pattern)
+			}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		m.regexps = append(m.regexps, domainRegexp[T]{re: re, val: val})
+		return nil
+	}
+	pattern = normalizeDomain(pattern)
+	var exists bool
+	switch {
+	case len(pattern) == 0:
+		exists = m.hasDef
+	case strings.HasPrefix(pattern, "*."):
+		_, exists = m.wildcards[pattern[1:]]
+	case strings.HasPrefix(pattern, "."):
+		_, exists = m.wildcards[pattern]
+	default:
+		_, exists = m.exact[pattern]
+	}
+	if exists {
+		return fmt.Errorf("domain pattern %s matches the same domains as an added one", pattern)
+	}
+	switch {
+	case len(pattern) == 0:
+		m.def, m.hasDef = val, true
+	case strings.HasPrefix(pattern, "*."):
+		m.wildcards[pattern[1:]] = val
+	case strings.HasPrefix(pattern, "."):
+		m.wildcards[pattern] = val
+		m.apexes[pattern[1:]] = val
+	default:
+		m.exact[pattern] = val
+	}
+	return nil
+}
+
+func (m *DomainMatcher[T]) Match(domain string) (val T, ok bool) {
+	domain = normalizeDomain(domain)
+	if val, ok = m.exact[domain]; ok {
+		return
+	}
+	if val, ok = m.apexes[domain]; ok { // the longest suffix
+		return
+	}
+	if len(m.wildcards) > 0 {
+		for i := strings.IndexByte(domain, '.'); i >= 0; {
+			if val, ok = m.wildcards[domain[i:]]; ok {
+				return
+			}
+			next := strings.IndexByte(domain[i+1:], '.')
+			if next < 0 {
+				break
+			}
+			i += next + 1
+		}
+	}
+	for _, r := range m.regexps {
+		if r.re.MatchString(domain) {
+			return r.val, true
+		}
+	}
+	return m.def, m.hasDef
+}
+
+func (m *DomainMatcher[T]) Default() (T, bool) {
+	return m.def, m.hasDef
+}
@@ -0,0 +1,118 @@
+package utils
+
+import "testing"
+
+func TestDomainMatcher(t *testing.T) {
+	m := NewDomainMatcher[string]()
+	for _, pattern := range []string{
+		"regexp:^a\\d+\\.",
+		"www.example.com",
+		"*.example.com",
+		".sub.example.com",
+		"regexp:example",
+		".example.org",
+		"Exact.Example.Net.",
+		"*.b.example.com",
+		"",
+	} {
+		if err := m.Add(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		domain string
+		expect string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.com.", "www.example.com"},
+		{"mail.example.com", "*.example.com"},
+		{"example.com", "regexp:example"}, // not matched by the wildcard
+		{"sub.example.com", ".sub.example.com"},
+		{"x.sub.example.com", ".sub.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"b.example.com", "*.example.com"},
+		{"example.org", ".example.org"},
+		{"a.b.example.org", ".example.org"},
+		{"notexample.org", "regexp:example"},
+		{"a1.example.com", "*.example.com"}, // wildcards before regexps
+		{"a1.other.com", "regexp:^a\\d+\\."},
+		{"a1.example.net", "regexp:^a\\d+\\."}, // regexps in the added order
+		{"exact.example.net", "Exact.Example.Net."},
+		{"other.com", ""},
+	}
+	for _, tt := range tests {
+		val, ok := m.Match(tt.domain)
+		if !ok || val != tt.expect {
+			t.Errorf("match %s = %q %t, want %q", tt.domain, val, ok, tt.expect)
+		}
+	}
+	if def, ok := m.Default(); !ok || def != "" {
+		t.Errorf("default = %q %t", def, ok)
+	}
+}
+
+func TestDomainMatcherNoDefault(t *testing.T) {
+	m := NewDomainMatcher[int]()
+	if err := m.Add("*.example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"example.com", "other.com", ""} {
+		if val, ok := m.Match(domain); ok {
+			t.Errorf("match %q = %d", domain, val)
+		}
+	}
+	if _, ok := m.Default(); ok {
+		t.Error("default without a default pattern")
+	}
+}
+
+func TestDomainMatcherAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		wantErr  bool
+	}{
+		{"different", []string{"example.com", "*.example.com", "regexp:example", ""}, false},
+		{"wildcard and suffix", []string{"*.example.com", ".example.com"}, true},
+		{"suffix and wildcard", []string{".example.com", "*.example.com"}, true},
+		{"wildcard of sub and suffix", []string{"*.sub.example.com", ".example.com"}, false},
+		{"exact", []string{"example.com", "EXAMPLE.com."}, true},
+		{"wildcard", []string{"*.example.com", "*.Example.com."}, true},
+		{"default", []string{"", "."}, true},
+		{"regexp", []string{"regexp:example", "regexp:example"}, true},
+		{"regexp is case sensitive", []string{"regexp:example", "regexp:Example"}, false},
+		{"invalid regexp", []string{"regexp:("}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewDomainMatcher[int]()
+			var err error
+			for i, pattern := range tt.patterns {
+				if err = m.Add(pattern, i); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		expect  string
+	}{
+		{"Example.COM.", "example.com"},
+		{"*.Example.com", "*.example.com"},
+		{".example.com.", ".example.com"},
+		{"", ""},
+		{"regexp:^Www\\.$", "regexp:^Www\\.$"},
+	}
+	for _, tt := range tests {
+		if got := NormalizePattern(tt.pattern); got != tt.expect {
+			t.Errorf("NormalizePattern(%q) = %q, want %q", tt.pattern, got, tt.expect)
+		}
+	}
+}
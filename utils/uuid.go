@@ -0,0 +1,12 @@
+package utils
+
+import "github.com/gofrs/uuid/v5"
+
+// UUIDFromString parses s as an uuid, or maps any other string to an UUIDv5 like Xray does
+func UUIDFromString(s string) uuid.UUID {
+	u := uuid.FromStringOrNil(s)
+	if u == uuid.Nil {
+		u = uuid.NewV5(u, s)
+	}
+	return u
+}
@@ -10,13 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/wwqgtxx/wstunnel/h2"
 	"github.com/wwqgtxx/wstunnel/peek"
 	"github.com/wwqgtxx/wstunnel/proxy"
 
@@ -77,7 +78,7 @@ func (w *WebsocketConn) Read(p []byte) (n int, err error) {
 			continue
 		}
 		if header.OpCode&(ws.OpBinary|ws.OpText) == 0 {
-			log.Println("unknown msgType")
+			slog.Debug("unknown msgType", "op", header.OpCode)
 			err = w.reader.Discard()
 			if err != nil {
 				return
@@ -144,6 +145,13 @@ func (w *WebsocketConn) ToWriter() io.Writer {
 }
 
 func ServerWebsocketUpgrade(w http.ResponseWriter, r *http.Request) (*WebsocketConn, error) {
+	if h2.IsWebSocketConnect(r) {
+		conn, err := h2.Upgrade(w, r)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebsocketConn(conn, ws.StateServerSide, false), nil
+	}
 	var conn net.Conn
 	var rw *bufio.ReadWriter
 	var err error
@@ -176,11 +184,11 @@ func ServerWebsocketUpgrade(w http.ResponseWriter, r *http.Request) (*WebsocketC
 }
 
 func IsWebSocketUpgrade(r *http.Request) bool {
-	return r.Header.Get("Upgrade") == "websocket"
+	return r.Header.Get("Upgrade") == "websocket" || h2.IsWebSocketConnect(r)
 }
 
 func IsV2rayHttpUpdate(r *http.Request) bool {
-	return IsWebSocketUpgrade(r) && r.Header.Get("Sec-WebSocket-Key") == ""
+	return r.Header.Get("Upgrade") == "websocket" && r.Header.Get("Sec-WebSocket-Key") == ""
 }
 
 func ClientWebsocketDial(ctx context.Context, uri url.URL, cHeaders http.Header, dialer proxy.ContextDialer, tlsConfig *tls.Config, v2rayHttpUpgrade bool) (net.Conn, http.Header, error) {
@@ -287,7 +295,17 @@ func ClientWebsocketDial(ctx context.Context, uri url.URL, cHeaders http.Header,
 		}
 	}
 
-	return NewWebsocketConn(conn, ws.StateClientSide, false), response.Header, nil
+	// the frames sent by server right after the response may be already buffered
+	return NewWebsocketConn(peek.WarpConnWithBioReader(conn, bufferedConn.Reader()), ws.StateClientSide, false), response.Header, nil
+}
+
+// ClientWebsocketDialH2 opens a WebSocket as a stream of the shared HTTP/2 connections of h2Client
+func ClientWebsocketDialH2(ctx context.Context, h2Client *h2.Client, uri url.URL, cHeaders http.Header) (net.Conn, http.Header, error) {
+	conn, respHeader, err := h2Client.Dial(ctx, uri, cHeaders)
+	if err != nil {
+		return nil, respHeader, err
+	}
+	return NewWebsocketConn(conn, ws.StateClientSide, false), respHeader, nil
 }
 
 func getSecAccept(secKey string) string {